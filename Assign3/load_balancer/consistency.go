@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	consistencyPrimary = "primary"
+	consistencyAny     = "any"
+	consistencyBounded = "bounded"
+)
+
+var (
+	appliedPoll  = time.Duration(envInt("APPLIED_POLL_MS", 500)) * time.Millisecond
+	appliedIndex = make(map[string]map[string]int)
+	appliedLock  = &sync.RWMutex{}
+)
+
+// pollApplied keeps track of how far every server has applied the log of each of its shards
+func pollApplied() {
+	client := &http.Client{Timeout: appliedPoll}
+	for {
+		time.Sleep(appliedPoll)
+		addRmLock.Lock()
+		var servers []string
+		for server := range lb.serverShards() {
+			servers = append(servers, server)
+		}
+		addRmLock.Unlock()
+		for _, server := range servers {
+			fetchApplied(client, server)
+		}
+	}
+}
+
+func fetchApplied(client *http.Client, server string) {
+	res, err := client.Get(fmt.Sprintf("http://%s:5000/applied", server))
+	if err != nil {
+		return
+	}
+	var applied map[string]int
+	err = json.NewDecoder(res.Body).Decode(&applied)
+	_ = res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK {
+		return
+	}
+	appliedLock.Lock()
+	appliedIndex[server] = applied
+	appliedLock.Unlock()
+}
+
+// readOptions checks the options shared by /read and /query and returns the session token,
+// taken from the Session-Token header or the session field. It answers 400 when one is
+// invalid.
+func readOptions(c *gin.Context, consistency string, token string, limit int) (sessionToken, bool) {
+	switch consistency {
+	case "", consistencyAny, consistencyPrimary, consistencyBounded:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> consistency must be primary, any or bounded", "status": "failure"})
+		return nil, false
+	}
+	if limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> limit must not be negative", "status": "failure"})
+		return nil, false
+	}
+	if header := c.GetHeader("Session-Token"); header != "" {
+		token = header
+	}
+	session, ok := parseSession(token)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> invalid session token", "status": "failure"})
+		return nil, false
+	}
+	return session, true
+}
+
+func getApplied(server string, shard_ string) (int, bool) {
+	appliedLock.RLock()
+	defer appliedLock.RUnlock()
+	index, ok := appliedIndex[server][shard_]
+	return index, ok
+}
+
+// pickReplica chooses the server a read of the shard goes to. primary always reads from the
+// primary, any picks a replica through the consistent hash map and bounded only considers
+// replicas whose applied index is within maxLag entries of the primary, falling back to the
+// primary when none is. A replica must also have applied minIndex entries, the position a
+// session token asks for. The caller holds the shard read lock.
+func pickReplica(shard_ string, consistency string, maxLag int, minIndex int) (string, error) {
+	switch consistency {
+	case "", consistencyAny:
+		if minIndex == 0 {
+			return lb.getServerID(shard_), nil
+		}
+		server := pickCaughtUp(shard_, minIndex, func(string, int) bool { return true })
+		if server == "" {
+			log.Printf("No replica of %s has applied %d entries", shard_, minIndex)
+			return getPrimary(shard_)
+		}
+		return server, nil
+	case consistencyPrimary:
+		return getPrimary(shard_)
+	case consistencyBounded:
+		primary, err := getPrimary(shard_)
+		if err != nil {
+			return "", err
+		}
+		primaryIndex, ok := getApplied(primary, shard_)
+		if !ok {
+			return primary, nil
+		}
+		server := pickCaughtUp(shard_, minIndex, func(server string, index int) bool {
+			return primaryIndex-index <= maxLag
+		})
+		if server == "" {
+			log.Printf("No replica of %s within %d entries of the primary", shard_, maxLag)
+			return primary, nil
+		}
+		return server, nil
+	}
+	return "", fmt.Errorf("unknown consistency level %s", consistency)
+}
+
+// pickCaughtUp picks a replica that has applied at least minIndex entries of the shard and
+// passes the check, or returns "" so the read goes to the primary, which applies every entry
+// before acknowledging it. Replicas behind are asked again for up to sessionWait.
+func pickCaughtUp(shard_ string, minIndex int, check func(string, int) bool) string {
+	client := &http.Client{Timeout: sessionWait}
+	deadline := time.Now().Add(sessionWait)
+	for {
+		eligible := make(map[string]bool)
+		var behind []string
+		metaData, _ := lb.shard(shard_)
+		for server := range metaData.servers {
+			index, ok := getApplied(server, shard_)
+			if !ok {
+				if minIndex != 0 {
+					behind = append(behind, server)
+				}
+				continue
+			}
+			if index < minIndex {
+				behind = append(behind, server)
+				continue
+			}
+			if check(server, index) {
+				eligible[server] = true
+			}
+		}
+		if server := lb.getServerIDFrom(shard_, eligible); server != "" {
+			return server
+		}
+		if len(behind) == 0 || !time.Now().Before(deadline) {
+			return ""
+		}
+		time.Sleep(sessionPoll)
+		for _, server := range behind {
+			fetchApplied(client, server)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// routedShard maps servers to shard sh1 of a new balancer
+func routedShard(servers ...string) *loadBalancer {
+	balancer := &loadBalancer{shards: map[string]*shardMetaData{
+		"sh1": {Shard_id: "sh1", hashmap: new([M]string), servers: make(map[string]bool), rw: &sync.RWMutex{}},
+	}}
+	for _, server := range servers {
+		balancer.insertServer(server, "sh1")
+	}
+	return balancer
+}
+
+func TestGetServerIDFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		servers  []string
+		eligible []string
+	}{
+		{"every replica", []string{"Server0", "Server1", "Server2"}, []string{"Server0", "Server1", "Server2"}},
+		{"one caught up", []string{"Server0", "Server1", "Server2"}, []string{"Server1"}},
+		{"none caught up", []string{"Server0", "Server1"}, nil},
+		{"eligible but not mapped", []string{"Server0"}, []string{"Server3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			balancer := routedShard(tt.servers...)
+			eligible := make(map[string]bool)
+			for _, server := range tt.eligible {
+				eligible[server] = true
+			}
+			mapped := make(map[string]bool)
+			for _, server := range tt.servers {
+				mapped[server] = true
+			}
+			candidates := 0
+			for server := range eligible {
+				if mapped[server] {
+					candidates++
+				}
+			}
+			picked := make(map[string]bool)
+			for i := 0; i < 200; i++ {
+				server := balancer.getServerIDFrom("sh1", eligible)
+				if (server == "") != (candidates == 0) || server != "" && !(eligible[server] && mapped[server]) {
+					t.Fatalf("picked %q out of %v", server, tt.eligible)
+				}
+				picked[server] = true
+			}
+			if candidates != 0 && len(picked) != candidates {
+				t.Errorf("picked %v, want every one of %d eligible replicas", picked, candidates)
+			}
+		})
+	}
+}
+
+func TestGetApplied(t *testing.T) {
+	appliedLock.Lock()
+	appliedIndex = map[string]map[string]int{"Server0": {"sh1": 7, "sh2": 0}}
+	appliedLock.Unlock()
+	tests := []struct {
+		server string
+		shard  string
+		index  int
+		ok     bool
+	}{
+		{"Server0", "sh1", 7, true},
+		{"Server0", "sh2", 0, true},
+		{"Server0", "sh3", 0, false},
+		{"Server1", "sh1", 0, false},
+	}
+	for _, tt := range tests {
+		index, ok := getApplied(tt.server, tt.shard)
+		if index != tt.index || ok != tt.ok {
+			t.Errorf("%s %s: got %d, %v, want %d, %v", tt.server, tt.shard, index, ok, tt.index, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const coordinatorPath = "/data/coordinator.log"
+
+var (
+	coordinatorLog  *os.File
+	coordinatorLock = &sync.Mutex{}
+	pendingTxns     = make(map[string]txnRecord)
+	activeTxns      = make(map[string]bool)
+)
+
+// openCoordinatorLog loads the transactions that were not resolved before a crash and
+// rewrites the log with only those
+func openCoordinatorLog() error {
+	data, err := os.ReadFile(coordinatorPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record txnRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// torn last line, the transaction never got past it
+			log.Printf("Skipping coordinator log entry: %v", err)
+			continue
+		}
+		if record.State == "end" {
+			delete(pendingTxns, record.Tx_id)
+			continue
+		}
+		pendingTxns[record.Tx_id] = record
+	}
+	coordinatorLog, err = os.OpenFile(coordinatorPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	for _, record := range pendingTxns {
+		jsonData, _ := json.Marshal(record)
+		_, err = coordinatorLog.Write(append(jsonData, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	if len(pendingTxns) != 0 {
+		log.Printf("%d in-doubt transactions found in coordinator log", len(pendingTxns))
+	}
+	return coordinatorLog.Sync()
+}
+
+// logTxn durably records a coordinator decision before it is acted on
+func logTxn(record txnRecord) error {
+	coordinatorLock.Lock()
+	defer coordinatorLock.Unlock()
+	jsonData, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = coordinatorLog.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+	err = coordinatorLog.Sync()
+	if err != nil {
+		return err
+	}
+	if record.State == "end" {
+		delete(pendingTxns, record.Tx_id)
+	} else {
+		pendingTxns[record.Tx_id] = record
+	}
+	return nil
+}
+
+func newTxId() string {
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Intn(1000000))
+}
+
+// sendTxn sends one two-phase commit message to the primary of the shard. Callers hold
+// the shard lock when the shard is known to the balancer.
+func sendTxn(path string, body txnPayload, key string) (int, []byte, error) {
+	primary, err := getPrimary(body.Shard)
+	if err != nil {
+		return 0, nil, err
+	}
+	dataToSend, err := json.Marshal(body)
+	if err != nil {
+		return 0, nil, err
+	}
+	log.Printf("sending %s for transaction %s to %s\n", path, body.Tx_id, primary)
+	// every message is idempotent on the participant, so a lost answer can be resent
+	return defaultRetry.send(context.Background(), http.MethodPost, fmt.Sprintf("http://%s:5000%s", primary, path), dataToSend, txnHeaders(body.Shard, key), acceptAnswer)
+}
+
+// txnHeaders carries the term of the shard and the client key of the batch, scoped to the
+// shard like setIdempotencyKey does for plain writes
+func txnHeaders(shard_ string, key string) map[string]string {
+	headers := map[string]string{"Term": strconv.Itoa(termOf(shard_))}
+	if key != "" {
+		headers["Idempotency-Key"] = key + ":" + shard_
+	}
+	return headers
+}
+
+// finishTxn sends the logged decision to every participant and ends the transaction once
+// all of them acknowledged it. The log position each shard reached is added to session.
+func finishTxn(record txnRecord, session sessionToken) bool {
+	path := "/abort"
+	if record.State == "commit" {
+		path = "/commit"
+	}
+	done := true
+	for _, shard_ := range record.Shards {
+		status, resp, err := sendTxn(path, txnPayload{Shard: shard_, Tx_id: record.Tx_id}, record.Key)
+		if err != nil || status != http.StatusOK {
+			log.Printf("Error sending %s for transaction %s to shard %s: %v", path, record.Tx_id, shard_, err)
+			done = false
+			continue
+		}
+		session.advance(shard_, logIndex(resp))
+	}
+	if !done {
+		return false
+	}
+	err := logTxn(txnRecord{Tx_id: record.Tx_id, State: "end"})
+	if err != nil {
+		log.Printf("Error logging end of transaction %s: %v", record.Tx_id, err)
+	}
+	return true
+}
+
+// resolvePending keeps retrying the decision of in-doubt transactions. A transaction that
+// never logged commit is presumed aborted.
+func resolvePending() {
+	for {
+		coordinatorLock.Lock()
+		var records []txnRecord
+		for _, record := range pendingTxns {
+			if !activeTxns[record.Tx_id] {
+				records = append(records, record)
+			}
+		}
+		coordinatorLock.Unlock()
+		for _, record := range records {
+			if record.State == "begin" {
+				record.State = "abort"
+				err := logTxn(record)
+				if err != nil {
+					log.Printf("Error logging abort of transaction %s: %v", record.Tx_id, err)
+					continue
+				}
+			}
+			resolveTxn(record)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func resolveTxn(record txnRecord) {
+	// lock the shards that are already routed by this balancer
+	for _, shard_ := range record.Shards {
+		if metaData, ok := lb.shard(shard_); ok {
+			metaData.rw.Lock()
+			defer metaData.rw.Unlock()
+		}
+	}
+	finishTxn(record, make(sessionToken))
+}
+
+// atomicWrite commits the rows of every shard or none of them. The caller holds the locks
+// of all shards involved.
+func atomicWrite(c *gin.Context, dataToWriteToShards map[string][]student, session sessionToken) {
+	record := txnRecord{Tx_id: newTxId(), State: "begin", Key: c.GetHeader("Idempotency-Key")}
+	for shard_ := range dataToWriteToShards {
+		record.Shards = append(record.Shards, shard_)
+	}
+	// keep the resolver away until this request has sent its decision once
+	coordinatorLock.Lock()
+	activeTxns[record.Tx_id] = true
+	coordinatorLock.Unlock()
+	defer func() {
+		coordinatorLock.Lock()
+		delete(activeTxns, record.Tx_id)
+		coordinatorLock.Unlock()
+	}()
+	err := logTxn(record)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error writing coordinator log", "status": "failure"})
+		return
+	}
+	failed := make(map[string]interface{})
+	for shard_, data := range dataToWriteToShards {
+		status, resp, err := sendTxn("/prepare", txnPayload{Shard: shard_, Tx_id: record.Tx_id, Data: data}, record.Key)
+		if err != nil {
+			failed[shard_] = err.Error()
+			continue
+		}
+		if status != http.StatusOK {
+			var reason interface{}
+			if json.Unmarshal(resp, &reason) != nil {
+				reason = string(resp)
+			}
+			failed[shard_] = reason
+		}
+	}
+	record.State = "commit"
+	if len(failed) != 0 {
+		record.State = "abort"
+	}
+	err = logTxn(record)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error writing coordinator log", "tx_id": record.Tx_id, "status": "failure"})
+		return
+	}
+	if !finishTxn(record, session) {
+		log.Printf("Transaction %s is in doubt, will retry %s", record.Tx_id, record.State)
+	}
+	if record.State == "abort" {
+		c.JSON(http.StatusConflict, gin.H{"message": "Transaction aborted", "tx_id": record.Tx_id, "failed": failed, "status": "failure"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Data entries added", "tx_id": record.Tx_id, "session": setSession(c, session), "status": "success"})
+}
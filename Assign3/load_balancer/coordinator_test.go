@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTxnHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want map[string]string
+	}{
+		{"no key", "", map[string]string{"Term": "0"}},
+		{"key scoped to the shard", "batch-7", map[string]string{"Term": "0", "Idempotency-Key": "batch-7:sh2"}},
+	}
+	for _, tt := range tests {
+		if got := txnHeaders("sh2", tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
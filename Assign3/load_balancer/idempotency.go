@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	idempotencyRetention = time.Duration(envInt("IDEMPOTENCY_RETENTION", 600)) * time.Second
+	idempotencyLock      = &sync.Mutex{}
+	idempotencyKeys      = make(map[string]*idempotencyEntry)
+)
+
+// idempotencyEntry is the stored outcome of a request sent with an Idempotency-Key. done is
+// closed once the first request finished.
+type idempotencyEntry struct {
+	hash    [sha256.Size]byte
+	status  int
+	body    []byte
+	done    chan struct{}
+	expires time.Time
+}
+
+// captureWriter keeps a copy of the response so it can be replayed
+type captureWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// storable tells whether a response is the final answer to a request and may be replayed.
+// Timeouts, misdirected requests, throttling and server errors may pass when the request is
+// resent, and so may a 409 that carries Retry-After, such as a row held by a prepared
+// transaction. Other 409s are a real conflict, like a failed If-Match.
+func storable(status int, header http.Header) bool {
+	switch {
+	case status >= 200 && status < 300:
+		return true
+	case status == http.StatusBadRequest, status == http.StatusNotFound:
+		return true
+	case status == http.StatusConflict:
+		return header.Get("Retry-After") == ""
+	}
+	return false
+}
+
+// idempotent replays the stored response when a request is resent with the same
+// Idempotency-Key, and waits for the first one if it is still running. Responses that are
+// not storable are dropped once the first request finished, so a resend runs again. The
+// servers run the same middleware, `make sync-shared` copies this file into the server.
+func idempotent(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.Next()
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, failureBody("Error reading request body"))
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	scope := c.Request.Method + " " + c.FullPath() + " " + key
+	hash := sha256.Sum256(body)
+
+	idempotencyLock.Lock()
+	entry, ok := idempotencyKeys[scope]
+	if ok {
+		idempotencyLock.Unlock()
+		if entry.hash != hash {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, failureBody("Idempotency-Key was used for a different request"))
+			return
+		}
+		<-entry.done
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(entry.status, "application/json; charset=utf-8", entry.body)
+		c.Abort()
+		return
+	}
+	entry = &idempotencyEntry{hash: hash, done: make(chan struct{})}
+	idempotencyKeys[scope] = entry
+	idempotencyLock.Unlock()
+
+	writer := &captureWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+	c.Writer = writer
+	c.Next()
+
+	idempotencyLock.Lock()
+	if !storable(writer.Status(), writer.Header()) {
+		delete(idempotencyKeys, scope)
+	}
+	entry.status = writer.Status()
+	entry.body = writer.body.Bytes()
+	entry.expires = time.Now().Add(idempotencyRetention)
+	close(entry.done)
+	idempotencyLock.Unlock()
+}
+
+// expireIdempotencyKeys forgets stored responses once the retention window has passed
+func expireIdempotencyKeys() {
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+		idempotencyLock.Lock()
+		for scope, entry := range idempotencyKeys {
+			select {
+			case <-entry.done:
+				if now.After(entry.expires) {
+					delete(idempotencyKeys, scope)
+				}
+			default:
+			}
+		}
+		idempotencyLock.Unlock()
+	}
+}
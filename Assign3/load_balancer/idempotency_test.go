@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// idempotencyRouter answers POST /write with each status of statuses in turn and counts the
+// requests that reached the handler
+func idempotencyRouter(t *testing.T, calls *int, statuses ...int) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	idempotencyLock.Lock()
+	idempotencyKeys = make(map[string]*idempotencyEntry)
+	idempotencyLock.Unlock()
+	router := gin.New()
+	router.POST("/write", idempotent, func(c *gin.Context) {
+		status := statuses[*calls%len(statuses)]
+		*calls++
+		c.JSON(status, gin.H{"call": *calls})
+	})
+	return router
+}
+
+func send(router *gin.Engine, key string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/write", strings.NewReader(body))
+	if key != "" {
+		request.Header.Set("Idempotency-Key", key)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestIdempotent(t *testing.T) {
+	type attempt struct {
+		key      string
+		body     string
+		status   int
+		replayed bool
+	}
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts []attempt
+		calls    int
+	}{
+		{"replayed", []int{http.StatusOK}, []attempt{
+			{"k1", `{"a":1}`, http.StatusOK, false},
+			{"k1", `{"a":1}`, http.StatusOK, true},
+		}, 1},
+		{"without a key", []int{http.StatusOK}, []attempt{
+			{"", `{"a":1}`, http.StatusOK, false},
+			{"", `{"a":1}`, http.StatusOK, false},
+		}, 2},
+		{"other keys run", []int{http.StatusOK}, []attempt{
+			{"k1", `{"a":1}`, http.StatusOK, false},
+			{"k2", `{"a":1}`, http.StatusOK, false},
+		}, 2},
+		{"different body", []int{http.StatusOK}, []attempt{
+			{"k1", `{"a":1}`, http.StatusOK, false},
+			{"k1", `{"a":2}`, http.StatusUnprocessableEntity, false},
+		}, 1},
+		{"server error retried", []int{http.StatusServiceUnavailable, http.StatusOK}, []attempt{
+			{"k1", `{"a":1}`, http.StatusServiceUnavailable, false},
+			{"k1", `{"a":1}`, http.StatusOK, false},
+			{"k1", `{"a":1}`, http.StatusOK, true},
+		}, 2},
+		{"client error replayed", []int{http.StatusBadRequest, http.StatusOK}, []attempt{
+			{"k1", `{"a":1}`, http.StatusBadRequest, false},
+			{"k1", `{"a":1}`, http.StatusBadRequest, true},
+		}, 1},
+		{"misdirected retried", []int{http.StatusMisdirectedRequest, http.StatusOK}, []attempt{
+			{"k1", `{"a":1}`, http.StatusMisdirectedRequest, false},
+			{"k1", `{"a":1}`, http.StatusOK, false},
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			router := idempotencyRouter(t, &calls, tt.statuses...)
+			var first string
+			for i, attempt := range tt.attempts {
+				recorder := send(router, attempt.key, attempt.body)
+				if recorder.Code != attempt.status {
+					t.Errorf("attempt %d: got status %d, want %d", i, recorder.Code, attempt.status)
+				}
+				replayed := recorder.Header().Get("Idempotent-Replayed") == "true"
+				if replayed != attempt.replayed {
+					t.Errorf("attempt %d: got replayed %v, want %v", i, replayed, attempt.replayed)
+				}
+				if replayed && recorder.Body.String() != first {
+					t.Errorf("attempt %d: replayed %s, want %s", i, recorder.Body.String(), first)
+				}
+				if !replayed {
+					first = recorder.Body.String()
+				}
+			}
+			if calls != tt.calls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		storable   bool
+	}{
+		{"ok", http.StatusOK, "", true},
+		{"partial", http.StatusMultiStatus, "", true},
+		{"bad request", http.StatusBadRequest, "", true},
+		{"not found", http.StatusNotFound, "", true},
+		{"version conflict", http.StatusConflict, "", true},
+		{"row held by a transaction", http.StatusConflict, "1", false},
+		{"timeout", http.StatusRequestTimeout, "", false},
+		{"misdirected", http.StatusMisdirectedRequest, "", false},
+		{"unprocessable", http.StatusUnprocessableEntity, "", false},
+		{"throttled", http.StatusTooManyRequests, "", false},
+		{"server error", http.StatusInternalServerError, "", false},
+		{"unavailable", http.StatusServiceUnavailable, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			if tt.retryAfter != "" {
+				header.Set("Retry-After", tt.retryAfter)
+			}
+			if got := storable(tt.status, header); got != tt.storable {
+				t.Errorf("got %v, want %v", got, tt.storable)
+			}
+		})
+	}
+}
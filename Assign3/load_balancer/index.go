@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var (
+	indexedColumns = make(map[string]bool)
+	indexedLock    = &sync.RWMutex{}
+)
+
+// loadIndexedColumns reads the secondary indexes declared in map_db
+func loadIndexedColumns() error {
+	var indexTs []IndexT
+	err := mapdb.Model(&IndexT{}).Find(&indexTs).Error
+	if err != nil {
+		return err
+	}
+	indexedLock.Lock()
+	defer indexedLock.Unlock()
+	for _, indexT := range indexTs {
+		indexedColumns[indexT.Column] = true
+	}
+	return nil
+}
+
+func isIndexed(column string) bool {
+	indexedLock.RLock()
+	defer indexedLock.RUnlock()
+	return indexedColumns[column]
+}
+
+// indexHandler declares a secondary index on a column in map_db and has every server build
+// it. Servers that join later build it when their shards are configured.
+func indexHandler(c *gin.Context) {
+	var payload struct {
+		Column string
+	}
+	jsonString := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonString), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
+		return
+	}
+	switch payload.Column {
+	case "Stud_name", "Stud_marks", "Version":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> column must be Stud_name, Stud_marks or Version", "status": "failure"})
+		return
+	}
+	err = mapdb.Clauses(clause.OnConflict{DoNothing: true}).Create(&IndexT{Column: payload.Column}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error declaring index", "status": "failure"})
+		return
+	}
+	indexedLock.Lock()
+	indexedColumns[payload.Column] = true
+	indexedLock.Unlock()
+
+	addRmLock.Lock()
+	var servers []string
+	for server := range lb.serverShards() {
+		servers = append(servers, server)
+	}
+	addRmLock.Unlock()
+	body, _ := json.Marshal(payload)
+	failed := []string{}
+	for _, server := range servers {
+		_, _, err := defaultRetry.send(c.Request.Context(), http.MethodPost, fmt.Sprintf("http://%s:5000/index", server), body, nil, acceptOK)
+		if err != nil {
+			// lookups treat shards without the index as possible matches
+			log.Printf("Error building index on %s at %s: %v", payload.Column, server, err)
+			failed = append(failed, server)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Index on " + payload.Column + " declared", "failed": failed, "status": "success"})
+}
+
+// lookupShards asks one replica of each shard which rows hold the value of an indexed
+// column. Shards that could not answer from an index are returned as unknown.
+func lookupShards(shards []string, column string, value interface{}, consistency string, maxLag int, session sessionToken) (map[string][]int, []string) {
+	replies := scatter(shards, "/lookup", func(shard_ string) (string, interface{}, error) {
+		server, err := pickReplica(shard_, consistency, maxLag, session[shard_])
+		return server, lookupPayload{Shard: shard_, Column: column, Value: value}, err
+	})
+	ids := make(map[string][]int)
+	unknown := []string{}
+	for _, reply := range replies {
+		var respBody struct {
+			Ids []int
+		}
+		if reply.err == nil {
+			reply.err = json.Unmarshal(reply.body, &respBody)
+		}
+		if reply.err != nil {
+			log.Printf("Error looking up %s in shard %s: %v", column, reply.shard, reply.err)
+			unknown = append(unknown, reply.shard)
+			continue
+		}
+		if len(respBody.Ids) != 0 {
+			ids[reply.shard] = respBody.Ids
+		}
+	}
+	return ids, unknown
+}
+
+// pruneByIndex drops the shards an equality predicate on an indexed column rules out
+func pruneByIndex(shards []string, where []predicate, consistency string, maxLag int, session sessionToken) []string {
+	for _, pred := range where {
+		if pred.Op != "=" || !isIndexed(pred.Column) {
+			continue
+		}
+		ids, unknown := lookupShards(shards, pred.Column, pred.Value, consistency, maxLag, session)
+		keep := make(map[string]bool)
+		for shard_ := range ids {
+			keep[shard_] = true
+		}
+		for _, shard_ := range unknown {
+			keep[shard_] = true
+		}
+		var pruned []string
+		for _, shard_ := range shards {
+			if keep[shard_] {
+				pruned = append(pruned, shard_)
+			}
+		}
+		shards = pruned
+	}
+	if shards == nil {
+		return []string{}
+	}
+	return shards
+}
+
+// lookupHandler finds the shards, and the Stud_ids in them, holding a value of an indexed
+// column without scanning any table
+func lookupHandler(c *gin.Context) {
+	var payload struct {
+		Column      string
+		Value       interface{}
+		Consistency string
+		Max_lag     int
+		Session     string
+	}
+	jsonString := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonString), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
+		return
+	}
+	session, ok := readOptions(c, payload.Consistency, payload.Session, 0)
+	if !ok {
+		return
+	}
+	if !isIndexed(payload.Column) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> no index on " + payload.Column, "status": "failure"})
+		return
+	}
+	ids, unknown := lookupShards(shardsMatching(nil), payload.Column, payload.Value, payload.Consistency, payload.Max_lag, session)
+	shards := []string{}
+	for shard_ := range ids {
+		shards = append(shards, shard_)
+	}
+	sort.Strings(shards)
+	c.JSON(http.StatusOK, gin.H{"shards": shards, "ids": ids, "unknown": unknown, "status": "success"})
+}
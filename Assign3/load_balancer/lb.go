@@ -7,6 +7,9 @@ import (
 )
 
 type loadBalancer struct {
+	// shardsLock guards the shards map and server_shard_mapping, the routing of each shard
+	// is guarded by its own rw
+	shardsLock           sync.RWMutex
 	shards               map[string]*shardMetaData
 	server_shard_mapping map[string]map[string]bool
 }
@@ -15,7 +18,6 @@ type shardMetaData struct {
 	Stud_id_high int
 	Shard_id     string
 	Shard_size   int
-	req_count    int
 	hashmap      *[M]string
 	servers      map[string]bool
 	rw           *sync.RWMutex
@@ -49,14 +51,77 @@ func Phi(i, j uint32) uint32 {
 	return H(i + H(j))
 }
 
+// shard looks up the routing of a shard
+func (lb *loadBalancer) shard(shard_id string) (*shardMetaData, bool) {
+	lb.shardsLock.RLock()
+	defer lb.shardsLock.RUnlock()
+	shard_, ok := lb.shards[shard_id]
+	return shard_, ok
+}
+
+// shardList copies the shards map, so callers can range over it without holding shardsLock
+func (lb *loadBalancer) shardList() map[string]*shardMetaData {
+	lb.shardsLock.RLock()
+	defer lb.shardsLock.RUnlock()
+	shards := make(map[string]*shardMetaData, len(lb.shards))
+	for shard_id, shard_ := range lb.shards {
+		shards[shard_id] = shard_
+	}
+	return shards
+}
+
+// putShard routes a shard, returning the routing already there if another request added it
+// first
+func (lb *loadBalancer) putShard(shard_ *shardMetaData) *shardMetaData {
+	lb.shardsLock.Lock()
+	defer lb.shardsLock.Unlock()
+	if lb.shards == nil {
+		lb.shards = make(map[string]*shardMetaData)
+	}
+	if existing, ok := lb.shards[shard_.Shard_id]; ok {
+		return existing
+	}
+	lb.shards[shard_.Shard_id] = shard_
+	return shard_
+}
+
+// configured tells whether the balancer routes any shards yet
+func (lb *loadBalancer) configured() bool {
+	lb.shardsLock.RLock()
+	defer lb.shardsLock.RUnlock()
+	return lb.shards != nil
+}
+
+// serverShards copies the shards mapped to each server
+func (lb *loadBalancer) serverShards() map[string][]string {
+	lb.shardsLock.RLock()
+	defer lb.shardsLock.RUnlock()
+	mapping := make(map[string][]string, len(lb.server_shard_mapping))
+	for server, shards := range lb.server_shard_mapping {
+		for shard_id := range shards {
+			mapping[server] = append(mapping[server], shard_id)
+		}
+	}
+	return mapping
+}
+
+// forgetServer drops a removed server from server_shard_mapping
+func (lb *loadBalancer) forgetServer(server string) {
+	lb.shardsLock.Lock()
+	defer lb.shardsLock.Unlock()
+	delete(lb.server_shard_mapping, server)
+}
+
 // method to insert server
 func (lb *loadBalancer) insertServer(server string, shard_id string) {
-	if _, ok := lb.shards[shard_id].servers[server]; ok {
+	shard_, _ := lb.shard(shard_id)
+	if _, ok := shard_.servers[server]; ok {
 		return
 	}
 	//add server to shard
-	lb.shards[shard_id].servers[server] = false
+	shard_.servers[server] = false
 	//add server to mapping
+	lb.shardsLock.Lock()
 	if _, ok := lb.server_shard_mapping[server]; !ok {
 		if lb.server_shard_mapping == nil {
 			lb.server_shard_mapping = make(map[string]map[string]bool)
@@ -64,17 +129,18 @@ func (lb *loadBalancer) insertServer(server string, shard_id string) {
 		lb.server_shard_mapping[server] = make(map[string]bool)
 	}
 	lb.server_shard_mapping[server][shard_id] = false
+	lb.shardsLock.Unlock()
 	// fit into hashmap
 	i := stringHash(server)
 	for j := 0; j < K; j++ {
 		pos := Phi(uint32(i), uint32(j)) % M
 		// linear probing
 		probe := pos
-		if lb.shards[shard_id].hashmap[pos] != "" {
+		if shard_.hashmap[pos] != "" {
 			probe++
 			for probe != pos {
-				if lb.shards[shard_id].hashmap[probe] == "" {
-					lb.shards[shard_id].hashmap[probe] = server
+				if shard_.hashmap[probe] == "" {
+					shard_.hashmap[probe] = server
 					break
 				}
 				probe++
@@ -82,33 +148,36 @@ func (lb *loadBalancer) insertServer(server string, shard_id string) {
 			}
 
 		} else {
-			lb.shards[shard_id].hashmap[probe] = server
+			shard_.hashmap[probe] = server
 		}
 	}
 }
 
 // method to remove server
 func (lb *loadBalancer) removeServer(server string, shard_id string) {
-	if _, ok := lb.shards[shard_id].servers[server]; !ok {
+	shard_, _ := lb.shard(shard_id)
+	if _, ok := shard_.servers[server]; !ok {
 		return
 	}
 	// remove server from shard
-	delete(lb.shards[shard_id].servers, server)
+	delete(shard_.servers, server)
 	// remove shard from server
+	lb.shardsLock.Lock()
 	delete(lb.server_shard_mapping[server], shard_id)
+	lb.shardsLock.Unlock()
 	// fit into hashmap
 	i := stringHash(server)
 	for j := 0; j < K; j++ {
 		pos := Phi(uint32(i), uint32(j)) % M
 		// linear probing
 		probe := pos
-		if lb.shards[shard_id].hashmap[pos] == server {
-			lb.shards[shard_id].hashmap[pos] = ""
+		if shard_.hashmap[pos] == server {
+			shard_.hashmap[pos] = ""
 		} else {
 			probe++
 			for probe != pos {
-				if lb.shards[shard_id].hashmap[probe] == server {
-					lb.shards[shard_id].hashmap[probe] = ""
+				if shard_.hashmap[probe] == server {
+					shard_.hashmap[probe] = ""
 					break
 				}
 				probe++
@@ -119,14 +188,29 @@ func (lb *loadBalancer) removeServer(server string, shard_id string) {
 }
 
 func (lb *loadBalancer) getServerID(shard_id string) string {
+	shard_, _ := lb.shard(shard_id)
 	// generate random number
 	rand.Seed(time.Now().UnixNano())
 	i := rand.Intn(512)
 	for {
-		if lb.shards[shard_id].hashmap[i] != "" {
-			return lb.shards[shard_id].hashmap[i]
+		if shard_.hashmap[i] != "" {
+			return shard_.hashmap[i]
 		}
 		i++
 		i %= M
 	}
 }
+
+// getServerIDFrom walks the hashmap from a random slot like getServerID but only returns
+// servers in the eligible set, or "" if none of them is mapped
+func (lb *loadBalancer) getServerIDFrom(shard_id string, eligible map[string]bool) string {
+	shard_, _ := lb.shard(shard_id)
+	i := rand.Intn(M)
+	for probe := 0; probe < M; probe++ {
+		server := shard_.hashmap[(i+probe)%M]
+		if server != "" && eligible[server] {
+			return server
+		}
+	}
+	return ""
+}
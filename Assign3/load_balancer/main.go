@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/mysql"
@@ -10,15 +12,21 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 )
 
 var (
 	lb        = &loadBalancer{}
 	mapdb     = &gorm.DB{}
 	addRmLock = &sync.Mutex{}
+	// placement changes spawn containers and are not safe to repeat, so the shard manager
+	// gets one long attempt
+	managerCall = retryPolicy{attempts: 1, callTimeout: time.Duration(envInt("MANAGER_TIMEOUT_S", 300)) * time.Second}
 )
 
 func getJSONstring(c *gin.Context) string {
@@ -30,8 +38,13 @@ func getJSONstring(c *gin.Context) string {
 	return string(body)
 }
 
+// failureBody is how the balancer reports a failed request
+func failureBody(message string) gin.H {
+	return gin.H{"message": message, "status": "failure"}
+}
+
 func initHandler(c *gin.Context) {
-	if lb.shards != nil {
+	if lb.configured() {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Database already configured", "status": "failure"})
 		return
 	}
@@ -46,29 +59,31 @@ func initHandler(c *gin.Context) {
 	}
 	// send the payload to the shard manager as it is
 	// the shard manager will spawn the containers and configure them
-	res, err := http.Post("http://shard_manager:5000/init", "application/json", bytes.NewReader([]byte(jsonData)))
-	if err != nil || res.StatusCode != http.StatusOK {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error sending request to shard manager", "status": "failure"})
+	status, body, err := managerCall.send(c.Request.Context(), http.MethodPost, "http://shard_manager:5000/init", []byte(jsonData), nil, acceptAnswer)
+	if err != nil {
+		log.Printf("Error sending request to shard manager: %v", err)
+		c.JSON(retryStatus(err), gin.H{"message": "Error sending request to shard manager", "status": "failure"})
 		return
 	}
+	if status != http.StatusOK {
+		// the shard manager answers in the same format, pass its rejection on
+		c.Data(status, "application/json; charset=utf-8", body)
+		return
+	}
+	// the shard manager completes the placement, use the servers it decided on
+	var planned planResponse
+	err = json.Unmarshal(body, &planned)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error decoding shard manager response", "status": "failure"})
+		return
+	}
+	payload.Servers = planned.Servers
 	for _, shard_ := range payload.Shards {
-		if lb.shards == nil {
-			lb.shards = make(map[string]*shardMetaData)
-		}
-		lb.shards[shard_.Shard_id] = &shardMetaData{
-			Stud_id_low:  shard_.Stud_id_low,
-			Shard_id:     shard_.Shard_id,
-			Stud_id_high: shard_.Stud_id_low + shard_.Shard_size,
-			Shard_size:   shard_.Shard_size,
-			hashmap:      &[M]string{},
-			servers:      make(map[string]bool),
-			rw:           &sync.RWMutex{},
-			req_count:    0,
-		}
+		metaData := lb.putShard(newShard(shard_.Shard_id, shard_.Stud_id_low, shard_.Shard_size))
 		//lock mutex
-		lb.shards[shard_.Shard_id].rw.Lock()
+		metaData.rw.Lock()
 		//defer unlock mutex
-		defer lb.shards[shard_.Shard_id].rw.Unlock()
+		defer metaData.rw.Unlock()
 	}
 	for server, shard_list := range payload.Servers {
 		for _, shard_ := range shard_list {
@@ -81,26 +96,21 @@ func initHandler(c *gin.Context) {
 }
 
 func statusHandler(c *gin.Context) {
-	var shard_list []shard
-	for _, shard_ := range lb.shards {
-		shard_list = append(shard_list, shard{
-			Stud_id_low: shard_.Stud_id_low,
-			Shard_id:    shard_.Shard_id,
-			Shard_size:  shard_.Shard_size,
-		})
+	var shard_list []shardStatus
+	for _, shard_ := range lb.shardList() {
 		//read lock
 		shard_.rw.RLock()
 		//defer unlock
 		defer shard_.rw.RUnlock()
+		shard_list = append(shard_list, shardStatus{
+			Stud_id_low:     shard_.Stud_id_low,
+			Shard_id:        shard_.Shard_id,
+			Shard_size:      shard_.Shard_size,
+			Replicas:        len(shard_.servers),
+			Target_replicas: targetOf(shard_.Shard_id),
+		})
 	}
-	var server_list map[string][]string
-	server_list = make(map[string][]string)
-	for server, shard_list := range lb.server_shard_mapping {
-		server_list[server] = make([]string, 0)
-		for shard_ := range shard_list {
-			server_list[server] = append(server_list[server], shard_)
-		}
-	}
+	server_list := lb.serverShards()
 	c.JSON(http.StatusOK, gin.H{"N": len(server_list), "shards": shard_list, "servers": server_list})
 }
 
@@ -118,23 +128,12 @@ func addHandler(c *gin.Context) {
 	var effectedShards map[string]bool
 	effectedShards = make(map[string]bool)
 	for _, shard_ := range payload.New_shards {
-		if _, ok := lb.shards[shard_.Shard_id]; !ok {
-			lb.shards[shard_.Shard_id] = &shardMetaData{
-				Stud_id_low:  shard_.Stud_id_low,
-				Shard_id:     shard_.Shard_id,
-				Stud_id_high: shard_.Stud_id_low + shard_.Shard_size,
-				Shard_size:   shard_.Shard_size,
-				hashmap:      &[M]string{},
-				servers:      make(map[string]bool),
-				rw:           &sync.RWMutex{},
-				req_count:    0,
-			}
-		}
+		lb.putShard(newShard(shard_.Shard_id, shard_.Stud_id_low, shard_.Shard_size))
 		effectedShards[shard_.Shard_id] = true
 	}
 	for _, shard_list := range payload.Servers {
 		for _, shard_ := range shard_list {
-			if _, ok := lb.shards[shard_]; !ok {
+			if _, ok := lb.shard(shard_); !ok {
 				c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> Shard not found", "status": "failure"})
 				return
 			}
@@ -143,16 +142,30 @@ func addHandler(c *gin.Context) {
 	}
 	// lock effected shards
 	for shard_ := range effectedShards {
-		lb.shards[shard_].rw.Lock()
-		defer lb.shards[shard_].rw.Unlock()
+		metaData, _ := lb.shard(shard_)
+		metaData.rw.Lock()
+		defer metaData.rw.Unlock()
 	}
 	// send the payload to the shard manager as it is
 	// the shard manager will spawn the containers and configure them
-	_, err = http.Post("http://shard_manager:5000/add", "application/json", bytes.NewReader([]byte(jsonString)))
+	status, body, err := managerCall.send(c.Request.Context(), http.MethodPost, "http://shard_manager:5000/add", []byte(jsonString), nil, acceptAnswer)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error sending request to shard manager", "status": "failure"})
+		log.Printf("Error sending request to shard manager: %v", err)
+		c.JSON(retryStatus(err), gin.H{"message": "Error sending request to shard manager", "status": "failure"})
 		return
 	}
+	if status != http.StatusOK {
+		// the shard manager answers in the same format, pass its rejection on
+		c.Data(status, "application/json; charset=utf-8", body)
+		return
+	}
+	var planned planResponse
+	err = json.Unmarshal(body, &planned)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error decoding shard manager response", "status": "failure"})
+		return
+	}
+	payload.Servers = planned.Servers
 	for server, shard_list := range payload.Servers {
 		for _, shard_ := range shard_list {
 			lb.insertServer(server, shard_)
@@ -164,7 +177,7 @@ func addHandler(c *gin.Context) {
 		msgStr += server
 		msgStr += ", "
 	}
-	c.JSON(http.StatusOK, gin.H{"N": len(lb.server_shard_mapping), "message": msgStr, "status": "success"})
+	c.JSON(http.StatusOK, gin.H{"N": len(lb.serverShards()), "message": msgStr, "status": "success"})
 }
 
 func rmHandler(c *gin.Context) {
@@ -192,18 +205,12 @@ func rmHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> Length of server list is more than removable instances", "status": "failure"})
 		return
 	}
-	if payload.N >= len(lb.server_shard_mapping) {
+	if payload.N >= len(lb.serverShards()) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> Cannot remove all servers", "status": "failure"})
 		return
 	}
-	var shard_list map[string]map[string]bool
-	shard_list = make(map[string]map[string]bool)
-
-	var remainingServers map[string]bool
-	remainingServers = make(map[string]bool)
-
 	k := payload.N - len(toRemove)
-	for server := range lb.server_shard_mapping {
+	for server := range lb.serverShards() {
 		if k > 0 {
 			if _, ok := toRemove[server]; !ok {
 				toRemove[server] = false
@@ -211,56 +218,20 @@ func rmHandler(c *gin.Context) {
 			}
 			k--
 		}
-		if _, ok := toRemove[server]; !ok {
-			remainingServers[server] = false
-		}
-	}
-	var addReq addPayload
-	addReq.New_shards = make([]shard, 0)
-	addReq.Servers = make(map[string][]string)
-	addReq.N = 0
-	var backupServer string
-	// select one of remaining servers to add shards
-	for server := range remainingServers {
-		backupServer = server
-		addReq.Servers[backupServer] = make([]string, 0)
-		break
-	}
-	for _, shard_ := range lb.shards {
-		shard_list[shard_.Shard_id] = make(map[string]bool)
-		for server := range shard_.servers {
-			if _, ok := remainingServers[server]; ok {
-				shard_list[shard_.Shard_id][server] = false
-			}
-		}
-		if len(shard_list[shard_.Shard_id]) == 0 {
-			addReq.Servers[backupServer] = append(addReq.Servers[backupServer], shard_.Shard_id)
-		}
 	}
 	var effectedShards map[string]bool
 	effectedShards = make(map[string]bool)
-	for server, shards := range lb.server_shard_mapping {
+	for server, shards := range lb.serverShards() {
 		if _, ok := toRemove[server]; ok {
-			for shard_ := range shards {
+			for _, shard_ := range shards {
 				effectedShards[shard_] = true
 			}
 		}
 	}
 	for shard_ := range effectedShards {
-		lb.shards[shard_].rw.Lock()
-		defer lb.shards[shard_].rw.Unlock()
-	}
-	if len(addReq.Servers[backupServer]) != 0 {
-		// send add request to shard manager
-		jsonValue, _ := json.Marshal(addReq)
-		_, err = http.Post("http://shard_manager:5000/add", "application/json", bytes.NewBuffer(jsonValue))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error sending request to shard manager", "status": "failure"})
-			return
-		}
-		for _, shard_ := range addReq.Servers[backupServer] {
-			lb.insertServer(backupServer, shard_)
-		}
+		metaData, _ := lb.shard(shard_)
+		metaData.rw.Lock()
+		defer metaData.rw.Unlock()
 	}
 	//change payload to remove servers
 	payload.Servers = make([]string, 0)
@@ -268,12 +239,30 @@ func rmHandler(c *gin.Context) {
 		payload.Servers = append(payload.Servers, server)
 	}
 
+	// the shard manager re-replicates the shards of removed servers before removing them
 	jsonValue, _ := json.Marshal(payload)
-	_, err = http.Post("http://shard_manager:5000/rm", "application/json", bytes.NewBuffer(jsonValue))
+	status, body, err := managerCall.send(c.Request.Context(), http.MethodPost, "http://shard_manager:5000/rm", jsonValue, nil, acceptAnswer)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error sending request to shard manager", "status": "failure"})
+		log.Printf("Error sending request to shard manager: %v", err)
+		c.JSON(retryStatus(err), gin.H{"message": "Error sending request to shard manager", "status": "failure"})
 		return
 	}
+	if status != http.StatusOK {
+		// the shard manager answers in the same format, pass its rejection on
+		c.Data(status, "application/json; charset=utf-8", body)
+		return
+	}
+	var planned planResponse
+	err = json.Unmarshal(body, &planned)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error decoding shard manager response", "status": "failure"})
+		return
+	}
+	for server, shard_list := range planned.Added {
+		for _, shard_ := range shard_list {
+			lb.insertServer(server, shard_)
+		}
+	}
 	//remove servers from load balancer
 	for shard_ := range effectedShards {
 		for _, server := range payload.Servers {
@@ -281,10 +270,50 @@ func rmHandler(c *gin.Context) {
 		}
 	}
 	for _, server := range payload.Servers {
-		delete(lb.server_shard_mapping, server)
+		lb.forgetServer(server)
 	}
 	// return OK
-	c.JSON(http.StatusOK, gin.H{"N": len(lb.server_shard_mapping), "servers": payload.Servers, "status": "success"})
+	c.JSON(http.StatusOK, gin.H{"N": len(lb.serverShards()), "servers": payload.Servers, "status": "success"})
+}
+
+// syncHandler applies replica moves that the shard manager made on its own and the view it
+// pushes with them
+func syncHandler(c *gin.Context) {
+	addRmLock.Lock()
+	defer addRmLock.Unlock()
+	var payload syncPayload
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil {
+		fmt.Println("Error decoding JSON:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
+		return
+	}
+	for server, shard_list := range payload.Added {
+		for _, shard_ := range shard_list {
+			metaData, ok := lb.shard(shard_)
+			if !ok {
+				continue
+			}
+			metaData.rw.Lock()
+			lb.insertServer(server, shard_)
+			metaData.rw.Unlock()
+		}
+	}
+	for server, shard_list := range payload.Removed {
+		for _, shard_ := range shard_list {
+			metaData, ok := lb.shard(shard_)
+			if !ok {
+				continue
+			}
+			metaData.rw.Lock()
+			lb.removeServer(server, shard_)
+			metaData.rw.Unlock()
+		}
+	}
+	if payload.View != nil && applyView(payload.Version, payload.View) {
+		syncReplicas()
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Synced", "status": "success"})
 }
 
 func main() {
@@ -297,23 +326,53 @@ func main() {
 	r.POST("/add", addHandler)
 	r.DELETE("/rm", rmHandler)
 	r.POST("/read", readHandler)
-	r.POST("/write", writeHandler)
-	r.PUT("/update", updateHandler)
-	r.DELETE("/del", delHandler)
+	r.POST("/query", queryHandler)
+	r.POST("/aggregate", aggregateHandler)
+	r.POST("/index", indexHandler)
+	r.POST("/lookup", lookupHandler)
+	r.POST("/write", idempotent, writeHandler)
+	r.PUT("/update", idempotent, updateHandler)
+	r.DELETE("/del", idempotent, delHandler)
 	r.GET("/read/:server_id", getallHandler)
+	r.POST("/sync", syncHandler)
 	mapdb = initDB()
+	err := openCoordinatorLog()
+	if err != nil {
+		log.Fatalf("Error opening coordinator log: %v", err)
+	}
+	err = loadIndexedColumns()
+	if err != nil {
+		log.Fatalf("Error loading secondary indexes: %v", err)
+	}
+	err = loadView()
+	if err != nil {
+		log.Fatalf("Error loading shard view: %v", err)
+	}
+	err = loadShards()
+	if err != nil {
+		log.Fatalf("Error loading shards: %v", err)
+	}
+	go resolvePending()
+	go expireIdempotencyKeys()
+	go pollApplied()
+	go reconcileView()
 
 	port := "5000"
-	err := r.Run(":" + port)
+	err = r.Run(":" + port)
 	if err != nil {
 		log.Fatalf("Error starting Load Balancer: %v", err)
 	}
 }
 func initDB() *gorm.DB {
 	dsn := "root:abc@tcp(map_db)/map_db?charset=utf8mb4&parseTime=True&loc=Local"
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
-	for err != nil {
+	var db *gorm.DB
+	err := startupRetry.do(context.Background(), func(ctx context.Context) error {
+		var err error
 		db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
 	}
 	return db
 }
@@ -329,19 +388,13 @@ func delHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
 		return
 	}
-	for shard_ := range lb.shards {
-		if payload.Stud_id >= lb.shards[shard_].Stud_id_low && payload.Stud_id < lb.shards[shard_].Stud_id_high {
+	session := requestSession(c)
+	for shard_, metaData := range lb.shardList() {
+		if payload.Stud_id >= metaData.Stud_id_low && payload.Stud_id < metaData.Stud_id_high {
 			// lock shard
-			lb.shards[shard_].rw.Lock()
+			metaData.rw.Lock()
 			//defer unlock
-			defer lb.shards[shard_].rw.Unlock()
-			// send delete request to primary servers
-			var mapT MapT
-			err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Not("primary", false).First(&mapT).Error
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error getting primary server", "status": "failure"})
-				return
-			}
+			defer metaData.rw.Unlock()
 			var reqPayload delPayload
 			reqPayload.Shard = shard_
 			reqPayload.Stud_id = payload.Stud_id
@@ -351,40 +404,22 @@ func delHandler(c *gin.Context) {
 				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error marshalling data", "status": "failure"})
 				return
 			}
-			request, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s:5000/del", mapT.Server_id), bytes.NewReader(dataToSend))
+			// send delete request to primary servers
+			_, status, body, err := sendToPrimary(c, shard_, http.MethodDelete, "/del", dataToSend)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error creating delete request", "status": "failure"})
+				c.JSON(retryStatus(err), gin.H{"message": err.Error(), "status": "failure"})
 				return
 			}
-			request.Header.Set("Content-Type", "application/json")
-			lb.shards[shard_].req_count++
-			request.Header.Set("Request-Count", strconv.Itoa(lb.shards[shard_].req_count))
-			log.Printf("sending delete request to %s\n", mapT.Server_id)
-			do, err := http.DefaultClient.Do(request)
-			for err != nil || do.StatusCode != http.StatusOK {
-				var mapT MapT
-				err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Not("primary", false).First(&mapT).Error
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"message": "Error getting primary server", "status": "failure"})
-					return
-				}
-				request, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s:5000/del", mapT.Server_id), bytes.NewReader(dataToSend))
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"message": "Error creating delete request", "status": "failure"})
-					return
-				}
-				request.Header.Set("Content-Type", "application/json")
-				request.Header.Set("Request-Count", strconv.Itoa(lb.shards[shard_].req_count))
-				// retry
-				log.Printf("retrying delete request to %s\n", mapT.Server_id)
-				do, err = http.DefaultClient.Do(request)
+			if status != http.StatusOK {
+				c.Data(status, "application/json; charset=utf-8", body)
+				return
 			}
-
+			session.advance(shard_, logIndex(body))
 			break
 		}
 
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Data entry for Stud_id: " + strconv.Itoa(payload.Stud_id) + " removed from all replicas", "status": "success"})
+	c.JSON(http.StatusOK, gin.H{"message": "Data entry for Stud_id: " + strconv.Itoa(payload.Stud_id) + " removed from all replicas", "session": setSession(c, session), "status": "success"})
 
 }
 
@@ -400,19 +435,14 @@ func updateHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
 		return
 	}
-	for shard_ := range lb.shards {
-		if payload.Stud_id >= lb.shards[shard_].Stud_id_low && payload.Stud_id < lb.shards[shard_].Stud_id_high {
+	session := requestSession(c)
+	for shard_, metaData := range lb.shardList() {
+		if payload.Stud_id >= metaData.Stud_id_low && payload.Stud_id < metaData.Stud_id_high {
 			// lock shard
-			lb.shards[shard_].rw.Lock()
+			metaData.rw.Lock()
 			//defer unlock
-			defer lb.shards[shard_].rw.Unlock()
+			defer metaData.rw.Unlock()
 
-			var mapT MapT
-			err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Not("primary", false).First(&mapT).Error
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error getting primary server", "status": "failure"})
-				return
-			}
 			// send data to this server as put request
 			var reqPayload updatePayload
 			reqPayload.Shard = shard_
@@ -423,43 +453,122 @@ func updateHandler(c *gin.Context) {
 				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error marshalling data", "status": "failure"})
 				return
 			}
-			request, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s:5000/update", mapT.Server_id), bytes.NewReader(dataToSend))
+			_, status, body, err := sendToPrimary(c, shard_, http.MethodPut, "/update", dataToSend)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error creating put request", "status": "failure"})
+				c.JSON(retryStatus(err), gin.H{"message": err.Error(), "status": "failure"})
 				return
 			}
-			request.Header.Set("Content-Type", "application/json")
-			lb.shards[shard_].req_count++
-			request.Header.Set("Request-Count", strconv.Itoa(lb.shards[shard_].req_count))
-			log.Printf("sending update request to %s\n", mapT.Server_id)
-			do, err := http.DefaultClient.Do(request)
-			for err != nil || do.StatusCode != http.StatusOK {
-				var mapT MapT
-				err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Not("primary", false).First(&mapT).Error
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"message": "Error getting primary server", "status": "failure"})
-					return
-				}
-				request, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s:5000/update", mapT.Server_id), bytes.NewReader(dataToSend))
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"message": "Error creating put request", "status": "failure"})
-					return
-				}
-				request.Header.Set("Content-Type", "application/json")
-				request.Header.Set("Request-Count", strconv.Itoa(lb.shards[shard_].req_count))
-				// retry
-				log.Printf("retrying update request to %s\n", mapT.Server_id)
-				do, err = http.DefaultClient.Do(request)
+			if status != http.StatusOK {
+				c.Data(status, "application/json; charset=utf-8", body)
+				return
 			}
-			break
+			var result struct {
+				Version int
+				Index   int
+			}
+			_ = json.Unmarshal(body, &result)
+			session.advance(shard_, result.Index)
+			c.JSON(http.StatusOK, gin.H{"message": "Data entry for Stud_id: " + strconv.Itoa(payload.Stud_id) + " updated", "version": result.Version, "session": setSession(c, session), "status": "success"})
+			return
 		}
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "Data entry for Stud_id: " + strconv.Itoa(payload.Stud_id) + " updated", "status": "success"})
 }
 
+// newRequestId names one request to a shard. Every retry carries the same id, so the primary
+// can tell a resend from a new request without any state kept in the balancer.
+func newRequestId() string {
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63())
+}
+
+// rejectedError is a 4xx a primary answered a write with
+type rejectedError struct {
+	status int
+	body   []byte
+}
+
+func (r rejectedError) Error() string {
+	return fmt.Sprintf("primary rejected the request with %d: %s", r.status, r.body)
+}
+
+// finalRejection tells whether a primary's answer will not change on a retry. 408 and 429
+// may pass later, and 421 means the primary moved, the rest of 4xx is the request's fault.
+func finalRejection(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusMisdirectedRequest, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 400 && status < 500
+}
+
+// setIdempotencyKey passes the client key on to a shard primary. The key is scoped to the
+// shard because one server may be primary for several shards of the same batch.
+func setIdempotencyKey(request *http.Request, key string, shard_ string) {
+	if key != "" {
+		request.Header.Set("Idempotency-Key", key+":"+shard_)
+	}
+}
+
+// sendToPrimary sends a request to the primary of a shard, refreshing the view and retrying
+// until it answers 200 or rejects the request for good with a 4xx, which is returned as is.
+// The caller holds the shard lock.
+func sendToPrimary(c *gin.Context, shard_ string, method string, path string, dataToSend []byte) (string, int, []byte, error) {
+	requestId := newRequestId()
+	var primary string
+	var status int
+	var body []byte
+	err := defaultRetry.do(c.Request.Context(), func(ctx context.Context) error {
+		var err error
+		primary, err = getPrimary(shard_)
+		if err != nil {
+			return err
+		}
+		request, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s:5000%s", primary, path), bytes.NewReader(dataToSend))
+		if err != nil {
+			return permanent(fmt.Errorf("Error creating %s request", path))
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Request-Id", requestId)
+		request.Header.Set("Term", strconv.Itoa(termOf(shard_)))
+		setIdempotencyKey(request, c.GetHeader("Idempotency-Key"), shard_)
+		if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+			request.Header.Set("If-Match", ifMatch)
+		}
+		log.Printf("sending %s request to %s\n", path, primary)
+		do, err := http.DefaultClient.Do(request)
+		if err == nil {
+			body, err = io.ReadAll(do.Body)
+			_ = do.Body.Close()
+			if err == nil && (do.StatusCode == http.StatusOK || finalRejection(do.StatusCode)) {
+				status = do.StatusCode
+				// a conflict that may pass later stays one, so it is not stored under the
+				// Idempotency-Key either
+				if retryAfter := do.Header.Get("Retry-After"); retryAfter != "" {
+					c.Header("Retry-After", retryAfter)
+				}
+				return nil
+			}
+			if err == nil {
+				err = fmt.Errorf("%s answered %d", primary, do.StatusCode)
+			}
+		}
+		// the primary may have changed, refresh the view before retrying
+		log.Printf("retrying %s request to %s: %v\n", path, primary, err)
+		if err := fetchView(); err != nil {
+			log.Printf("Error refreshing view: %v", err)
+		}
+		return err
+	})
+	if err != nil {
+		return primary, 0, nil, fmt.Errorf("%s to shard %s failed: %w", path, shard_, err)
+	}
+	return primary, status, body, nil
+}
+
 func writeHandler(c *gin.Context) {
 	var payload struct {
-		Data []student
+		Data   []student
+		Atomic bool
 	}
 	jsonString := getJSONstring(c)
 	err := json.Unmarshal([]byte(jsonString), &payload)
@@ -468,75 +577,151 @@ func writeHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
 		return
 	}
+	var results []rowResult
 	dataToWriteToShards := make(map[string][]student)
+	shards := lb.shardList()
 	for _, row := range payload.Data {
-		for shard_ := range lb.shards {
-			if row.Stud_id >= lb.shards[shard_].Stud_id_low && row.Stud_id < lb.shards[shard_].Stud_id_high {
+		routed := false
+		for shard_, metaData := range shards {
+			if row.Stud_id >= metaData.Stud_id_low && row.Stud_id < metaData.Stud_id_high {
 				dataToWriteToShards[shard_] = append(dataToWriteToShards[shard_], row)
+				routed = true
 				break
 			}
 		}
+		if !routed {
+			results = append(results, rowResult{Stud_id: row.Stud_id, Status: "failed", Error: "No shard holds this Stud_id"})
+		}
 	}
 	for shard_ := range dataToWriteToShards {
 		// lock shard
-		lb.shards[shard_].rw.Lock()
+		shards[shard_].rw.Lock()
 		//defer unlock
-		defer lb.shards[shard_].rw.Unlock()
+		defer shards[shard_].rw.Unlock()
+	}
+	session := requestSession(c)
+	if payload.Atomic {
+		atomicWrite(c, dataToWriteToShards, session)
+		return
 	}
 
-	// send write request to primary servers
+	// send write request to primary servers, a failing shard does not stop the others
+	var retry []student
+	rejectedStatus := 0
 	for shard_, data := range dataToWriteToShards {
 		log.Printf("Writing to shard %s\n", shard_)
-		var mapT MapT
-		err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Not("primary", false).First(&mapT).Error
+		primary, shardResult, err := writeToShard(c, shard_, data)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error getting primary server", "status": "failure"})
-			return
-		}
-		// send data to this server
-		var payload writePayload
-		payload.Shard = shard_
-		payload.Data = data
-		dataToSend, err := json.Marshal(payload)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error marshalling data", "status": "failure"})
-			return
-		}
-		request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s:5000/write", mapT.Server_id), bytes.NewReader(dataToSend))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error creating write request", "status": "failure"})
-			return
-		}
-		lb.shards[shard_].req_count++
-		request.Header.Set("Content-Type", "application/json")
-		request.Header.Set("Request-Count", strconv.Itoa(lb.shards[shard_].req_count))
-		log.Printf("sending write request to %s\n", mapT.Server_id)
-		do, err := http.DefaultClient.Do(request)
-		for err != nil || do.StatusCode != http.StatusOK {
-			var mapT MapT
-			err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Not("primary", false).First(&mapT).Error
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error getting primary server", "status": "failure"})
-				return
+			log.Printf("Error writing to shard %s: %v", shard_, err)
+			for _, row := range data {
+				results = append(results, rowResult{Stud_id: row.Stud_id, Shard: shard_, Primary: primary, Status: "failed", Error: err.Error()})
 			}
-			request, err = http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s:5000/write", mapT.Server_id), bytes.NewReader(dataToSend))
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error creating write request", "status": "failure"})
-				return
+			// inserts skip rows that already exist, so resending the rows is safe, unless the
+			// primary rejected them for good
+			var rejected rejectedError
+			if errors.As(err, &rejected) {
+				rejectedStatus = rejected.status
+			} else {
+				retry = append(retry, data...)
 			}
-			request.Header.Set("Content-Type", "application/json")
-			request.Header.Set("Request-Count", strconv.Itoa(lb.shards[shard_].req_count))
-			// retry
-			log.Printf("retrying write request to %s\n", mapT.Server_id)
-			do, err = http.DefaultClient.Do(request)
+			continue
+		}
+		session.advance(shard_, shardResult.Index)
+		results = append(results, rowResults(shard_, primary, data, shardResult.Duplicates)...)
+	}
+
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	code := http.StatusOK
+	status := "success"
+	message := "Data entries added"
+	if counts["failed"] != 0 {
+		code = http.StatusMultiStatus
+		status = "partial"
+		message = "Some data entries were not added"
+		if counts["failed"] == len(results) {
+			code = http.StatusServiceUnavailable
+			// nothing worth retrying, pass on why the primary refused
+			if len(retry) == 0 && rejectedStatus != 0 {
+				code = rejectedStatus
+			}
+			status = "failure"
+			message = "No data entries were added"
+		}
+	}
+	c.JSON(code, gin.H{
+		"message":    message,
+		"inserted":   counts["inserted"],
+		"duplicates": counts["duplicate"],
+		"failed":     counts["failed"],
+		"rows":       results,
+		"retry":      retry,
+		"session":    setSession(c, session),
+		"status":     status,
+	})
+}
+
+// rowResults marks each row a primary took as inserted or duplicate. The primary lists an id
+// once per skipped row, and only the first row of an id repeated within the batch can be
+// inserted.
+func rowResults(shard_ string, primary string, data []student, skipped []int) []rowResult {
+	duplicates := make(map[int]int)
+	for _, id := range skipped {
+		duplicates[id]++
+	}
+	occurrences := make(map[int]int)
+	for _, row := range data {
+		occurrences[row.Stud_id]++
+	}
+	var results []rowResult
+	seen := make(map[int]int)
+	for _, row := range data {
+		seen[row.Stud_id]++
+		status := "inserted"
+		if seen[row.Stud_id] > occurrences[row.Stud_id]-duplicates[row.Stud_id] {
+			status = "duplicate"
 		}
+		results = append(results, rowResult{Stud_id: row.Stud_id, Shard: shard_, Primary: primary, Status: status})
+	}
+	return results
+}
 
+// writeToShard sends the rows of one shard to its primary and returns the primary that took
+// them along with its per-row result. The caller holds the shard lock.
+func writeToShard(c *gin.Context, shard_ string, data []student) (string, writeResult, error) {
+	var result writeResult
+	// send data to this server
+	var payload writePayload
+	payload.Shard = shard_
+	payload.Data = data
+	dataToSend, err := json.Marshal(payload)
+	if err != nil {
+		return "", result, fmt.Errorf("Error marshalling data")
 	}
+	primary, status, body, err := sendToPrimary(c, shard_, http.MethodPost, "/write", dataToSend)
+	if err != nil {
+		return primary, result, err
+	}
+	if status != http.StatusOK {
+		return primary, result, rejectedError{status: status, body: body}
+	}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return primary, result, fmt.Errorf("Error decoding write response")
+	}
+	return primary, result, nil
 }
 
 func readHandler(c *gin.Context) {
 	var payload struct {
-		Stud_id map[string]int
+		Stud_id     map[string]int
+		Consistency string
+		Max_lag     int
+		Session     string
+		Limit       int
+		Cursor      string
 	}
 	jsonString := getJSONstring(c)
 	err := json.Unmarshal([]byte(jsonString), &payload)
@@ -545,73 +730,87 @@ func readHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
 		return
 	}
-	var response struct {
-		shards_queried []string
-		Data           []student
-		Status         string
-	}
-	response.Status = ""
-	for shard_, shardMetaData_ := range lb.shards {
-		if !(payload.Stud_id["low"] >= shardMetaData_.Stud_id_high || payload.Stud_id["high"] <= shardMetaData_.Stud_id_low) {
-			// acquire shared lock
-			shardMetaData_.rw.RLock()
-
-			server := lb.getServerID(shard_)
-			fmt.Printf("\nForwarding to %s\n", server)
-			readEndpoint := fmt.Sprintf("http://%s:5000/read", server)
-			var body readPayload
-			body.Shard = shard_
-			body.Stud_id = make(map[string]int)
-			body.Stud_id["low"] = max(payload.Stud_id["low"], shardMetaData_.Stud_id_low)
-			body.Stud_id["high"] = min(payload.Stud_id["high"], shardMetaData_.Stud_id_high)
-			// fmt.Printf("\n%v\n", body)
-			jsonBody, _ := json.Marshal(body)
-			post, err := http.Post(readEndpoint, "application/json", bytes.NewReader(jsonBody))
-			// release shared lock
-			shardMetaData_.rw.RUnlock()
+	session, ok := readOptions(c, payload.Consistency, payload.Session, payload.Limit)
+	if !ok {
+		return
+	}
+	low, high := payload.Stud_id["low"], payload.Stud_id["high"]
+	if payload.Cursor != "" {
+		cursor, ok := parseCursor(payload.Cursor)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> invalid cursor", "status": "failure"})
+			return
+		}
+		low, high = cursor.Low, cursor.High
+	}
+	var shards []string
+	routed := lb.shardList()
+	for shard_, shardMetaData_ := range routed {
+		if !(low >= shardMetaData_.Stud_id_high || high <= shardMetaData_.Stud_id_low) {
+			shards = append(shards, shard_)
+		}
+	}
+	sort.Strings(shards)
+	replies := scatter(shards, "/read", func(shard_ string) (string, interface{}, error) {
+		shardMetaData_ := routed[shard_]
+		server, err := pickReplica(shard_, payload.Consistency, payload.Max_lag, session[shard_])
+		var body readPayload
+		body.Shard = shard_
+		body.Stud_id = make(map[string]int)
+		body.Stud_id["low"] = max(low, shardMetaData_.Stud_id_low)
+		body.Stud_id["high"] = min(high, shardMetaData_.Stud_id_high)
+		body.Limit = payload.Limit
+		return server, body, err
+	})
 
-			if err == nil {
-				resp, _ := io.ReadAll(post.Body)
-				var respBody readResponse
-				err := json.Unmarshal(resp, &respBody)
-				if err != nil {
-					continue
-				}
-				response.shards_queried = append(response.shards_queried, shard_)
-				response.Data = append(response.Data, respBody.Data...)
-			} else {
-				// add failed shard to response.status
-				response.Status += shard_ + " "
-			}
+	shards_queried := []string{}
+	data := []student{}
+	status := ""
+	more := false
+	for _, reply := range replies {
+		var respBody readResponse
+		if reply.err == nil {
+			reply.err = json.Unmarshal(reply.body, &respBody)
+		}
+		if reply.err != nil {
+			log.Printf("Error reading shard %s: %v", reply.shard, reply.err)
+			// add failed shard to status
+			status += reply.shard + " "
+			continue
 		}
+		shards_queried = append(shards_queried, reply.shard)
+		data = append(data, respBody.Data...)
+		// a full page from a shard may have more rows behind it
+		if payload.Limit > 0 && len(respBody.Data) == payload.Limit {
+			more = true
+		}
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].Stud_id < data[j].Stud_id })
+	if payload.Limit > 0 && len(data) > payload.Limit {
+		data = data[:payload.Limit]
+		more = true
 	}
-	if response.Status == "" {
-		response.Status = "success"
+	if status == "" {
+		status = "success"
 	} else {
-		response.Status += "failed"
+		status += "failed"
+	}
+	response := gin.H{"shards_queried": shards_queried, "data": data, "status": status}
+	// rows of a failed shard may lie before the last row returned, a cursor past them would
+	// skip them for good, so the client has to retry the page instead
+	if more && status == "success" {
+		next := readCursor{Low: data[len(data)-1].Stud_id + 1, High: high}
+		response["next_cursor"] = next.encode()
 	}
-	c.JSON(http.StatusOK, gin.H{"shards_queried": response.shards_queried, "data": response.Data, "status": response.Status})
+	c.JSON(http.StatusOK, response)
 }
 
 func getallHandler(c *gin.Context) {
 	server := c.Param("server_id")
 	url := fmt.Sprintf("http://%s:5000/getall", server)
-	resp, err := http.Get(url)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error getting data from server", "status": "failure"})
-		return
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error closing response body", "status": "failure"})
-			return
-		}
-	}(resp.Body)
-
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	_, bodyBytes, err := defaultRetry.send(c.Request.Context(), http.MethodGet, url, nil, nil, acceptAnswer)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error reading server response", "status": "failure"})
+		c.JSON(retryStatus(err), gin.H{"message": "Error getting data from server", "status": "failure"})
 		return
 	}
 
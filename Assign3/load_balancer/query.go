@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// studIdRange narrows the shards a query has to visit using its predicates on Stud_id. The
+// range is [low, high) like the shard ranges.
+func studIdRange(where []predicate) (int, int) {
+	low, high := math.MinInt, math.MaxInt
+	for _, pred := range where {
+		value, ok := pred.Value.(float64)
+		if pred.Column != "Stud_id" || !ok {
+			continue
+		}
+		switch pred.Op {
+		case "=":
+			low = max(low, int(math.Ceil(value)))
+			high = min(high, int(math.Floor(value))+1)
+		case ">=":
+			low = max(low, int(math.Ceil(value)))
+		case ">":
+			low = max(low, int(math.Floor(value))+1)
+		case "<=":
+			high = min(high, int(math.Floor(value))+1)
+		case "<":
+			high = min(high, int(math.Ceil(value)))
+		}
+	}
+	return low, high
+}
+
+// shardsMatching lists, in name order, the shards whose range can hold rows matching where
+func shardsMatching(where []predicate) []string {
+	low, high := studIdRange(where)
+	shards := []string{}
+	for shard_, shardMetaData_ := range lb.shardList() {
+		if shardMetaData_.Stud_id_low < high && low < shardMetaData_.Stud_id_high {
+			shards = append(shards, shard_)
+		}
+	}
+	sort.Strings(shards)
+	return shards
+}
+
+// compareValues orders two decoded JSON values, numbers before strings
+func compareValues(a, b interface{}) int {
+	x, aNum := a.(float64)
+	y, bNum := b.(float64)
+	switch {
+	case aNum && bNum:
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+		return 0
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	}
+	s, _ := a.(string)
+	t, _ := b.(string)
+	return strings.Compare(s, t)
+}
+
+// queryHandler fans a filtered query out to one replica of every shard that can hold
+// matching rows and merges the sorted results. Shards apply the predicates, projection,
+// sort and limit themselves.
+func queryHandler(c *gin.Context) {
+	var payload struct {
+		Where       []predicate
+		Select      []string
+		Order_by    string
+		Desc        bool
+		Limit       int
+		Consistency string
+		Max_lag     int
+		Session     string
+	}
+	jsonString := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonString), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
+		return
+	}
+	session, ok := readOptions(c, payload.Consistency, payload.Session, payload.Limit)
+	if !ok {
+		return
+	}
+	// the merge needs the sort column and Stud_id even when they are not selected
+	fetch := payload.Select
+	extra := make(map[string]bool)
+	if len(fetch) != 0 {
+		selected := make(map[string]bool)
+		for _, column := range fetch {
+			selected[column] = true
+		}
+		for _, column := range []string{payload.Order_by, "Stud_id"} {
+			if column != "" && !selected[column] {
+				fetch = append(fetch, column)
+				selected[column] = true
+				extra[column] = true
+			}
+		}
+	}
+
+	shards := pruneByIndex(shardsMatching(payload.Where), payload.Where, payload.Consistency, payload.Max_lag, session)
+	replies := scatter(shards, "/query", func(shard_ string) (string, interface{}, error) {
+		server, err := pickReplica(shard_, payload.Consistency, payload.Max_lag, session[shard_])
+		body := queryPayload{Shard: shard_, Where: payload.Where, Select: fetch, Order_by: payload.Order_by, Desc: payload.Desc, Limit: payload.Limit}
+		return server, body, err
+	})
+
+	shards_queried := []string{}
+	data := []map[string]interface{}{}
+	status := ""
+	for _, reply := range replies {
+		var respBody struct {
+			Data  []map[string]interface{}
+			Error string
+		}
+		_ = json.Unmarshal(reply.body, &respBody)
+		if reply.status == http.StatusBadRequest && respBody.Error != "" {
+			// every shard rejects the same bad predicate
+			c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> " + respBody.Error, "status": "failure"})
+			return
+		}
+		if reply.err != nil {
+			log.Printf("Error querying shard %s: %v", reply.shard, reply.err)
+			status += reply.shard + " "
+			continue
+		}
+		shards_queried = append(shards_queried, reply.shard)
+		data = append(data, respBody.Data...)
+	}
+	sort.SliceStable(data, func(i, j int) bool {
+		if payload.Order_by != "" {
+			cmp := compareValues(data[i][payload.Order_by], data[j][payload.Order_by])
+			if payload.Desc {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return compareValues(data[i]["Stud_id"], data[j]["Stud_id"]) < 0
+	})
+	if payload.Limit > 0 && len(data) > payload.Limit {
+		data = data[:payload.Limit]
+	}
+	for _, row := range data {
+		for column := range extra {
+			delete(row, column)
+		}
+	}
+	if status == "" {
+		status = "success"
+	} else {
+		status += "failed"
+	}
+	c.JSON(http.StatusOK, gin.H{"shards_queried": shards_queried, "data": data, "status": status})
+}
+
+// aggregateName is the key an aggregate gets in the result rows, like avg(Stud_marks)
+func aggregateName(spec aggregateSpec) string {
+	if spec.Column == "" {
+		return spec.Op
+	}
+	return spec.Op + "(" + spec.Column + ")"
+}
+
+// aggregateHandler computes counts, sums, averages, min and max, optionally per group, over
+// the rows matching the predicates. Every shard computes partials on one replica and the
+// balancer combines them, so a missing shard fails the whole request instead of
+// undercounting.
+func aggregateHandler(c *gin.Context) {
+	var payload struct {
+		Aggregates  []aggregateSpec
+		Group_by    []string
+		Where       []predicate
+		Consistency string
+		Max_lag     int
+		Session     string
+	}
+	jsonString := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonString), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
+		return
+	}
+	session, ok := readOptions(c, payload.Consistency, payload.Session, 0)
+	if !ok {
+		return
+	}
+	if len(payload.Aggregates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> no aggregates requested", "status": "failure"})
+		return
+	}
+	var columns []string
+	seen := make(map[string]bool)
+	for _, spec := range payload.Aggregates {
+		switch spec.Op {
+		case "count":
+			continue
+		case "sum", "avg", "min", "max":
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> aggregate must be count, sum, avg, min or max", "status": "failure"})
+			return
+		}
+		if spec.Column == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> " + spec.Op + " needs a column", "status": "failure"})
+			return
+		}
+		if !seen[spec.Column] {
+			seen[spec.Column] = true
+			columns = append(columns, spec.Column)
+		}
+	}
+
+	shards := shardsMatching(payload.Where)
+	replies := scatter(shards, "/aggregate", func(shard_ string) (string, interface{}, error) {
+		server, err := pickReplica(shard_, payload.Consistency, payload.Max_lag, session[shard_])
+		body := aggregatePayload{Shard: shard_, Where: payload.Where, Group_by: payload.Group_by, Columns: columns}
+		return server, body, err
+	})
+
+	groups := make(map[string]*aggregatePartial)
+	var failed []string
+	for _, reply := range replies {
+		var respBody struct {
+			Groups []aggregatePartial
+			Error  string
+		}
+		_ = json.Unmarshal(reply.body, &respBody)
+		if reply.status == http.StatusBadRequest && respBody.Error != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "<Error> " + respBody.Error, "status": "failure"})
+			return
+		}
+		if reply.err != nil {
+			log.Printf("Error aggregating shard %s: %v", reply.shard, reply.err)
+			failed = append(failed, reply.shard)
+			continue
+		}
+		for _, partial := range respBody.Groups {
+			key, _ := json.Marshal(partial.Key)
+			group, ok := groups[string(key)]
+			if !ok {
+				group = &aggregatePartial{Key: partial.Key, Sum: make(map[string]float64), Min: make(map[string]float64), Max: make(map[string]float64)}
+				groups[string(key)] = group
+			}
+			group.merge(partial)
+		}
+	}
+	if len(failed) != 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Shards " + strings.Join(failed, " ") + " could not be aggregated", "failed": failed, "status": "failure"})
+		return
+	}
+	if len(groups) == 0 && len(payload.Group_by) == 0 {
+		// no shard can hold a matching row
+		groups["{}"] = &aggregatePartial{Key: map[string]interface{}{}}
+	}
+
+	data := []map[string]interface{}{}
+	for _, group := range groups {
+		row := make(map[string]interface{})
+		for column, value := range group.Key {
+			row[column] = value
+		}
+		for _, spec := range payload.Aggregates {
+			var value interface{}
+			switch spec.Op {
+			case "count":
+				value = group.Count
+			case "sum":
+				value = group.Sum[spec.Column]
+			case "avg":
+				if group.Count != 0 {
+					value = group.Sum[spec.Column] / float64(group.Count)
+				}
+			case "min":
+				if v, ok := group.Min[spec.Column]; ok {
+					value = v
+				}
+			case "max":
+				if v, ok := group.Max[spec.Column]; ok {
+					value = v
+				}
+			}
+			row[aggregateName(spec)] = value
+		}
+		data = append(data, row)
+	}
+	sort.Slice(data, func(i, j int) bool {
+		for _, column := range payload.Group_by {
+			if cmp := compareValues(data[i][column], data[j][column]); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+	c.JSON(http.StatusOK, gin.H{"shards_queried": shards, "data": data, "status": "success"})
+}
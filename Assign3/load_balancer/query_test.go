@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestStudIdRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		where     []predicate
+		low, high int
+	}{
+		{"no predicates", nil, math.MinInt, math.MaxInt},
+		{"equal", []predicate{{"Stud_id", "=", 5.0}}, 5, 6},
+		{"equal to a fraction matches nothing", []predicate{{"Stud_id", "=", 5.5}}, 6, 6},
+		{"at least", []predicate{{"Stud_id", ">=", 10.0}}, 10, math.MaxInt},
+		{"at least a fraction", []predicate{{"Stud_id", ">=", 9.5}}, 10, math.MaxInt},
+		{"greater", []predicate{{"Stud_id", ">", 10.0}}, 11, math.MaxInt},
+		{"greater than a fraction", []predicate{{"Stud_id", ">", 9.5}}, 10, math.MaxInt},
+		{"at most", []predicate{{"Stud_id", "<=", 20.0}}, math.MinInt, 21},
+		{"at most a fraction", []predicate{{"Stud_id", "<=", 20.5}}, math.MinInt, 21},
+		{"less", []predicate{{"Stud_id", "<", 20.0}}, math.MinInt, 20},
+		{"less than a fraction", []predicate{{"Stud_id", "<", 19.5}}, math.MinInt, 20},
+		{"between", []predicate{{"Stud_id", ">=", 10.0}, {"Stud_id", "<", 20.0}}, 10, 20},
+		{"tightest bounds win", []predicate{{"Stud_id", ">", 5.0}, {"Stud_id", ">=", 8.0}, {"Stud_id", "<=", 30.0}, {"Stud_id", "<", 25.0}}, 8, 25},
+		{"other columns are ignored", []predicate{{"Stud_marks", ">=", 50.0}, {"Stud_id", "<", 100.0}}, math.MinInt, 100},
+		{"other operators are ignored", []predicate{{"Stud_id", "!=", 5.0}, {"Stud_id", "like", "5%"}}, math.MinInt, math.MaxInt},
+		{"non-numeric values are ignored", []predicate{{"Stud_id", "=", "5"}}, math.MinInt, math.MaxInt},
+		{"disjoint", []predicate{{"Stud_id", ">", 20.0}, {"Stud_id", "<", 10.0}}, 21, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			low, high := studIdRange(tt.where)
+			if low != tt.low || high != tt.high {
+				t.Errorf("got [%d, %d), want [%d, %d)", low, high, tt.low, tt.high)
+			}
+		})
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b interface{}
+		want int
+	}{
+		{"smaller number", 1.0, 2.0, -1},
+		{"larger number", 2.5, 2.0, 1},
+		{"equal numbers", 3.0, 3.0, 0},
+		{"negative numbers", -4.0, -3.0, -1},
+		{"smaller string", "Alice", "Bob", -1},
+		{"larger string", "b", "a", 1},
+		{"equal strings", "Eve", "Eve", 0},
+		{"numbers before strings", 100.0, "1", -1},
+		{"strings after numbers", "1", 100.0, 1},
+		{"nulls sort as empty strings", nil, "a", -1},
+		{"two nulls", nil, nil, 0},
+		{"null after numbers", nil, 0.0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareValues(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareValues(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardsMatching(t *testing.T) {
+	defer func(balancer *loadBalancer) { lb = balancer }(lb)
+	lb = &loadBalancer{shards: map[string]*shardMetaData{
+		"sh1": {Shard_id: "sh1", Stud_id_low: 0, Stud_id_high: 100, rw: &sync.RWMutex{}},
+		"sh2": {Shard_id: "sh2", Stud_id_low: 100, Stud_id_high: 200, rw: &sync.RWMutex{}},
+		"sh3": {Shard_id: "sh3", Stud_id_low: 200, Stud_id_high: 300, rw: &sync.RWMutex{}},
+	}}
+	tests := []struct {
+		name  string
+		where []predicate
+		want  []string
+	}{
+		{"every shard", nil, []string{"sh1", "sh2", "sh3"}},
+		{"one id", []predicate{{Column: "Stud_id", Op: "=", Value: 150.0}}, []string{"sh2"}},
+		{"range across shards", []predicate{{Column: "Stud_id", Op: ">=", Value: 50.0}, {Column: "Stud_id", Op: "<", Value: 201.0}}, []string{"sh1", "sh2", "sh3"}},
+		{"shard boundary", []predicate{{Column: "Stud_id", Op: ">=", Value: 100.0}, {Column: "Stud_id", Op: "<", Value: 200.0}}, []string{"sh2"}},
+		{"other columns", []predicate{{Column: "Stud_marks", Op: ">", Value: 50.0}}, []string{"sh1", "sh2", "sh3"}},
+		{"past every shard", []predicate{{Column: "Stud_id", Op: ">", Value: 400.0}}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shardsMatching(tt.where); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregateName(t *testing.T) {
+	tests := []struct {
+		spec aggregateSpec
+		want string
+	}{
+		{aggregateSpec{Op: "count"}, "count"},
+		{aggregateSpec{Op: "avg", Column: "Stud_marks"}, "avg(Stud_marks)"},
+		{aggregateSpec{Op: "max", Column: "Stud_id"}, "max(Stud_id)"},
+	}
+	for _, tt := range tests {
+		if got := aggregateName(tt.spec); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestAggregateMerge(t *testing.T) {
+	partial := func(count int64, sum, min, max float64) aggregatePartial {
+		return aggregatePartial{Count: count, Sum: map[string]float64{"Stud_marks": sum}, Min: map[string]float64{"Stud_marks": min}, Max: map[string]float64{"Stud_marks": max}}
+	}
+	// an empty shard sends a count of 0 and no sums
+	empty := aggregatePartial{Sum: map[string]float64{}, Min: map[string]float64{}, Max: map[string]float64{}}
+	tests := []struct {
+		name     string
+		partials []aggregatePartial
+		want     aggregatePartial
+	}{
+		{"one shard", []aggregatePartial{partial(2, 90, 40, 50)}, partial(2, 90, 40, 50)},
+		{"several shards", []aggregatePartial{partial(2, 90, 40, 50), partial(3, 100, 10, 60), partial(1, 45, 45, 45)}, partial(6, 235, 10, 60)},
+		{"negative values", []aggregatePartial{partial(1, -5, -5, -5), partial(1, -7, -7, -7)}, partial(2, -12, -7, -5)},
+		{"empty shard", []aggregatePartial{empty, partial(1, 30, 30, 30), empty}, partial(1, 30, 30, 30)},
+		{"only empty shards", []aggregatePartial{empty, empty}, empty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := &aggregatePartial{Sum: make(map[string]float64), Min: make(map[string]float64), Max: make(map[string]float64)}
+			for _, partial := range tt.partials {
+				group.merge(partial)
+			}
+			if !reflect.DeepEqual(*group, tt.want) {
+				t.Errorf("got %+v, want %+v", *group, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// retryPolicy bounds the retries of a call to another service. Attempts are spaced by
+// exponential backoff with full jitter, each attempt gets its own timeout and the call as a
+// whole gives up at the deadline. This is the only copy to edit: every service is built from
+// its own Docker context and cannot import a package outside it, so `make sync-shared` copies
+// this file into the server and the shard manager.
+type retryPolicy struct {
+	attempts    int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	callTimeout time.Duration
+	deadline    time.Duration
+}
+
+var (
+	defaultRetry = retryPolicy{
+		attempts:    envInt("RETRY_ATTEMPTS", 5),
+		baseDelay:   time.Duration(envInt("RETRY_BASE_MS", 100)) * time.Millisecond,
+		maxDelay:    time.Duration(envInt("RETRY_MAX_MS", 2000)) * time.Millisecond,
+		callTimeout: time.Duration(envInt("RETRY_CALL_TIMEOUT_MS", 5000)) * time.Millisecond,
+		deadline:    time.Duration(envInt("RETRY_DEADLINE_MS", 20000)) * time.Millisecond,
+	}
+	// startupRetry waits for dependencies such as MySQL while a container starts
+	startupRetry = retryPolicy{
+		attempts:    envInt("STARTUP_ATTEMPTS", 60),
+		baseDelay:   500 * time.Millisecond,
+		maxDelay:    5 * time.Second,
+		callTimeout: 10 * time.Second,
+	}
+)
+
+var errRetriesExhausted = errors.New("retries exhausted")
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// permanent wraps an error that retrying cannot fix
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.baseDelay << attempt
+	if delay <= 0 || delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// do calls fn until it succeeds, returns a permanent error, runs out of attempts or ctx ends
+func (p retryPolicy) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.deadline)
+		defer cancel()
+	}
+	var err error
+	for attempt := 0; attempt < p.attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%w: %v", ctx.Err(), err)
+			case <-time.After(p.backoff(attempt - 1)):
+			}
+		}
+		callCtx, cancel := context.WithTimeout(ctx, p.callTimeout)
+		err = fn(callCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		var perm permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		}
+	}
+	return fmt.Errorf("%w after %d attempts: %v", errRetriesExhausted, p.attempts, err)
+}
+
+// send makes an HTTP call under the policy, with a fresh body for every attempt. Transport
+// errors and statuses accept rejects are retried; the last response is returned either way.
+func (p retryPolicy) send(ctx context.Context, method string, url string, body []byte, headers map[string]string, accept func(int) bool) (int, []byte, error) {
+	var status int
+	var resp []byte
+	err := p.do(ctx, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return permanent(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		res, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		resp, err = io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		status = res.StatusCode
+		if !accept(status) {
+			return fmt.Errorf("%s %s answered %d", method, url, status)
+		}
+		return nil
+	})
+	return status, resp, err
+}
+
+func acceptOK(status int) bool {
+	return status == http.StatusOK
+}
+
+// acceptAnswer takes every status but server errors as the final answer
+func acceptAnswer(status int) bool {
+	return status < http.StatusInternalServerError
+}
+
+// retryStatus is the status to answer with once a call to another service gave up: 504 when
+// the deadline passed, 503 otherwise
+func retryStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusServiceUnavailable
+}
+
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	tests := []struct {
+		attempt int
+		limit   time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{10, time.Second},
+		// the shift overflows, the delay stays capped
+		{70, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := p.backoff(tt.attempt)
+				if delay < 0 || delay > tt.limit {
+					t.Fatalf("backoff(%d) = %v, want within [0, %v]", tt.attempt, delay, tt.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	errFlaky := errors.New("flaky")
+	tests := []struct {
+		name string
+		// the error of each call, calls past the end succeed
+		errs  []error
+		calls int
+		want  error
+	}{
+		{"first call succeeds", nil, 1, nil},
+		{"succeeds after retries", []error{errFlaky, errFlaky}, 3, nil},
+		{"permanent error stops", []error{errFlaky, permanent(errFlaky)}, 2, errFlaky},
+		{"attempts run out", []error{errFlaky, errFlaky, errFlaky, errFlaky}, 3, errRetriesExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := retryPolicy{attempts: 3, baseDelay: time.Millisecond, maxDelay: time.Millisecond, callTimeout: time.Second}
+			calls := 0
+			err := p.do(context.Background(), func(ctx context.Context) error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if calls != tt.calls {
+				t.Errorf("got %d calls, want %d", calls, tt.calls)
+			}
+			if !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	p := retryPolicy{attempts: 100, baseDelay: 10 * time.Millisecond, maxDelay: 10 * time.Millisecond, callTimeout: time.Second, deadline: 50 * time.Millisecond}
+	err := p.do(context.Background(), func(ctx context.Context) error {
+		return errors.New("down")
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline", err)
+	}
+	if status := retryStatus(err); status != http.StatusGatewayTimeout {
+		t.Errorf("got status %d, want %d", status, http.StatusGatewayTimeout)
+	}
+	if status := retryStatus(fmt.Errorf("%w: down", errRetriesExhausted)); status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", status, http.StatusServiceUnavailable)
+	}
+}
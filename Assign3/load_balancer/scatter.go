@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var readTimeout = time.Duration(envInt("READ_TIMEOUT_MS", 2000)) * time.Millisecond
+
+// readCursor is the remaining range of a paginated read. Clients get it as an opaque
+// base64url string and send it back unchanged for the next page.
+type readCursor struct {
+	Low  int
+	High int
+}
+
+func (cursor readCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseCursor(token string) (readCursor, bool) {
+	var cursor readCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, false
+	}
+	return cursor, json.Unmarshal(data, &cursor) == nil
+}
+
+type shardReply struct {
+	shard  string
+	status int
+	body   []byte
+	err    error
+}
+
+// scatter sends one request per shard concurrently and waits for all of them. build picks
+// the server and request body of a shard; it runs under the shard read lock, which is held
+// until that shard answered or readTimeout passed.
+func scatter(shards []string, path string, build func(shard_ string) (string, interface{}, error)) []shardReply {
+	client := &http.Client{Timeout: readTimeout}
+	replies := make([]shardReply, len(shards))
+	var wg sync.WaitGroup
+	for i, shard_ := range shards {
+		wg.Add(1)
+		go func(i int, shard_ string) {
+			defer wg.Done()
+			replies[i].shard = shard_
+			// acquire shared lock
+			metaData, _ := lb.shard(shard_)
+			metaData.rw.RLock()
+			defer metaData.rw.RUnlock()
+			server, body, err := build(shard_)
+			if err != nil {
+				replies[i].err = err
+				return
+			}
+			jsonBody, err := json.Marshal(body)
+			if err != nil {
+				replies[i].err = err
+				return
+			}
+			fmt.Printf("\nForwarding to %s\n", server)
+			post, err := client.Post(fmt.Sprintf("http://%s:5000%s", server, path), "application/json", bytes.NewReader(jsonBody))
+			if err != nil {
+				replies[i].err = err
+				return
+			}
+			defer post.Body.Close()
+			replies[i].status = post.StatusCode
+			replies[i].body, replies[i].err = io.ReadAll(post.Body)
+			if replies[i].err == nil && post.StatusCode != http.StatusOK {
+				replies[i].err = fmt.Errorf("%s answered %d", server, post.StatusCode)
+			}
+		}(i, shard_)
+	}
+	wg.Wait()
+	return replies
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor readCursor
+	}{
+		{"zero", readCursor{}},
+		{"range", readCursor{Low: 100, High: 250}},
+		{"negative low", readCursor{Low: -5, High: 5}},
+		{"open ended", readCursor{Low: math.MinInt, High: math.MaxInt}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.cursor.encode()
+			if strings.ContainsAny(token, "+/=") {
+				t.Errorf("token %q is not base64url without padding", token)
+			}
+			cursor, ok := parseCursor(token)
+			if !ok || cursor != tt.cursor {
+				t.Errorf("got %+v, %v, want %+v", cursor, ok, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestParseCursorRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"Low":1,"High":20}`))},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("low=1"))},
+		{"wrong types", base64.RawURLEncoding.EncodeToString([]byte(`{"Low":"1","High":2}`))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if cursor, ok := parseCursor(tt.token); ok {
+				t.Errorf("parsed %q as %+v", tt.token, cursor)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"time"
+)
+
+var (
+	sessionWait = time.Duration(envInt("SESSION_WAIT_MS", 200)) * time.Millisecond
+	sessionPoll = 20 * time.Millisecond
+)
+
+// sessionToken holds, per shard, how many log entries a replica must have applied to show
+// the client its own writes. It travels as base64url encoded JSON in the Session-Token
+// header or the session field.
+type sessionToken map[string]int
+
+func parseSession(token string) (sessionToken, bool) {
+	session := make(sessionToken)
+	if token == "" {
+		return session, true
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return session, false
+	}
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return make(sessionToken), false
+	}
+	return session, true
+}
+
+func (session sessionToken) advance(shard_ string, index int) {
+	if index > session[shard_] {
+		session[shard_] = index
+	}
+}
+
+func (session sessionToken) encode() string {
+	data, _ := json.Marshal(session)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// requestSession reads the token the client sent along with a write. A malformed token is
+// dropped, the write still goes through and a fresh token is handed back.
+func requestSession(c *gin.Context) sessionToken {
+	session, _ := parseSession(c.GetHeader("Session-Token"))
+	return session
+}
+
+// setSession returns the token to the client as a header and for the response body
+func setSession(c *gin.Context, session sessionToken) string {
+	token := session.encode()
+	c.Header("Session-Token", token)
+	return token
+}
+
+// logIndex reads the log position the primary reported for a write, update or delete
+func logIndex(body []byte) int {
+	var result struct {
+		Index int
+	}
+	_ = json.Unmarshal(body, &result)
+	return result.Index
+}
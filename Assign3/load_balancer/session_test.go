@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSession(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  sessionToken
+		ok    bool
+	}{
+		{"no token", "", sessionToken{}, true},
+		{"encoded", sessionToken{"sh1": 4, "sh2": 9}.encode(), sessionToken{"sh1": 4, "sh2": 9}, true},
+		{"not base64", "!!", sessionToken{}, false},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("sh1=4")), sessionToken{}, false},
+		{"wrong shape", base64.RawURLEncoding.EncodeToString([]byte(`{"sh1":"4"}`)), sessionToken{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, ok := parseSession(tt.token)
+			if ok != tt.ok || !reflect.DeepEqual(session, tt.want) {
+				t.Errorf("got %v, %v, want %v, %v", session, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSessionAdvance(t *testing.T) {
+	session := sessionToken{"sh1": 5}
+	session.advance("sh1", 3)
+	session.advance("sh2", 2)
+	session.advance("sh1", 7)
+	session.advance("sh3", 0)
+	want := sessionToken{"sh1": 7, "sh2": 2}
+	if !reflect.DeepEqual(session, want) {
+		t.Errorf("got %v, want %v", session, want)
+	}
+}
+
+func TestLogIndex(t *testing.T) {
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"message":"Data entries added","Index":12,"status":"success"}`, 12},
+		{`{"message":"Data entries added","status":"success"}`, 0},
+		{`not json`, 0},
+	}
+	for _, tt := range tests {
+		if got := logIndex([]byte(tt.body)); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestPickCaughtUp(t *testing.T) {
+	defer func(balancer *loadBalancer, wait time.Duration) { lb, sessionWait = balancer, wait }(lb, sessionWait)
+	// replicas nothing listens for, so asking them again fails at once
+	lb = routedShard("127.0.0.2", "127.0.0.3")
+	everyone := func(string, int) bool { return true }
+	tests := []struct {
+		name     string
+		applied  map[string]map[string]int
+		minIndex int
+		check    func(string, int) bool
+		wait     time.Duration
+		// applied index of 127.0.0.3 reported while the pick waits
+		later int
+		want  string
+	}{
+		{"one caught up", map[string]map[string]int{"127.0.0.2": {"sh1": 4}, "127.0.0.3": {"sh1": 9}}, 6, everyone, 0, 0, "127.0.0.3"},
+		{"none caught up", map[string]map[string]int{"127.0.0.2": {"sh1": 4}, "127.0.0.3": {"sh1": 5}}, 6, everyone, 0, 0, ""},
+		{"never polled", map[string]map[string]int{}, 1, everyone, 0, 0, ""},
+		{"check fails", map[string]map[string]int{"127.0.0.2": {"sh1": 9}, "127.0.0.3": {"sh1": 9}}, 6, func(server string, _ int) bool { return server == "127.0.0.2" }, 0, 0, "127.0.0.2"},
+		{"catches up in time", map[string]map[string]int{"127.0.0.2": {"sh1": 1}, "127.0.0.3": {"sh1": 1}}, 6, everyone, time.Second, 6, "127.0.0.3"},
+		{"still behind at the deadline", map[string]map[string]int{"127.0.0.2": {"sh1": 1}, "127.0.0.3": {"sh1": 1}}, 6, everyone, 100 * time.Millisecond, 5, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessionWait = tt.wait
+			appliedLock.Lock()
+			appliedIndex = tt.applied
+			appliedLock.Unlock()
+			if tt.later != 0 {
+				go func() {
+					time.Sleep(3 * sessionPoll)
+					appliedLock.Lock()
+					appliedIndex = map[string]map[string]int{"127.0.0.2": {"sh1": 1}, "127.0.0.3": {"sh1": tt.later}}
+					appliedLock.Unlock()
+				}()
+			}
+			if got := pickCaughtUp("sh1", tt.minIndex, tt.check); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,18 @@
 package main
 
 type shard struct {
-	Stud_id_low int
-	Shard_id    string
-	Shard_size  int
+	Stud_id_low     int
+	Shard_id        string
+	Shard_size      int
+	Target_replicas int
+}
+
+type shardStatus struct {
+	Stud_id_low     int
+	Shard_id        string
+	Shard_size      int
+	Replicas        int
+	Target_replicas int
 }
 
 type addPayload struct {
@@ -17,10 +26,34 @@ type rmPayload struct {
 	Servers []string
 }
 
+type planResponse struct {
+	Servers map[string][]string
+	Added   map[string][]string
+}
+
+// syncPayload carries replica moves made by the shard manager and its view of every shard
+// as of Version
+type syncPayload struct {
+	Added   map[string][]string
+	Removed map[string][]string
+	Version int64
+	View    map[string]shardView
+}
+
+type shardView struct {
+	Primary         string
+	Replicas        []string
+	Target_replicas int
+	Stud_id_low     int
+	Shard_size      int
+	Term            int
+}
+
 type student struct {
 	Stud_id    int
 	Stud_name  string
 	Stud_marks int
+	Version    int
 }
 
 type MapT struct {
@@ -29,6 +62,19 @@ type MapT struct {
 	Primary   bool
 }
 
+// IndexT declares a secondary index on a column of the student table
+type IndexT struct {
+	Column string `gorm:"primaryKey"`
+}
+
+type ShardT struct {
+	Shard_id        string `gorm:"primaryKey"`
+	Target_replicas int
+	Stud_id_low     int
+	Shard_size      int
+	Term            int
+}
+
 type initPayload struct {
 	N       int
 	Shards  []shard
@@ -37,6 +83,66 @@ type initPayload struct {
 type readPayload struct {
 	Shard   string         `json:"shard" binding:"required"`
 	Stud_id map[string]int `json:"Stud_id" binding:"required"`
+	Limit   int            `json:"limit,omitempty"`
+}
+
+type predicate struct {
+	Column string      `json:"column" binding:"required"`
+	Op     string      `json:"op" binding:"required"`
+	Value  interface{} `json:"value" binding:"required"`
+}
+
+type queryPayload struct {
+	Shard    string      `json:"shard" binding:"required"`
+	Where    []predicate `json:"where"`
+	Select   []string    `json:"select,omitempty"`
+	Order_by string      `json:"order_by,omitempty"`
+	Desc     bool        `json:"desc,omitempty"`
+	Limit    int         `json:"limit,omitempty"`
+}
+
+type lookupPayload struct {
+	Shard  string      `json:"shard" binding:"required"`
+	Column string      `json:"column" binding:"required"`
+	Value  interface{} `json:"value" binding:"required"`
+}
+
+type aggregateSpec struct {
+	Op     string `json:"op" binding:"required"`
+	Column string `json:"column"`
+}
+
+type aggregatePayload struct {
+	Shard    string      `json:"shard" binding:"required"`
+	Where    []predicate `json:"where"`
+	Group_by []string    `json:"group_by"`
+	Columns  []string    `json:"columns"`
+}
+
+// aggregatePartial is the aggregate of one group as computed by a shard
+type aggregatePartial struct {
+	Key   map[string]interface{}
+	Count int64
+	Sum   map[string]float64
+	Min   map[string]float64
+	Max   map[string]float64
+}
+
+func (group *aggregatePartial) merge(partial aggregatePartial) {
+	group.Count += partial.Count
+	for column, sum := range partial.Sum {
+		group.Sum[column] += sum
+	}
+	for column, value := range partial.Min {
+		if current, ok := group.Min[column]; !ok || value < current {
+			group.Min[column] = value
+		}
+	}
+	for column, value := range partial.Max {
+		if current, ok := group.Max[column]; !ok || value > current {
+			group.Max[column] = value
+		}
+	}
 }
 
 type readResponse struct {
@@ -48,6 +154,34 @@ type writePayload struct {
 	Data  []student `json:"data" binding:"required"`
 }
 
+type txnPayload struct {
+	Shard string    `json:"shard" binding:"required"`
+	Tx_id string    `json:"tx_id" binding:"required"`
+	Data  []student `json:"data"`
+}
+
+type txnRecord struct {
+	Tx_id  string
+	State  string
+	Shards []string `json:",omitempty"`
+	Key    string   `json:",omitempty"`
+}
+
+type writeResult struct {
+	Inserted   []int
+	Duplicates []int
+	Replayed   bool
+	Index      int
+}
+
+type rowResult struct {
+	Stud_id int
+	Shard   string `json:",omitempty"`
+	Primary string `json:",omitempty"`
+	Status  string
+	Error   string `json:",omitempty"`
+}
+
 type updatePayload struct {
 	Shard   string  `json:"shard" binding:"required"`
 	Stud_id int     `json:"Stud_id" binding:"required"`
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	viewReconcile = time.Duration(envInt("VIEW_RECONCILE_S", 10)) * time.Second
+	// fetchView runs inside the retries of writes, so it makes a single attempt itself
+	viewFetch   = retryPolicy{attempts: 1, callTimeout: defaultRetry.callTimeout}
+	viewVersion int64
+	view        = make(map[string]shardView)
+	viewLock    = &sync.RWMutex{}
+	// the name the shard manager reaches this balancer under
+	balancerAddress = balancerName()
+)
+
+// balancerName is LB_ADDRESS, or the container hostname when it is unset
+func balancerName() string {
+	if name := os.Getenv("LB_ADDRESS"); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("Error getting hostname: %v", err)
+	}
+	return name
+}
+
+// loadView builds the initial view from map_db. This is the only time the balancer reads
+// placement from map_db, afterwards the shard manager pushes every change.
+func loadView() error {
+	var mapTs []MapT
+	err := mapdb.Find(&mapTs).Error
+	if err != nil {
+		return err
+	}
+	var shardTs []ShardT
+	err = mapdb.Find(&shardTs).Error
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]shardView)
+	for _, mapT := range mapTs {
+		shardView_ := loaded[mapT.Shard_id]
+		shardView_.Replicas = append(shardView_.Replicas, mapT.Server_id)
+		if mapT.Primary {
+			shardView_.Primary = mapT.Server_id
+		}
+		loaded[mapT.Shard_id] = shardView_
+	}
+	for _, shardT := range shardTs {
+		shardView_ := loaded[shardT.Shard_id]
+		shardView_.Target_replicas = shardT.Target_replicas
+		shardView_.Stud_id_low = shardT.Stud_id_low
+		shardView_.Shard_size = shardT.Shard_size
+		shardView_.Term = shardT.Term
+		loaded[shardT.Shard_id] = shardView_
+	}
+	viewLock.Lock()
+	view = loaded
+	viewLock.Unlock()
+	return nil
+}
+
+// loadShards rebuilds the shard ranges and consistent hash maps from map_db, so a restarted
+// balancer routes requests without another /init
+func loadShards() error {
+	var shardTs []ShardT
+	err := mapdb.Find(&shardTs).Error
+	if err != nil {
+		return err
+	}
+	var mapTs []MapT
+	err = mapdb.Find(&mapTs).Error
+	if err != nil {
+		return err
+	}
+	if len(shardTs) == 0 {
+		return nil
+	}
+	restoreRouting(shardTs, mapTs)
+	log.Printf("Routing restored for %d shards", len(shardTs))
+	return nil
+}
+
+// restoreRouting routes every shard of shardTs to the servers mapTs places it on
+func restoreRouting(shardTs []ShardT, mapTs []MapT) {
+	for _, shardT := range shardTs {
+		lb.putShard(newShard(shardT.Shard_id, shardT.Stud_id_low, shardT.Shard_size))
+	}
+	for _, mapT := range mapTs {
+		if _, ok := lb.shard(mapT.Shard_id); ok {
+			lb.insertServer(mapT.Server_id, mapT.Shard_id)
+		}
+	}
+}
+
+func newShard(shard_ string, low int, size int) *shardMetaData {
+	return &shardMetaData{
+		Stud_id_low:  low,
+		Shard_id:     shard_,
+		Stud_id_high: low + size,
+		Shard_size:   size,
+		hashmap:      &[M]string{},
+		servers:      make(map[string]bool),
+		rw:           &sync.RWMutex{},
+	}
+}
+
+// applyView replaces the view if the pushed one is newer
+func applyView(version int64, pushed map[string]shardView) bool {
+	viewLock.Lock()
+	defer viewLock.Unlock()
+	if version <= viewVersion {
+		return false
+	}
+	viewVersion = version
+	view = pushed
+	return true
+}
+
+// syncReplicas brings the shards and replica sets of the consistent hash maps in line with
+// the view, picking up shards another balancer added. The caller holds addRmLock and no
+// shard lock.
+func syncReplicas() {
+	viewLock.RLock()
+	current := view
+	viewLock.RUnlock()
+	for shard_, shardView_ := range current {
+		metaData, ok := lb.shard(shard_)
+		if !ok {
+			if shardView_.Shard_size == 0 {
+				continue
+			}
+			metaData = lb.putShard(newShard(shard_, shardView_.Stud_id_low, shardView_.Shard_size))
+			log.Printf("Shard %s added by another balancer", shard_)
+		}
+		replicas := make(map[string]bool)
+		for _, server := range shardView_.Replicas {
+			replicas[server] = true
+		}
+		metaData.rw.Lock()
+		for server := range replicas {
+			lb.insertServer(server, shard_)
+		}
+		for server := range metaData.servers {
+			if !replicas[server] {
+				lb.removeServer(server, shard_)
+			}
+		}
+		metaData.rw.Unlock()
+	}
+}
+
+// fetchView pulls the current view from the shard manager
+func fetchView() error {
+	_, body, err := viewFetch.send(context.Background(), http.MethodGet, "http://shard_manager:5000/view", nil, nil, acceptOK)
+	if err != nil {
+		return err
+	}
+	var payload syncPayload
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		return err
+	}
+	if applyView(payload.Version, payload.View) {
+		log.Printf("View reconciled to version %d", payload.Version)
+	}
+	return nil
+}
+
+// registerBalancer asks the shard manager to push views to this balancer
+func registerBalancer() error {
+	body, _ := json.Marshal(gin.H{"address": balancerAddress})
+	_, _, err := viewFetch.send(context.Background(), http.MethodPost, "http://shard_manager:5000/register", body, nil, acceptOK)
+	return err
+}
+
+// reconcileView periodically registers with the shard manager and pulls the view in case a
+// push was lost
+func reconcileView() {
+	for {
+		err := registerBalancer()
+		if err != nil {
+			log.Printf("Error registering with shard manager: %v", err)
+		}
+		time.Sleep(viewReconcile)
+		err = fetchView()
+		if err != nil {
+			log.Printf("Error reconciling view: %v", err)
+			continue
+		}
+		addRmLock.Lock()
+		syncReplicas()
+		addRmLock.Unlock()
+	}
+}
+
+func getView(shard_ string) (shardView, bool) {
+	viewLock.RLock()
+	defer viewLock.RUnlock()
+	shardView_, ok := view[shard_]
+	return shardView_, ok
+}
+
+// getPrimary returns the primary of the shard from the view, asking the shard manager once
+// when the view has none. Callers may hold shard locks, so the hash maps are left to the
+// next reconciliation.
+func getPrimary(shard_ string) (string, error) {
+	if shardView_, ok := getView(shard_); ok && shardView_.Primary != "" {
+		return shardView_.Primary, nil
+	}
+	err := fetchView()
+	if err != nil {
+		return "", err
+	}
+	if shardView_, ok := getView(shard_); ok && shardView_.Primary != "" {
+		return shardView_.Primary, nil
+	}
+	return "", fmt.Errorf("no primary for shard %s", shard_)
+}
+
+// termOf is the election term of the shard's primary in the view, sent along so servers can
+// fence off a deposed primary
+func termOf(shard_ string) int {
+	shardView_, _ := getView(shard_)
+	return shardView_.Term
+}
+
+// targetOf is the number of replicas the shard manager keeps for the shard
+func targetOf(shard_ string) int {
+	shardView_, _ := getView(shard_)
+	return shardView_.Target_replicas
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// resetView drops the view and its version for a test
+func resetView(t *testing.T) {
+	t.Helper()
+	viewLock.Lock()
+	viewVersion, view = 0, make(map[string]shardView)
+	viewLock.Unlock()
+}
+
+func TestApplyView(t *testing.T) {
+	resetView(t)
+	v1 := map[string]shardView{"sh1": {Primary: "Server0", Replicas: []string{"Server0", "Server1"}}}
+	v2 := map[string]shardView{"sh1": {Primary: "Server1", Replicas: []string{"Server1"}}}
+	tests := []struct {
+		name    string
+		version int64
+		pushed  map[string]shardView
+		applied bool
+		primary string
+	}{
+		{"first push", 1, v1, true, "Server0"},
+		{"same version again", 1, v2, false, "Server0"},
+		{"newer", 3, v2, true, "Server1"},
+		{"late older push", 2, v1, false, "Server1"},
+	}
+	for _, tt := range tests {
+		if applied := applyView(tt.version, tt.pushed); applied != tt.applied {
+			t.Errorf("%s: got applied %v, want %v", tt.name, applied, tt.applied)
+		}
+		primary, err := getPrimary("sh1")
+		if err != nil || primary != tt.primary {
+			t.Errorf("%s: got primary %s, %v, want %s", tt.name, primary, err, tt.primary)
+		}
+	}
+}
+
+func TestSyncReplicas(t *testing.T) {
+	defer func(balancer *loadBalancer) { lb = balancer }(lb)
+	resetView(t)
+	lb = routedShard("Server0", "Server1")
+	applyView(1, map[string]shardView{
+		"sh1": {Primary: "Server1", Replicas: []string{"Server1", "Server2"}, Target_replicas: 2},
+		// shards the balancer does not route yet are left alone
+		"sh2": {Primary: "Server3", Replicas: []string{"Server3"}, Target_replicas: 1},
+		// unless another balancer added them with their range
+		"sh3": {Primary: "Server2", Replicas: []string{"Server2"}, Target_replicas: 1, Stud_id_low: 100, Shard_size: 50},
+	})
+	syncReplicas()
+	var servers []string
+	for server := range lb.shards["sh1"].servers {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	if !reflect.DeepEqual(servers, []string{"Server1", "Server2"}) {
+		t.Errorf("got replicas %v", servers)
+	}
+	for _, server := range lb.shards["sh1"].hashmap {
+		if server == "Server0" {
+			t.Fatal("removed replica is still in the hash map")
+		}
+	}
+	if _, ok := lb.shards["sh2"]; ok {
+		t.Error("unrouted shard was added")
+	}
+	added, ok := lb.shards["sh3"]
+	if !ok || added.Stud_id_low != 100 || added.Stud_id_high != 150 || !reflect.DeepEqual(added.servers, map[string]bool{"Server2": false}) {
+		t.Errorf("got added shard %+v, %v", added, ok)
+	}
+	if target := targetOf("sh1"); target != 2 {
+		t.Errorf("got target %d, want 2", target)
+	}
+}
+
+func TestRestoreRouting(t *testing.T) {
+	defer func(balancer *loadBalancer) { lb = balancer }(lb)
+	lb = &loadBalancer{}
+	restoreRouting([]ShardT{
+		{Shard_id: "sh1", Stud_id_low: 0, Shard_size: 4096},
+		{Shard_id: "sh2", Stud_id_low: 4096, Shard_size: 4096},
+	}, []MapT{
+		{Shard_id: "sh1", Server_id: "Server0", Primary: true},
+		{Shard_id: "sh1", Server_id: "Server1"},
+		{Shard_id: "sh2", Server_id: "Server1", Primary: true},
+		// a placement left behind by a shard that no longer exists
+		{Shard_id: "sh9", Server_id: "Server2"},
+	})
+	tests := []struct {
+		shard     string
+		low, high int
+		servers   []string
+	}{
+		{"sh1", 0, 4096, []string{"Server0", "Server1"}},
+		{"sh2", 4096, 8192, []string{"Server1"}},
+	}
+	if len(lb.shards) != len(tests) {
+		t.Fatalf("got %d shards, want %d", len(lb.shards), len(tests))
+	}
+	for _, tt := range tests {
+		metaData := lb.shards[tt.shard]
+		if metaData.Stud_id_low != tt.low || metaData.Stud_id_high != tt.high {
+			t.Errorf("%s: got range [%d, %d), want [%d, %d)", tt.shard, metaData.Stud_id_low, metaData.Stud_id_high, tt.low, tt.high)
+		}
+		var servers []string
+		for server := range metaData.servers {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+		if !reflect.DeepEqual(servers, tt.servers) {
+			t.Errorf("%s: got servers %v, want %v", tt.shard, servers, tt.servers)
+		}
+		if server := lb.getServerID(tt.shard); server == "" {
+			t.Errorf("%s: no server in the hash map", tt.shard)
+		}
+	}
+	if _, ok := lb.server_shard_mapping["Server2"]; ok {
+		t.Error("server of an unknown shard was mapped")
+	}
+}
+
+func TestPutShard(t *testing.T) {
+	balancer := &loadBalancer{}
+	var wg sync.WaitGroup
+	put := make([]*shardMetaData, 8)
+	for i := range put {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			put[i] = balancer.putShard(newShard("sh1", 0, 100))
+		}(i)
+	}
+	wg.Wait()
+	// every request that raced to add the shard routes through the one that won
+	routed, ok := balancer.shard("sh1")
+	for i, shard_ := range put {
+		if !ok || shard_ != routed {
+			t.Errorf("request %d got %p, routing holds %p", i, shard_, routed)
+		}
+	}
+	if shards := balancer.shardList(); len(shards) != 1 {
+		t.Errorf("got %d shards, want 1", len(shards))
+	}
+}
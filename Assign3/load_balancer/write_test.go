@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRowResults(t *testing.T) {
+	rows := func(ids ...int) []student {
+		var data []student
+		for _, id := range ids {
+			data = append(data, student{Stud_id: id})
+		}
+		return data
+	}
+	tests := []struct {
+		name    string
+		data    []student
+		skipped []int
+		want    []string
+	}{
+		{"all inserted", rows(1, 2, 3), nil, []string{"inserted", "inserted", "inserted"}},
+		{"existing row", rows(1, 2, 3), []int{2}, []string{"inserted", "duplicate", "inserted"}},
+		{"repeated in the batch", rows(1, 2, 1), []int{1}, []string{"inserted", "inserted", "duplicate"}},
+		{"repeated and existing", rows(1, 1, 2), []int{1, 1}, []string{"duplicate", "duplicate", "inserted"}},
+		{"nothing new", rows(4, 5), []int{5, 4}, []string{"duplicate", "duplicate"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := rowResults("sh1", "Server0", tt.data, tt.skipped)
+			var got []string
+			for i, result := range results {
+				if result.Stud_id != tt.data[i].Stud_id || result.Shard != "sh1" || result.Primary != "Server0" {
+					t.Errorf("row %d: got %+v", i, result)
+				}
+				got = append(got, result.Status)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFinalRejection(t *testing.T) {
+	tests := []struct {
+		status int
+		final  bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusBadRequest, true},
+		{http.StatusNotFound, true},
+		{http.StatusConflict, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusMisdirectedRequest, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			if got := finalRejection(tt.status); got != tt.final {
+				t.Errorf("got %v, want %v", got, tt.final)
+			}
+		})
+	}
+}
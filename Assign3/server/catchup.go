@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"net/http"
+)
+
+var (
+	// most entries a replica fetches in one catch-up call
+	catchupBatch = envInt("CATCHUP_BATCH", 1000)
+	// most rows a replica fetches in one snapshot chunk
+	snapshotChunk = envInt("SNAPSHOT_CHUNK", 1000)
+)
+
+// catchupHandler sends a replica the entries after the last one it holds. 410 tells it the
+// primary compacted those entries away and it has to start from a snapshot.
+func catchupHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	var payload catchupPayload
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	logT, ok := g_shard_log_map[payload.Shard]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return
+	}
+	if payload.From < logT.base {
+		c.JSON(http.StatusGone, gin.H{"error": fmt.Sprintf("entries up to %d were compacted", logT.base), "base": logT.base})
+		return
+	}
+	last := logT.lastIndex()
+	if payload.From > last {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("replica holds %d entries, the primary %d", payload.From, last)})
+		return
+	}
+	limit := payload.Limit
+	if limit <= 0 || limit > catchupBatch {
+		limit = catchupBatch
+	}
+	end := payload.From + limit
+	if end > last {
+		end = last
+	}
+	response := catchupResponse{Entries: []logPayload{}, Last_index: last}
+	err = logT.each(payload.From+1, end, func(_ int, record []byte) error {
+		var logItem logPayload
+		err := json.Unmarshal(record, &logItem)
+		if err != nil {
+			return err
+		}
+		response.Entries = append(response.Entries, logItem)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error reading log items: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// snapshotHandler sends a chunk of the rows of a shard in Stud_id order, starting after the
+// given id. The first chunk, asked for with a negative id, also carries the index the primary
+// had applied and the transaction and sequence state of its log.
+func snapshotHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	var payload snapshotPayload
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shard_ := payload.Shard
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	logT, ok := g_shard_log_map[shard_]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return
+	}
+	limit := payload.Limit
+	if limit <= 0 || limit > snapshotChunk {
+		limit = snapshotChunk
+	}
+	var chunk shardSnapshot
+	if payload.After < 0 {
+		chunk.Index = *logT.index
+		chunk.Prepared = g_prepared[shard_]
+		chunk.Decided = g_txn_decided[shard_]
+		chunk.Last_seq = sequencesOf(shard_).last
+		chunk.Recent = sequencesOf(shard_).records(chunk.Index)
+	}
+	err = db.Table(shard_).Where("Stud_id > ?", payload.After).Order("Stud_id").Limit(limit).Find(&chunk.Rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, chunk)
+}
+
+// resyncHandler catches a secondary up from its primary, which stopped shipping to it when it
+// fell too far behind. Shipped requests wait for it, so the entries stay in log order.
+func resyncHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	var payload resyncPayload
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shard_ := payload.Shard
+	release := lockShardOrder(shard_)
+	defer release()
+	if !checkReady(c, shard_) {
+		return
+	}
+	if !checkTerm(c, shard_) {
+		return
+	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	logT, ok := g_shard_log_map[shard_]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return
+	}
+	err = catchUp(c.Request.Context(), shard_, payload.Primary)
+	if err != nil {
+		log.Printf("Error catching up shard %s from %s:%v", shard_, payload.Primary, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Caught up", "index": *logT.index, "status": "success"})
+}
+
+// catchUp brings a replica of a shard level with the primary. It asks for the entries after
+// the last one it holds and falls back to a snapshot only when the primary compacted them
+// away or has fewer. ctx bounds the calls to the primary. indexLock is held.
+func catchUp(ctx context.Context, shard_ string, primaryServer string) error {
+	logT := g_shard_log_map[shard_]
+	endpoint := fmt.Sprintf("http://%s:5000/catchup", primaryServer)
+	for {
+		from := logT.lastIndex()
+		body, _ := json.Marshal(catchupPayload{Shard: shard_, From: from, Limit: catchupBatch})
+		status, answer, err := defaultRetry.send(ctx, http.MethodPost, endpoint, body, nil, acceptAnswer)
+		if err != nil {
+			return err
+		}
+		// a replica holding entries the primary never had, like a deposed primary that
+		// restarted, is rebuilt from a snapshot as well
+		if status == http.StatusGone || status == http.StatusConflict {
+			log.Printf("Primary %s cannot continue shard %s after entry %d, fetching a snapshot", primaryServer, shard_, from)
+			err = fetchSnapshot(ctx, shard_, primaryServer)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("%s answered %d: %s", endpoint, status, answer)
+		}
+		var response catchupResponse
+		err = json.Unmarshal(answer, &response)
+		if err != nil {
+			return err
+		}
+		for _, logItem := range response.Entries {
+			err = writeToLog(logItem, shard_)
+			if err != nil {
+				return err
+			}
+		}
+		if len(response.Entries) == 0 || from+len(response.Entries) >= response.Last_index {
+			break
+		}
+	}
+	err := logT.syncNow()
+	if err != nil {
+		return err
+	}
+	return executeFromLog(shard_)
+}
+
+// fetchSnapshot replaces the rows of a replica with the primary's and restarts its log at the
+// index the primary had applied when the first chunk was read. The chunks are loaded into a
+// staging table first and swapped in with one transaction, so a failed fetch leaves the rows
+// and the log as they were. Later chunks may already hold rows written after that index;
+// replaying the entries from there brings every row to its latest state either way.
+// indexLock is held.
+func fetchSnapshot(ctx context.Context, shard_ string, primaryServer string) error {
+	staging := shard_ + "_staging"
+	err := db.Migrator().DropTable(staging)
+	if err == nil {
+		err = db.Table(staging).AutoMigrate(&StudT{})
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := db.Migrator().DropTable(staging)
+		if err != nil {
+			log.Printf("Error dropping %s:%v", staging, err)
+		}
+	}()
+	endpoint := fmt.Sprintf("http://%s:5000/snapshot", primaryServer)
+	var first shardSnapshot
+	after := -1
+	for {
+		body, _ := json.Marshal(snapshotPayload{Shard: shard_, After: after, Limit: snapshotChunk})
+		_, answer, err := defaultRetry.send(ctx, http.MethodPost, endpoint, body, nil, acceptOK)
+		if err != nil {
+			return err
+		}
+		var chunk shardSnapshot
+		err = json.Unmarshal(answer, &chunk)
+		if err != nil {
+			return err
+		}
+		if after < 0 {
+			first = chunk
+		}
+		if len(chunk.Rows) == 0 {
+			break
+		}
+		err = db.Table(staging).Clauses(clause.OnConflict{UpdateAll: true}).Create(&chunk.Rows).Error
+		if err != nil {
+			return err
+		}
+		after = chunk.Rows[len(chunk.Rows)-1].Stud_id
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Table(shard_).Where("1 = 1").Delete(&StudT{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO ? SELECT * FROM ?", clause.Table{Name: shard_}, clause.Table{Name: staging}).Error
+	})
+	if err != nil {
+		return err
+	}
+	return restartLog(shard_, first)
+}
+
+// restartLog empties the log of a shard whose rows were just replaced by a snapshot, so the
+// next entry is the one after it. indexLock is held.
+func restartLog(shard_ string, snapshot shardSnapshot) error {
+	logT := g_shard_log_map[shard_]
+	err := logT.reset(snapshot.Index)
+	if err != nil {
+		return err
+	}
+	snapshot.Rows = nil
+	logT.snapshot = &snapshot
+	*logT.index = snapshot.Index
+	err = saveIndex(shard_, snapshot.Index)
+	if err != nil {
+		return err
+	}
+	err = loadTxns(shard_)
+	if err != nil {
+		return err
+	}
+	err = loadSequences(shard_)
+	if err != nil {
+		return err
+	}
+	return loadIndexes(shard_)
+}
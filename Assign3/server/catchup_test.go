@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCatchupHandler(t *testing.T) {
+	defer func(done bool, batch int) { configDone, catchupBatch = done, batch }(configDone, catchupBatch)
+	configDone = true
+	catchupBatch = 3
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/catchup", catchupHandler)
+	tests := []struct {
+		name   string
+		base   int
+		from   int
+		limit  int
+		status int
+		seqs   []int
+	}{
+		{"from the start", 0, 0, 2, http.StatusOK, []int{1, 2}},
+		{"rest of the log", 0, 3, 10, http.StatusOK, []int{4, 5}},
+		{"capped at the batch", 0, 0, 10, http.StatusOK, []int{1, 2, 3}},
+		{"no limit", 0, 1, 0, http.StatusOK, []int{2, 3, 4}},
+		{"level already", 0, 5, 10, http.StatusOK, []int{}},
+		{"after the compacted entries", 2, 2, 10, http.StatusOK, []int{3, 4, 5}},
+		{"compacted away", 2, 1, 10, http.StatusGone, nil},
+		{"ahead of the primary", 0, 6, 10, http.StatusConflict, nil},
+		{"unknown shard", -1, 0, 10, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// entries 1 to 5, each carrying its index as sequence, up to base compacted
+			var entries []logPayload
+			for seq := tt.base + 1; seq <= 5; seq++ {
+				entries = append(entries, logPayload{Operation: "w", Seq: seq})
+			}
+			logFrom(t, "sh1", tt.base, entries)
+			shard_ := "sh1"
+			if tt.base < 0 {
+				shard_ = "sh9"
+			}
+			body, _ := json.Marshal(catchupPayload{Shard: shard_, From: tt.from, Limit: tt.limit})
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/catchup", strings.NewReader(string(body))))
+			if recorder.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, tt.status, recorder.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var response catchupResponse
+			err := json.Unmarshal(recorder.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seqs := []int{}
+			for _, entry := range response.Entries {
+				seqs = append(seqs, entry.Seq)
+			}
+			if !reflect.DeepEqual(seqs, tt.seqs) || response.Last_index != 5 {
+				t.Errorf("got entries %v up to %d, want %v up to 5", seqs, response.Last_index, tt.seqs)
+			}
+		})
+	}
+}
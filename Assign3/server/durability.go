@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// when a WAL record reaches the disk before the write is acknowledged: "none" leaves it to
+	// the OS, "write" syncs every record on its own and "group" syncs the records of concurrent
+	// writers together
+	walSyncMode = walSyncModeOf(os.Getenv("WAL_SYNC"))
+	// how long the first writer of a group waits for others to join it before syncing
+	groupCommitWindow = time.Duration(envInt("WAL_GROUP_COMMIT_US", 2000)) * time.Microsecond
+	// WAL counters since the server started
+	g_wal_metrics = walMetrics{started: time.Now()}
+)
+
+func walSyncModeOf(mode string) string {
+	switch mode {
+	case "":
+		return "group"
+	case "none", "write", "group":
+		return mode
+	}
+	log.Printf("Invalid WAL_SYNC %q, using group", mode)
+	return "group"
+}
+
+// walSync tracks the records of a log not yet synced to disk
+type walSync struct {
+	mu      sync.Mutex
+	done    *sync.Cond
+	dirty   map[*os.File]bool
+	written int
+	synced  int
+	syncing bool
+	// the last failed sync and the records it covered
+	failed   error
+	failedTo int
+}
+
+func newWalSync() *walSync {
+	s := &walSync{dirty: make(map[*os.File]bool)}
+	s.done = sync.NewCond(&s.mu)
+	return s
+}
+
+type walMetrics struct {
+	mu        sync.Mutex
+	started   time.Time
+	records   int64
+	bytes     int64
+	syncs     int64
+	synced    int64
+	syncTotal time.Duration
+	syncMax   time.Duration
+}
+
+func (m *walMetrics) wrote(bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records++
+	m.bytes += int64(bytes)
+}
+
+func (m *walMetrics) flushed(records int, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syncs++
+	m.synced += int64(records)
+	m.syncTotal += took
+	if took > m.syncMax {
+		m.syncMax = took
+	}
+}
+
+// syncFiles syncs the segments records were written to. A segment closed since then was
+// compacted or truncated away and has nothing left to sync.
+func syncFiles(files map[*os.File]bool) error {
+	for file := range files {
+		err := file.Sync()
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// appended notes a record written to file, which is synced right away in the write mode.
+// indexLock is held.
+func (s *walSync) appended(file *os.File) error {
+	switch walSyncMode {
+	case "write":
+		start := time.Now()
+		err := file.Sync()
+		if err != nil {
+			return err
+		}
+		g_wal_metrics.flushed(1, time.Since(start))
+	case "group":
+		s.mu.Lock()
+		s.dirty[file] = true
+		s.written++
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// flush syncs what was written so far and returns once it is on disk
+func (s *walSync) flush() error {
+	s.mu.Lock()
+	files := s.dirty
+	s.dirty = make(map[*os.File]bool)
+	upTo := s.written
+	from := s.synced
+	s.mu.Unlock()
+
+	start := time.Now()
+	err := syncFiles(files)
+	took := time.Since(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		// the next flush retries these segments
+		for file := range files {
+			s.dirty[file] = true
+		}
+		s.failed = err
+		s.failedTo = upTo
+		s.done.Broadcast()
+		return err
+	}
+	if upTo > s.synced {
+		s.synced = upTo
+	}
+	g_wal_metrics.flushed(upTo-from, took)
+	s.done.Broadcast()
+	return nil
+}
+
+// awaitSync returns once the records written to the log so far are on disk. In the group
+// mode the first writer to wait holds the sync back for the commit window so the writers
+// arriving meanwhile share it. indexLock must not be held.
+func (l *LogT) awaitSync() error {
+	if walSyncMode != "group" {
+		return nil
+	}
+	s := l.sync
+	s.mu.Lock()
+	target := s.written
+	for s.synced < target {
+		if s.failed != nil && s.failedTo >= target {
+			err := s.failed
+			s.mu.Unlock()
+			return err
+		}
+		if s.syncing {
+			s.done.Wait()
+			continue
+		}
+		s.syncing = true
+		s.failed = nil
+		s.mu.Unlock()
+		time.Sleep(groupCommitWindow)
+		err := s.flush()
+		s.mu.Lock()
+		s.syncing = false
+		s.done.Broadcast()
+		if err != nil {
+			s.mu.Unlock()
+			log.Printf("Error syncing log of shard %s:%v", l.shard, err)
+			return err
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// syncNow puts the records written so far on disk without waiting for other writers, for
+// callers that hold indexLock
+func (l *LogT) syncNow() error {
+	if walSyncMode != "group" {
+		return nil
+	}
+	return l.sync.flush()
+}
+
+// metricsHandler reports the WAL throughput and fsync latency of this server
+func metricsHandler(c *gin.Context) {
+	m := &g_wal_metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	uptime := time.Since(m.started).Seconds()
+	response := walReport{
+		Sync_mode:       walSyncMode,
+		Records:         m.records,
+		Bytes:           m.bytes,
+		Records_per_sec: float64(m.records) / uptime,
+		Bytes_per_sec:   float64(m.bytes) / uptime,
+		Fsyncs:          m.syncs,
+		Fsync_max_ms:    float64(m.syncMax) / float64(time.Millisecond),
+	}
+	if m.syncs > 0 {
+		response.Records_per_sync = float64(m.synced) / float64(m.syncs)
+		response.Fsync_avg_ms = float64(m.syncTotal) / float64(m.syncs) / float64(time.Millisecond)
+	}
+	c.JSON(http.StatusOK, response)
+}
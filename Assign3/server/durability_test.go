@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWalSyncModeOf(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", "group"},
+		{"none", "none"},
+		{"write", "write"},
+		{"group", "group"},
+		{"always", "group"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			if got := walSyncModeOf(tt.mode); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAwaitSync(t *testing.T) {
+	defer func(mode string, window time.Duration) { walSyncMode, groupCommitWindow = mode, window }(walSyncMode, groupCommitWindow)
+	groupCommitWindow = 20 * time.Millisecond
+	tests := []struct {
+		name    string
+		mode    string
+		writers int
+		// records the group sync tracks
+		tracked int
+	}{
+		{"group of one", "group", 1, 1},
+		{"group of many", "group", 8, 8},
+		{"write syncs each record", "write", 4, 0},
+		{"none leaves it to the OS", "none", 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			walSyncMode = tt.mode
+			l := testLog(t, 0, 1)
+			g_wal_metrics.mu.Lock()
+			syncs := g_wal_metrics.syncs
+			g_wal_metrics.mu.Unlock()
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.writers)
+			for i := 1; i <= tt.writers; i++ {
+				indexLock.Lock()
+				err := l.Write(1, payloadOf(i))
+				indexLock.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- l.awaitSync()
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatalf("awaitSync: %v", err)
+				}
+			}
+			s := l.sync
+			if s.written != tt.tracked || s.synced != tt.tracked || len(s.dirty) != 0 {
+				t.Errorf("got %d written, %d synced, %d dirty, want %d, %d, 0", s.written, s.synced, len(s.dirty), tt.tracked, tt.tracked)
+			}
+			g_wal_metrics.mu.Lock()
+			syncs = g_wal_metrics.syncs - syncs
+			g_wal_metrics.mu.Unlock()
+			// writers arriving within the commit window share a sync
+			if tt.mode == "group" && (syncs < 1 || tt.writers > 1 && syncs >= int64(tt.writers)) {
+				t.Errorf("got %d syncs for %d writers", syncs, tt.writers)
+			}
+			if tt.mode == "write" && syncs != int64(tt.writers) {
+				t.Errorf("got %d syncs for %d records", syncs, tt.writers)
+			}
+		})
+	}
+}
+
+func TestFlushRetriesFailedSegments(t *testing.T) {
+	l := testLog(t, 0, 1)
+	defer func(mode string) { walSyncMode = mode }(walSyncMode)
+	walSyncMode = "group"
+	err := l.Write(1, payloadOf(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an unsyncable file fails the flush and stays dirty for the next one
+	file := l.segments[0].file
+	l.sync.dirty[nil] = true
+	err = l.sync.flush()
+	if err == nil {
+		t.Fatal("flush of an unsyncable file succeeded")
+	}
+	if !l.sync.dirty[file] || l.sync.synced != 0 || l.sync.failedTo != 1 {
+		t.Errorf("got dirty %v, synced %d, failed to %d after a failed flush", l.sync.dirty, l.sync.synced, l.sync.failedTo)
+	}
+	delete(l.sync.dirty, nil)
+	err = l.sync.flush()
+	if err != nil || l.sync.synced != 1 || len(l.sync.dirty) != 0 {
+		t.Errorf("retry: got %v, synced %d, %d dirty", err, l.sync.synced, len(l.sync.dirty))
+	}
+}
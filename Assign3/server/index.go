@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// secondaryIndex maps the values of one column of a shard to the Stud_ids holding them. rows
+// keeps the indexed value of every row so updates and deletes can find the old entry.
+type secondaryIndex struct {
+	values map[string]map[int]bool
+	rows   map[int]string
+}
+
+// secondary indexes per shard and column, guarded by indexLock and kept in step with the
+// table by executeFromLog
+var g_indexes = make(map[string]map[string]*secondaryIndex)
+
+// indexKey folds a value the way the table collation compares it, ignoring case and
+// trailing spaces, so a lookup finds every row an equality query would
+func indexKey(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return strings.ToLower(strings.TrimRight(s, " "))
+	}
+	return fmt.Sprint(value)
+}
+
+func (index *secondaryIndex) add(id int, value string) {
+	if index.values[value] == nil {
+		index.values[value] = make(map[int]bool)
+	}
+	index.values[value][id] = true
+	index.rows[id] = value
+}
+
+func (index *secondaryIndex) remove(id int) {
+	value, ok := index.rows[id]
+	if !ok {
+		return
+	}
+	delete(index.values[value], id)
+	if len(index.values[value]) == 0 {
+		delete(index.values, value)
+	}
+	delete(index.rows, id)
+}
+
+// buildIndex indexes a column of a shard from its table
+func buildIndex(shard_ string, column string) error {
+	var studs []StudT
+	err := db.Table(shard_).Find(&studs).Error
+	if err != nil {
+		return err
+	}
+	index := &secondaryIndex{values: make(map[string]map[int]bool), rows: make(map[int]string)}
+	for _, stud := range studs {
+		index.add(stud.Stud_id, indexKey(stud.column(column)))
+	}
+	if g_indexes[shard_] == nil {
+		g_indexes[shard_] = make(map[string]*secondaryIndex)
+	}
+	g_indexes[shard_][column] = index
+	return nil
+}
+
+// loadIndexes builds every index declared in map_db for a shard
+func loadIndexes(shard_ string) error {
+	var indexTs []IndexT
+	err := mapdb.Model(&IndexT{}).Find(&indexTs).Error
+	if err != nil {
+		return err
+	}
+	g_indexes[shard_] = make(map[string]*secondaryIndex)
+	for _, indexT := range indexTs {
+		err = buildIndex(shard_, indexT.Column)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexInsert indexes rows just written to the shard. Rows already indexed existed before
+// and were skipped by the insert.
+func indexInsert(shard_ string, rows []StudT) {
+	for column, index := range g_indexes[shard_] {
+		for _, row := range rows {
+			if _, ok := index.rows[row.Stud_id]; !ok {
+				index.add(row.Stud_id, indexKey(row.column(column)))
+			}
+		}
+	}
+}
+
+// indexUpdate re-indexes a row after an update, reading it back since an update only sets
+// the fields it carries
+func indexUpdate(shard_ string, id int) error {
+	if len(g_indexes[shard_]) == 0 {
+		return nil
+	}
+	var rows []StudT
+	err := db.Table(shard_).Where("stud_id = ?", id).Find(&rows).Error
+	if err != nil {
+		return err
+	}
+	for column, index := range g_indexes[shard_] {
+		index.remove(id)
+		for _, row := range rows {
+			index.add(row.Stud_id, indexKey(row.column(column)))
+		}
+	}
+	return nil
+}
+
+func indexDelete(shard_ string, id int) {
+	for _, index := range g_indexes[shard_] {
+		index.remove(id)
+	}
+}
+
+// indexHandler starts maintaining an index on a column for every shard of this server. The
+// balancer calls it after declaring the index in map_db.
+func indexHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	var payload struct {
+		Column string `json:"column" binding:"required"`
+	}
+	jsonData := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonData), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON:%v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := queryColumns[payload.Column]; !ok || payload.Column == "Stud_id" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot index column %s", payload.Column)})
+		return
+	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	for shard_ := range g_shard_log_map {
+		// the table has to hold every logged entry before it is scanned
+		err = executeFromLog(shard_)
+		if err == nil {
+			err = buildIndex(shard_, payload.Column)
+		}
+		if err != nil {
+			log.Printf("Error building index on %s for shard %s:%v", payload.Column, shard_, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Index on " + payload.Column + " built", "status": "success"})
+}
+
+// lookupHandler answers which Stud_ids of a shard hold a value of an indexed column without
+// touching the table
+func lookupHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	var payload lookupPayload
+	jsonData := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonData), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON:%v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	index, ok := g_indexes[payload.Shard][payload.Column]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no index on %s for shard %s", payload.Column, payload.Shard)})
+		return
+	}
+	countRequest(payload.Shard)
+	if !checkReady(c, payload.Shard) {
+		return
+	}
+	ids := []int{}
+	for id := range index.values[indexKey(payload.Value)] {
+		ids = append(ids, id)
+	}
+	c.JSON(http.StatusOK, gin.H{"ids": ids, "status": "success"})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIndexKey(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"Alice", "alice"},
+		{"ALICE  ", "alice"},
+		{"  Alice", "  alice"},
+		{70, "70"},
+		{70.0, "70"},
+		{nil, "<nil>"},
+	}
+	for _, tt := range tests {
+		if got := indexKey(tt.value); got != tt.want {
+			t.Errorf("%#v: got %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+// indexedShard starts an empty index on Stud_name for shard sh1
+func indexedShard(t *testing.T) *secondaryIndex {
+	t.Helper()
+	index := &secondaryIndex{values: make(map[string]map[int]bool), rows: make(map[int]string)}
+	g_indexes["sh1"] = map[string]*secondaryIndex{"Stud_name": index}
+	t.Cleanup(func() { delete(g_indexes, "sh1") })
+	return index
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	index := indexedShard(t)
+	indexInsert("sh1", []StudT{{Stud_id: 1, Stud_name: "Ann"}, {Stud_id: 2, Stud_name: "ann "}, {Stud_id: 3, Stud_name: "Bob"}})
+	// the insert skipped a row that was already there, so its value stays
+	indexInsert("sh1", []StudT{{Stud_id: 3, Stud_name: "Carl"}})
+	want := map[string]map[int]bool{"ann": {1: true, 2: true}, "bob": {3: true}}
+	if !reflect.DeepEqual(index.values, want) {
+		t.Fatalf("got %v, want %v", index.values, want)
+	}
+	index.remove(1)
+	index.add(1, "carl")
+	indexDelete("sh1", 3)
+	indexDelete("sh1", 9)
+	want = map[string]map[int]bool{"ann": {2: true}, "carl": {1: true}}
+	if !reflect.DeepEqual(index.values, want) {
+		t.Errorf("got %v, want %v", index.values, want)
+	}
+	if !reflect.DeepEqual(index.rows, map[int]string{1: "carl", 2: "ann"}) {
+		t.Errorf("got rows %v", index.rows)
+	}
+}
+
+func TestLookupHandler(t *testing.T) {
+	defer func(done bool) { configDone = done }(configDone)
+	configDone = true
+	indexedShard(t)
+	indexInsert("sh1", []StudT{{Stud_id: 1, Stud_name: "Ann"}, {Stud_id: 2, Stud_name: "ANN"}, {Stud_id: 3, Stud_name: "Bob"}})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/lookup", lookupHandler)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		ids    []int
+	}{
+		{"folded value", `{"shard":"sh1","column":"Stud_name","value":"ann"}`, http.StatusOK, []int{1, 2}},
+		{"no rows", `{"shard":"sh1","column":"Stud_name","value":"Eve"}`, http.StatusOK, []int{}},
+		{"no index on the column", `{"shard":"sh1","column":"Stud_marks","value":70}`, http.StatusNotFound, nil},
+		{"unknown shard", `{"shard":"sh9","column":"Stud_name","value":"Ann"}`, http.StatusNotFound, nil},
+		{"bad json", `{"shard":`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/lookup", strings.NewReader(tt.body)))
+			if recorder.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, tt.status, recorder.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Ids []int
+			}
+			err := json.Unmarshal(recorder.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Ints(resp.Ids)
+			if !reflect.DeepEqual(resp.Ids, tt.ids) {
+				t.Errorf("got ids %v, want %v", resp.Ids, tt.ids)
+			}
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -24,6 +24,8 @@ var (
 	g_shard_log_map = make(map[string]*LogT)
 	indexLock       = &sync.Mutex{}
 	configDone      = false
+	g_shard_stats   = make(map[string]int)
+	statsLock       = &sync.Mutex{}
 )
 
 func getJSONstring(c *gin.Context) string {
@@ -35,45 +37,84 @@ func getJSONstring(c *gin.Context) string {
 	return string(body)
 }
 
+// failureBody is how the server reports a failed request
+func failureBody(message string) gin.H {
+	return gin.H{"error": message}
+}
+
 func writeToLog(logItem logPayload, shard_ string) error {
+	// a raft leader stamps its entries with its term
+	if node := raftOf(shard_); node != nil && logItem.Raft_term == 0 {
+		logItem.Raft_term = node.currentTerm()
+	}
 	// convert logItem to a string
 	jsonData, err := json.Marshal(logItem)
 	if err != nil {
 		log.Fatalln("Error marshalling logItem to JSON:", err)
 		return err
 	}
-	jsonData = append(jsonData, []byte("\n")...)
 	// write logItem to the log file
-	err = g_shard_log_map[shard_].Write(jsonData)
+	err = g_shard_log_map[shard_].Write(logItem.Raft_term, jsonData)
 	if err != nil {
-		log.Fatalln("Error writing logItem to log file:", err)
+		// Write cut off whatever part of the record made it to the file
+		log.Println("Error writing logItem to log file:", err)
 		return err
 	}
+	sequencesOf(shard_).observe(logItem)
+	trackTxn(shard_, logItem)
 	return nil
 }
 
 func executeFromLog(shard_ string) error {
-	logData := g_shard_log_map[shard_].data
-	idx := g_shard_log_map[shard_].index
-	// split the logData by \n
-	logItems := strings.Split(string(logData), "\n")
-	if logItems[len(logItems)-1] == "" {
-		logItems = logItems[:len(logItems)-1]
-	}
-	for *idx < len(logItems) {
+	logT := g_shard_log_map[shard_]
+	idx := logT.index
+	limit := logT.lastIndex()
+	// a raft replica only applies what a majority has logged
+	if node := raftOf(shard_); node != nil {
+		if commit := node.committed(); commit < limit {
+			limit = commit
+		}
+	}
+	for *idx < limit {
+		record, err := logT.entry(*idx + 1)
+		if err != nil {
+			// the entry was torn on disk, it and everything after it were never applied
+			log.Printf("Error reading log item, truncating the log of shard %s:%v", shard_, err)
+			truncErr := truncateLog(shard_, *idx)
+			if truncErr != nil {
+				log.Printf("Error truncating log for shard %s:%v", shard_, truncErr)
+			}
+			return err
+		}
 		var logItem logPayload
-		err := json.Unmarshal([]byte(logItems[*idx]), &logItem)
+		err = json.Unmarshal(record, &logItem)
 		if err != nil {
-			log.Fatalf("\nError unmarshalling log item: %v\n", err)
+			log.Printf("Error unmarshalling log item of shard %s:%v", shard_, err)
 			return err
 		}
-		if logItem.Operation == "w" {
+		// a committed transaction carries the rows it prepared
+		if logItem.Operation == "w" || logItem.Operation == "c" {
+			// every inserted row starts at version 1
+			rows := make([]StudT, len(logItem.W_Data))
+			copy(rows, logItem.W_Data)
+			for i := range rows {
+				rows[i].Version = 1
+			}
 			err := db.Transaction(func(tx *gorm.DB) error {
-				result := tx.Table(shard_).Clauses(clause.OnConflict{DoNothing: true}).Create(&logItem.W_Data)
-				if result.Error != nil {
-					return err
+				// writes skip the rows that already exist, but nothing may have taken the
+				// rows a transaction prepared, so a commit never drops one silently
+				if logItem.Operation == "w" {
+					result := tx.Table(shard_).Clauses(clause.OnConflict{DoNothing: true}).Create(&rows)
+					if result.Error != nil {
+						return result.Error
+					}
+				} else {
+					err := replayCommit(tx, shard_, rows)
+					if err != nil {
+						return err
+					}
 				}
-				err := os.WriteFile(fmt.Sprintf("/data/%s_index.log", shard_), []byte(fmt.Sprintf("%v", *idx+1)), 0777)
+				err := saveIndex(shard_, *idx+1)
 				if err != nil {
 					return err
 				}
@@ -81,17 +122,18 @@ func executeFromLog(shard_ string) error {
 				return nil
 			})
 			if err != nil {
-				log.Fatalf("\nError performing write from log item: %v\n", err)
+				log.Printf("Error performing write from log item of shard %s:%v", shard_, err)
 				return err
 			}
+			indexInsert(shard_, rows)
 		}
 		if logItem.Operation == "u" {
 			err := db.Transaction(func(tx *gorm.DB) error {
 				result := tx.Table(shard_).Where("Stud_id = ?", logItem.UD_Stud_id).Updates(&logItem.U_Data)
 				if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
-					return err
+					return result.Error
 				}
-				err := os.WriteFile(fmt.Sprintf("/data/%s_index.log", shard_), []byte(fmt.Sprintf("%v", *idx+1)), 0777)
+				err := saveIndex(shard_, *idx+1)
 				if err != nil {
 					return err
 				}
@@ -99,17 +141,21 @@ func executeFromLog(shard_ string) error {
 				return nil
 			})
 			if err != nil {
-				log.Fatalf("\nError performing update from log item: %v\n", err)
+				log.Printf("Error performing update from log item of shard %s:%v", shard_, err)
 				return err
 			}
+			err = indexUpdate(shard_, logItem.UD_Stud_id)
+			if err != nil {
+				log.Printf("Error updating secondary indexes for shard %s:%v", shard_, err)
+			}
 		}
 		if logItem.Operation == "d" {
 			err := db.Transaction(func(tx *gorm.DB) error {
 				result := tx.Table(shard_).Where("Stud_id = ?", logItem.UD_Stud_id).Delete(&StudT{})
 				if result.Error != nil {
-					return err
+					return result.Error
 				}
-				err := os.WriteFile(fmt.Sprintf("/data/%s_index.log", shard_), []byte(fmt.Sprintf("%v", *idx+1)), 0777)
+				err := saveIndex(shard_, *idx+1)
 				if err != nil {
 					return err
 				}
@@ -117,9 +163,19 @@ func executeFromLog(shard_ string) error {
 				return nil
 			})
 			if err != nil {
-				log.Fatalf("\nError performing delete from log item: %v\n", err)
+				log.Printf("Error performing delete from log item of shard %s:%v", shard_, err)
+				return err
+			}
+			indexDelete(shard_, logItem.UD_Stud_id)
+		}
+		// prepare, abort and the no-op a raft leader starts its term with do not touch the table
+		if logItem.Operation == "p" || logItem.Operation == "a" || logItem.Operation == "n" {
+			err := saveIndex(shard_, *idx+1)
+			if err != nil {
+				log.Printf("Error performing %s from log item of shard %s:%v", logItem.Operation, shard_, err)
 				return err
 			}
+			*idx = *idx + 1
 		}
 	}
 	return nil
@@ -150,20 +206,8 @@ func configHandler(c *gin.Context) {
 	}
 	var message = ""
 	for _, shard_ := range payload.Shards {
-		// create a new table for each shard
-		err := db.Table(shard_).AutoMigrate(&StudT{})
-		g_shard_log_map[shard_] = new(LogT)
-		g_shard_log_map[shard_].file, err = os.OpenFile(fmt.Sprintf("/data/%s.log", shard_), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
-		g_shard_log_map[shard_].data = []byte{}
-		g_shard_log_map[shard_].index = new(int)
-		if err != nil {
-			log.Printf("Error opening log file for shard %s:%v", shard_, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		g_shard_log_map[shard_].indexFile, err = os.OpenFile(fmt.Sprintf("/data/%s_index.log", shard_), os.O_RDWR|os.O_CREATE, 0777)
+		err := configureShard(shard_)
 		if err != nil {
-			log.Printf("Error opening index file for shard %s:%v", shard_, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -175,7 +219,8 @@ func configHandler(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		if err == nil {
+		// a raft replica gets its entries from the leader instead
+		if err == nil && payload.Modes[shard_] != "raft" {
 			var primaryServer string
 			for _, mapT := range mapTs {
 				if mapT.Primary {
@@ -185,125 +230,70 @@ func configHandler(c *gin.Context) {
 			}
 
 			if primaryServer != "" {
-				// get data from primary server
-				readEndpoint := fmt.Sprintf("http://%s:5000/copy", primaryServer)
-				jsonBody, _ := json.Marshal(copyPayload{Shard: shard_})
-				get, err := http.NewRequest(http.MethodGet, readEndpoint, bytes.NewReader(jsonBody))
-				if err != nil {
-					log.Printf("Error making request for getting data from primary server for shard %s:%v", shard_, err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				res, err := http.DefaultClient.Do(get)
-				if err != nil {
-					log.Printf("Error getting data from primary server for shard %s:%v", shard_, err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				// write data to the shard
-				var response struct {
-					Data []StudT
-					Logs []logPayload
-				}
-				err = json.NewDecoder(res.Body).Decode(&response)
-				if err != nil {
-					log.Printf("Error decoding data from primary server for shard %s:%v", shard_, err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				err = db.Table(shard_).Create(&response.Data).Error
-				if err != nil {
-					log.Printf("Error writing data to shard %s:%v", shard_, err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				// write log file to the shard
-				for _, logItem := range response.Logs {
-					err := writeToLog(logItem, shard_)
-					if err != nil {
-						log.Printf("Error writing to log for shard %s:%v", shard_, err)
-						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-						return
-					}
-				}
-				commitsDoneTill := res.Header.Get("Commit-Index")
-				*g_shard_log_map[shard_].index, err = strconv.Atoi(commitsDoneTill)
-				if err != nil {
-					log.Printf("Error converting commit index to int for shard %s:%v", shard_, err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-				err = os.WriteFile(fmt.Sprintf("/data/%s_index.log", shard_), []byte(commitsDoneTill), 0777)
+				err = catchUp(c.Request.Context(), shard_, primaryServer)
 				if err != nil {
-					log.Printf("Error writing commit index to file for shard %s:%v", shard_, err)
-					return
-				}
-				err = executeFromLog(shard_)
-				if err != nil {
-					log.Printf("Error executing from log for shard %s:%v", shard_, err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					log.Printf("Error catching up shard %s from %s:%v", shard_, primaryServer, err)
+					c.JSON(retryStatus(err), gin.H{"error": err.Error()})
 					return
 				}
 			}
 		}
+		if payload.Modes[shard_] == "raft" && raftOf(shard_) == nil {
+			err = startRaft(shard_)
+			if err != nil {
+				log.Printf("Error starting raft for shard %s:%v", shard_, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
 		message += fmt.Sprintf("%s:%s, ", name, shard_)
 	}
-	message = message[:len(message)-2]
+	if message != "" {
+		message = message[:len(message)-2] + " "
+	}
 	message += "configured"
 	configDone = true
 	c.JSON(http.StatusOK, gin.H{"message": message, "status": "success"})
 }
 
-// copy sends the logs as well as the data to the secondary servers
-// change copy to handle single shard instead of shard array as we are not using that functionality
-
-func copyHandler(c *gin.Context) {
-	if !configDone {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
-		return
+// configureShard creates the table and an empty log for a shard. A shard recovered from
+// /data at startup keeps its log and only catches up. indexLock is held.
+func configureShard(shard_ string) error {
+	if _, ok := g_shard_log_map[shard_]; ok {
+		return nil
 	}
-	var payload copyPayload
-	jsonData := getJSONstring(c)
-	err := json.Unmarshal([]byte(jsonData), &payload)
+	// create a new table for each shard
+	err := db.Table(shard_).AutoMigrate(&StudT{})
 	if err != nil {
-		log.Printf("Error decoding JSON: %v", err)
-		return
-	}
-	// get the shard from the request
-	shard_ := payload.Shard
-	if g_shard_log_map[shard_] == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
-		return
+		log.Printf("Error creating table for shard %s:%v", shard_, err)
+		return err
 	}
-	// get all the records from the shard
-	var studs []StudT
-	indexLock.Lock()
-	defer indexLock.Unlock()
-	err = db.Table(shard_).Find(&studs).Error
+	logT, err := openLog(shard_)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		log.Printf("Error opening log for shard %s:%v", shard_, err)
+		return err
 	}
-	logData := g_shard_log_map[shard_].data
-	//split the logData by \n
-	logItems := strings.Split(string(logData), "\n")
-	if logItems[len(logItems)-1] == "" {
-		logItems = logItems[:len(logItems)-1]
+	g_shard_log_map[shard_] = logT
+	err = loadIndexes(shard_)
+	if err != nil {
+		log.Printf("Error loading secondary indexes for shard %s:%v", shard_, err)
+		closeShardLog(shard_)
+		return err
 	}
-	var logs []logPayload
-	for _, logItem := range logItems {
-		var logItemStruct logPayload
-		err = json.Unmarshal([]byte(logItem), &logItemStruct)
-		if err != nil {
-			log.Printf("Error unmarshalling log item: %v\n", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		logs = append(logs, logItemStruct)
+	err = loadSequences(shard_)
+	if err != nil {
+		log.Printf("Error loading sequences for shard %s:%v", shard_, err)
+		closeShardLog(shard_)
+		return err
 	}
-	c.Header("Commit-Index", fmt.Sprintf("%v", *g_shard_log_map[shard_].index))
-	// send the response
-	c.JSON(http.StatusOK, gin.H{"Data": studs, "Logs": logs})
+	return nil
+}
+
+// closeShardLog forgets a shard that could not be set up and closes its log. indexLock is
+// held.
+func closeShardLog(shard_ string) {
+	g_shard_log_map[shard_].close()
+	delete(g_shard_log_map, shard_)
 }
 
 func readHandler(c *gin.Context) {
@@ -320,12 +310,20 @@ func readHandler(c *gin.Context) {
 	}
 	// get the shard from the request
 	shard_ := payload.Shard
+	countRequest(shard_)
+	if !checkReady(c, shard_) {
+		return
+	}
 	// get the student id from the request
 	low := payload.Stud_id["low"]
 	high := payload.Stud_id["high"]
-	// get all the records from the shard
+	// get the records from the shard in Stud_id order, at most limit of them if set
 	var studs []StudT
-	err = db.Table(shard_).Where("stud_id >= ? AND stud_id <= ?", low, high).Find(&studs).Error
+	query := db.Table(shard_).Where("stud_id >= ? AND stud_id <= ?", low, high).Order("stud_id")
+	if payload.Limit > 0 {
+		query = query.Limit(payload.Limit)
+	}
+	err = query.Find(&studs).Error
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -349,6 +347,18 @@ func writeHandler(c *gin.Context) {
 	}
 	// get the shard from the request
 	shard_ := payload.Shard
+	countRequest(shard_)
+	release := lockShardOrder(shard_)
+	defer release()
+	if !checkReady(c, shard_) {
+		return
+	}
+	if !checkTerm(c, shard_) {
+		return
+	}
+	if !checkLeader(c, shard_) {
+		return
+	}
 	// get the data from the request
 	data := payload.Data
 
@@ -357,84 +367,86 @@ func writeHandler(c *gin.Context) {
 	logItem.Operation = "w"
 	logItem.W_Data = data
 	indexLock.Lock()
-	//get number of entries in log
-	logItems := strings.Split(string(g_shard_log_map[shard_].data), "\n")
-	if logItems[len(logItems)-1] == "" {
-		logItems = logItems[:len(logItems)-1]
+	seq, index, old, err := sequenceFor(c, shard_)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		indexLock.Unlock()
+		return
+	}
+	if old {
+		log.Printf("Old Request %v for %s\n", seq, shard_)
+		indexLock.Unlock()
+		if !replicate(c, shard_, http.MethodPost, "/write", jsonData, sequenced(seq, nil)) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Data entries added", "replayed": true, "index": index, "status": "success"})
+		return
 	}
-	//get Request-Count from header
-	parseInt, err := strconv.Atoi(c.GetHeader("Request-Count"))
+	// apply earlier entries so the duplicate check sees every row written before this one
+	err = executeFromLog(shard_)
 	if err != nil {
-		log.Printf("Error converting Request-Count to int:%v", err)
+		log.Printf("Error executing from log for shard %s:%v", shard_, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		indexLock.Unlock()
 		return
 	}
-	if parseInt == len(logItems) {
-		log.Printf("Old Request %v for %s\n", parseInt, shard_)
-		c.JSON(http.StatusOK, gin.H{"message": "Data entries added", "status": "success"})
+	inserted, duplicates, err := splitDuplicates(shard_, data)
+	if err != nil {
+		log.Printf("Error checking duplicates for shard %s:%v", shard_, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		indexLock.Unlock()
 		return
 	}
+	if refuseHeld(c, shard_, inserted) {
+		indexLock.Unlock()
+		return
+	}
+	logItem.Seq = seq
+	logItem.Request_id = c.GetHeader("Request-Id")
 	err = writeToLog(logItem, shard_)
+	logT := g_shard_log_map[shard_]
 	indexLock.Unlock()
 	if err != nil {
 		log.Printf("Error writing to log for shard %s:%v", shard_, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	// check if server is primary
-	var mapTs []MapT
-	err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Find(&mapTs).Error
-	if err != nil {
-		log.Printf("Error getting primary server for shard %s:%v", shard_, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	pending := startReplication(c, shard_, http.MethodPost, "/write", jsonData, sequenced(seq, nil))
+	index, ok := commitLogged(c, logT, pending, release)
+	if !ok {
 		return
 	}
-	var shard_server_map = make(map[string]map[string]bool)
-	for _, mapT := range mapTs {
-		if _, ok := shard_server_map[mapT.Shard_id]; !ok {
-			shard_server_map[mapT.Shard_id] = make(map[string]bool)
-		}
-		shard_server_map[mapT.Shard_id][mapT.Server_id] = mapT.Primary
-	}
-	if shard_server_map[shard_][os.Getenv("SERVER_ID")] {
-		// send write request to secondary servers
-		// get list of secondary servers
-		log.Printf("Forwarding to secondary servers for shard:%s\n", shard_)
-		// send write request to secondary servers
-		for _, mapT := range mapTs {
-			if shard_server_map[mapT.Shard_id][mapT.Server_id] {
-				continue
-			}
-			// send write request to secondary server
+	// send the response
+	c.JSON(http.StatusOK, gin.H{"message": "Data entries added", "inserted": inserted, "duplicates": duplicates, "index": index, "status": "success"})
+}
 
-			fmt.Printf("\nForwarding to %s\n", mapT.Server_id)
-			writeEndpoint := fmt.Sprintf("http://%s:5000/write", mapT.Server_id)
-			request, err := http.NewRequest(http.MethodPost, writeEndpoint, bytes.NewReader([]byte(jsonData)))
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error creating write request", "status": "failure"})
-				return
-			}
-			request.Header.Set("Content-Type", "application/json")
-			request.Header.Set("Request-Count", c.GetHeader("Request-Count"))
-			res, err := http.DefaultClient.Do(request)
-			for err != nil || res.StatusCode != http.StatusOK {
-				res, err = http.DefaultClient.Do(request)
-			}
-		}
+// splitDuplicates separates the ids of a batch that will be inserted from those that already
+// exist in the shard or repeat earlier in the batch and are skipped
+func splitDuplicates(shard_ string, data []StudT) ([]int, []int, error) {
+	ids := make([]int, 0)
+	for _, row := range data {
+		ids = append(ids, row.Stud_id)
 	}
-	indexLock.Lock()
-	defer indexLock.Unlock()
-	err = executeFromLog(shard_)
+	var existing []int
+	err := db.Table(shard_).Where("stud_id IN ?", ids).Pluck("stud_id", &existing).Error
 	if err != nil {
-		log.Printf("Error executing from log for shard %s:%v", shard_, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, nil, err
+	}
+	seen := make(map[int]bool)
+	for _, id := range existing {
+		seen[id] = true
+	}
+	inserted := make([]int, 0)
+	duplicates := make([]int, 0)
+	for _, id := range ids {
+		if seen[id] {
+			duplicates = append(duplicates, id)
+			continue
+		}
+		seen[id] = true
+		inserted = append(inserted, id)
 	}
-	// send the response
-	c.JSON(http.StatusOK, gin.H{"message": "Data entries added", "status": "success"})
+	return inserted, duplicates, nil
 }
 
 func updateHandler(c *gin.Context) {
@@ -451,6 +463,18 @@ func updateHandler(c *gin.Context) {
 	}
 	// get the shard from the request
 	shard_ := payload.Shard
+	countRequest(shard_)
+	release := lockShardOrder(shard_)
+	defer release()
+	if !checkReady(c, shard_) {
+		return
+	}
+	if !checkTerm(c, shard_) {
+		return
+	}
+	if !checkLeader(c, shard_) {
+		return
+	}
 	// get the student id from the request
 	Stud_id := payload.Stud_id
 	// get the data from the request
@@ -462,83 +486,102 @@ func updateHandler(c *gin.Context) {
 	logItem.UD_Stud_id = Stud_id
 	logItem.U_Data = data
 	indexLock.Lock()
-	//get number of entries in log
-	logItems := strings.Split(string(g_shard_log_map[shard_].data), "\n")
-	if logItems[len(logItems)-1] == "" {
-		logItems = logItems[:len(logItems)-1]
-	}
-	//get Request-Count from header
-	parseInt, err := strconv.Atoi(c.GetHeader("Request-Count"))
+	seq, index, old, err := sequenceFor(c, shard_)
 	if err != nil {
-		log.Printf("Error converting Request-Count to int:%v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		indexLock.Unlock()
 		return
 	}
-	if parseInt == len(logItems) {
-		log.Printf("Old Request %v for %s\n", parseInt, shard_)
-		c.JSON(http.StatusOK, gin.H{"message": "Data entries added", "status": "success"})
+	if old {
+		log.Printf("Old Request %v for %s\n", seq, shard_)
+		// the sequence state keeps the version the primary gave the row, also for entries
+		// compacted into a checkpoint
+		entry, known := sequencesOf(shard_).recent[seq]
+		indexLock.Unlock()
+		// a request below the dedupe window was applied everywhere long ago
+		if known && !replicate(c, shard_, http.MethodPut, "/update", jsonData, sequenced(seq, map[string]string{"Row-Version": strconv.Itoa(entry.version - 1)})) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Data entries added", "index": index, "status": "success"})
+		return
+	}
+	if refuseHeld(c, shard_, []int{Stud_id}) {
 		indexLock.Unlock()
 		return
 	}
+	version, ok := resolveVersion(c, shard_, Stud_id)
+	if !ok {
+		indexLock.Unlock()
+		return
+	}
+	logItem.U_Data.Version = version + 1
+	logItem.Seq = seq
+	logItem.Request_id = c.GetHeader("Request-Id")
 	err = writeToLog(logItem, shard_)
+	logT := g_shard_log_map[shard_]
 	indexLock.Unlock()
 	if err != nil {
 		log.Printf("Error writing to log for shard %s:%v", shard_, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	// check if server is primary
-	var mapTs []MapT
-	err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Find(&mapTs).Error
-	if err != nil {
-		log.Printf("Error getting primary server for shard %s:%v", shard_, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	pending := startReplication(c, shard_, http.MethodPut, "/update", jsonData, sequenced(seq, map[string]string{"Row-Version": strconv.Itoa(version)}))
+	index, ok = commitLogged(c, logT, pending, release)
+	if !ok {
 		return
 	}
-	var shard_server_map = make(map[string]map[string]bool)
-	for _, mapT := range mapTs {
-		if _, ok := shard_server_map[mapT.Shard_id]; !ok {
-			shard_server_map[mapT.Shard_id] = make(map[string]bool)
-		}
-		shard_server_map[mapT.Shard_id][mapT.Server_id] = mapT.Primary
-	}
-	if shard_server_map[shard_][os.Getenv("SERVER_ID")] {
-		// send write request to secondary servers
-		// get list of secondary servers
-		log.Printf("Forwarding to secondary servers for shard:%s\n", shard_)
-		// send write request to secondary servers
-		for _, mapT := range mapTs {
-			if shard_server_map[mapT.Shard_id][mapT.Server_id] {
-				continue
-			}
-			// send update request to secondary server
-			fmt.Printf("\nForwarding to %s\n", mapT.Server_id)
-			updateEndpoint := fmt.Sprintf("http://%s:5000/update", mapT.Server_id)
-			request, err := http.NewRequest(http.MethodPut, updateEndpoint, bytes.NewReader([]byte(jsonData)))
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error creating put request", "status": "failure"})
-				return
-			}
-			request.Header.Set("Content-Type", "application/json")
-			request.Header.Set("Request-Count", c.GetHeader("Request-Count"))
-			do, err := http.DefaultClient.Do(request)
-			for err != nil || do.StatusCode != http.StatusOK {
-				do, err = http.DefaultClient.Do(request)
-			}
+	// send the response
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Data entry for Stud_id:%d updated", Stud_id), "version": version + 1, "index": index, "status": "success"})
+}
+
+// resolveVersion returns the version of the row before an update or delete. A secondary
+// takes the version its primary forwarded; the primary answers 409 when If-Match does not
+// match the current row.
+func resolveVersion(c *gin.Context, shard_ string, Stud_id int) (int, bool) {
+	if forwarded := c.GetHeader("Row-Version"); forwarded != "" {
+		version, err := strconv.Atoi(forwarded)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Row-Version"})
+			return 0, false
 		}
+		return version, true
 	}
-	indexLock.Lock()
-	defer indexLock.Unlock()
-	err = executeFromLog(shard_)
+	// apply earlier entries so the check sees the latest version
+	err := executeFromLog(shard_)
 	if err != nil {
 		log.Printf("Error executing from log for shard %s:%v", shard_, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return 0, false
 	}
-	// send the response
-	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Data entry for Stud_id:%d updated", Stud_id), "status": "success"})
+	var row StudT
+	err = db.Table(shard_).Where("stud_id = ?", Stud_id).First(&row).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if !checkIfMatch(c, Stud_id, err == nil, row.Version) {
+		return 0, false
+	}
+	return row.Version, true
+}
+
+// checkIfMatch answers 400 or 409 unless If-Match is absent or names the current version of
+// a row that exists
+func checkIfMatch(c *gin.Context, Stud_id int, found bool, version int) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	expected, err := strconv.Atoi(strings.Trim(ifMatch, `"`))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match"})
+		return false
+	}
+	if !found || expected != version {
+		c.JSON(http.StatusConflict, gin.H{"message": fmt.Sprintf("Version mismatch for Stud_id:%d", Stud_id), "version": version, "status": "failure"})
+		return false
+	}
+	return true
 }
 
 type delPayload struct {
@@ -560,6 +603,18 @@ func delHandler(c *gin.Context) {
 	}
 	// get the shard from the request
 	shard_ := payload.Shard
+	countRequest(shard_)
+	release := lockShardOrder(shard_)
+	defer release()
+	if !checkReady(c, shard_) {
+		return
+	}
+	if !checkTerm(c, shard_) {
+		return
+	}
+	if !checkLeader(c, shard_) {
+		return
+	}
 	// get the student id from the request
 	Stud_id := payload.Stud_id
 
@@ -568,83 +623,48 @@ func delHandler(c *gin.Context) {
 	logItem.Operation = "d"
 	logItem.UD_Stud_id = Stud_id
 	indexLock.Lock()
-	//get number of entries in log
-	logItems := strings.Split(string(g_shard_log_map[shard_].data), "\n")
-	if logItems[len(logItems)-1] == "" {
-		logItems = logItems[:len(logItems)-1]
-	}
-	//get Request-Count from header
-	parseInt, err := strconv.Atoi(c.GetHeader("Request-Count"))
+	seq, index, old, err := sequenceFor(c, shard_)
 	if err != nil {
-		log.Printf("Error converting Request-Count to int:%v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		indexLock.Unlock()
 		return
 	}
-	if parseInt == len(logItems) {
-		log.Printf("Old Request %v for %s\n", parseInt, shard_)
-		c.JSON(http.StatusOK, gin.H{"message": "Data entries added", "status": "success"})
+	if old {
+		log.Printf("Old Request %v for %s\n", seq, shard_)
 		indexLock.Unlock()
+		// secondaries only use Row-Version to skip the If-Match check of a delete
+		if !replicate(c, shard_, http.MethodDelete, "/del", jsonData, sequenced(seq, map[string]string{"Row-Version": "0"})) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Data entries added", "index": index, "status": "success"})
 		return
 	}
+	if refuseHeld(c, shard_, []int{Stud_id}) {
+		indexLock.Unlock()
+		return
+	}
+	version, ok := resolveVersion(c, shard_, Stud_id)
+	if !ok {
+		indexLock.Unlock()
+		return
+	}
+	logItem.Seq = seq
+	logItem.Request_id = c.GetHeader("Request-Id")
 	err = writeToLog(logItem, shard_)
+	logT := g_shard_log_map[shard_]
 	indexLock.Unlock()
 	if err != nil {
 		log.Printf("Error writing to log for shard %s:%v", shard_, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	// check if server is primary
-	var mapTs []MapT
-	err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Find(&mapTs).Error
-	if err != nil {
-		log.Printf("Error getting primary server for shard %s:%v", shard_, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	var shard_server_map = make(map[string]map[string]bool)
-	for _, mapT := range mapTs {
-		if _, ok := shard_server_map[mapT.Shard_id]; !ok {
-			shard_server_map[mapT.Shard_id] = make(map[string]bool)
-		}
-		shard_server_map[mapT.Shard_id][mapT.Server_id] = mapT.Primary
-	}
-	if shard_server_map[shard_][os.Getenv("SERVER_ID")] {
-		// send write request to secondary servers
-		// get list of secondary servers
-		log.Printf("Forwarding to secondary servers for shard:%s\n", shard_)
-		// send write request to secondary servers
-		for _, mapT := range mapTs {
-			if shard_server_map[mapT.Shard_id][mapT.Server_id] {
-				continue
-			}
-			fmt.Printf("\nForwarding to %s\n", mapT.Server_id)
-			delEndpoint := fmt.Sprintf("http://%s:5000/del", mapT.Server_id)
-
-			request, err := http.NewRequest(http.MethodDelete, delEndpoint, bytes.NewReader([]byte(jsonData)))
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error creating put request", "status": "failure"})
-				return
-			}
-			request.Header.Set("Content-Type", "application/json")
-			request.Header.Set("Request-Count", c.GetHeader("Request-Count"))
-			do, err := http.DefaultClient.Do(request)
-			for err != nil || do.StatusCode != http.StatusOK {
-				do, err = http.DefaultClient.Do(request)
-			}
-		}
-	}
-	indexLock.Lock()
-	defer indexLock.Unlock()
-	err = executeFromLog(shard_)
-	if err != nil {
-		log.Printf("Error executing from log for shard %s:%v", shard_, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	pending := startReplication(c, shard_, http.MethodDelete, "/del", jsonData, sequenced(seq, map[string]string{"Row-Version": strconv.Itoa(version)}))
+	index, ok = commitLogged(c, logT, pending, release)
+	if !ok {
 		return
 	}
 	// send the response
-	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Data entry with Stud_id:%d removed", Stud_id), "status": "success"})
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Data entry with Stud_id:%d removed", Stud_id), "index": index, "status": "success"})
 }
 
 func lenLogHandler(c *gin.Context) {
@@ -662,19 +682,14 @@ func lenLogHandler(c *gin.Context) {
 		return
 	}
 	// get logs for the shard
-	var logItems []string
 	indexLock.Lock()
 	defer indexLock.Unlock()
 	if _, ok := g_shard_log_map[payload.Shard]; !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
 		return
 	}
-	logItems = strings.Split(string(g_shard_log_map[payload.Shard].data), "\n")
-	if logItems[len(logItems)-1] == "" {
-		logItems = logItems[:len(logItems)-1]
-	}
 	// send the response
-	c.JSON(http.StatusOK, gin.H{"Length": len(logItems), "status": "success"})
+	c.JSON(http.StatusOK, gin.H{"Length": g_shard_log_map[payload.Shard].lastIndex(), "status": "success"})
 }
 
 func main() {
@@ -682,25 +697,44 @@ func main() {
 
 	r.GET("/heartbeat", heartbeatHandler)
 	r.POST("/config", configHandler)
-	r.GET("/copy", copyHandler)
+	r.POST("/catchup", catchupHandler)
+	r.POST("/snapshot", snapshotHandler)
+	r.POST("/resync", resyncHandler)
 	r.POST("/read", readHandler)
-	r.POST("/write", writeHandler)
-	r.PUT("/update", updateHandler)
-	r.DELETE("/del", delHandler)
+	r.POST("/write", idempotent, writeHandler)
+	r.PUT("/update", idempotent, updateHandler)
+	r.DELETE("/del", idempotent, delHandler)
 	r.POST("/lenlog", lenLogHandler)
 	r.POST("/add", addHandler)
 	r.GET("/getall", getAllHandler)
+	r.GET("/stats", statsHandler)
+	r.GET("/applied", appliedHandler)
+	r.GET("/metrics", metricsHandler)
+	r.POST("/query", queryHandler)
+	r.POST("/aggregate", aggregateHandler)
+	r.POST("/index", indexHandler)
+	r.POST("/lookup", lookupHandler)
+	r.POST("/prepare", idempotent, prepareHandler)
+	r.POST("/commit", idempotent, commitHandler)
+	r.POST("/abort", idempotent, abortHandler)
+	r.POST("/term", termHandler)
+	r.POST("/raft/vote", raftVoteHandler)
+	r.POST("/raft/append", raftAppendHandler)
+	r.POST("/raft/snapshot", raftSnapshotHandler)
+	r.DELETE("/rmshard", rmShardHandler)
 
 	mapdb = initDB()
 
 	// Connect to the database
 	dsn := "root:abc@tcp(localhost)/"
-	database, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
-	for {
-		if err == nil {
-			break
-		}
+	var database *gorm.DB
+	err := startupRetry.do(context.Background(), func(ctx context.Context) error {
+		var err error
 		database, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
 	}
 	_ = database.Exec("CREATE DATABASE IF NOT EXISTS assign3")
 	dsn += "assign3?charset=utf8mb4&parseTime=True&loc=Local"
@@ -710,6 +744,10 @@ func main() {
 		return
 	}
 
+	recoverShards()
+	go expireIdempotencyKeys()
+	go checkpointLogs()
+
 	port := 5000
 	addr := fmt.Sprintf(":%d", port)
 
@@ -722,7 +760,12 @@ func main() {
 }
 func initDB() *gorm.DB {
 	dsn := "root:abc@tcp(map_db:3306)/map_db?charset=utf8mb4&parseTime=True&loc=Local"
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	var db *gorm.DB
+	err := startupRetry.do(context.Background(), func(ctx context.Context) error {
+		var err error
+		db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+		return err
+	})
 	if err != nil {
 		log.Fatalf("Error connecting to database: %v", err)
 	}
@@ -763,6 +806,7 @@ func addHandler(c *gin.Context) {
 	}
 	var payload struct {
 		Shard string
+		Mode  string
 	}
 	jsonData := getJSONstring(c)
 	err := json.Unmarshal([]byte(jsonData), &payload)
@@ -777,26 +821,14 @@ func addHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard not provided"})
 		return
 	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
 	if _, ok := g_shard_log_map[shard_]; ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard already exists"})
 		return
 	}
-	// create a new table for each shard
-	err = db.Table(shard_).AutoMigrate(&StudT{})
-	g_shard_log_map[shard_] = new(LogT)
-	g_shard_log_map[shard_].file, err = os.OpenFile(fmt.Sprintf("/data/%s.log", shard_), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
-	g_shard_log_map[shard_].data = []byte{}
-	g_shard_log_map[shard_].index = new(int)
-	if err != nil {
-		log.Printf("Error opening log file for shard %s:%v", shard_, err)
-		delete(g_shard_log_map, shard_)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	g_shard_log_map[shard_].indexFile, err = os.OpenFile(fmt.Sprintf("/data/%s_index.log", shard_), os.O_RDWR|os.O_CREATE, 0777)
+	err = configureShard(shard_)
 	if err != nil {
-		log.Printf("Error opening index file for shard %s:%v", shard_, err)
-		delete(g_shard_log_map, shard_)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -806,11 +838,20 @@ func addHandler(c *gin.Context) {
 	err = mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Find(&mapTs).Error
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		log.Printf("Error getting primary server for shard %s:%v", shard_, err)
-		delete(g_shard_log_map, shard_)
+		closeShardLog(shard_)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if err == nil {
+	if payload.Mode == "raft" {
+		// the leader sends the new replica its snapshot and entries
+		err = startRaft(shard_)
+		if err != nil {
+			log.Printf("Error starting raft for shard %s:%v", shard_, err)
+			closeShardLog(shard_)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	} else if err == nil {
 		var primaryServer string
 		for _, mapT := range mapTs {
 			if mapT.Primary {
@@ -820,76 +861,118 @@ func addHandler(c *gin.Context) {
 		}
 
 		if primaryServer != "" {
-			//copy data from primary
-			readEndpoint := fmt.Sprintf("http://%s:5000/copy", primaryServer)
-			jsonBody, _ := json.Marshal(copyPayload{Shard: shard_})
-			get, err := http.NewRequest(http.MethodGet, readEndpoint, bytes.NewReader(jsonBody))
+			err = catchUp(c.Request.Context(), shard_, primaryServer)
 			if err != nil {
-				log.Printf("Error making request for getting data from primary server for shard %s:%v", shard_, err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				delete(g_shard_log_map, shard_)
+				log.Printf("Error catching up shard %s from %s:%v", shard_, primaryServer, err)
+				closeShardLog(shard_)
+				c.JSON(retryStatus(err), gin.H{"error": err.Error()})
 				return
 			}
-			res, err := http.DefaultClient.Do(get)
-			if err != nil {
-				log.Printf("Error getting data from primary server for shard %s:%v", shard_, err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				delete(g_shard_log_map, shard_)
-				return
-			}
-			// write data to the shard
-			var response struct {
-				Data []StudT
-				Logs []logPayload
-			}
-			err = json.NewDecoder(res.Body).Decode(&response)
-			if err != nil {
-				log.Printf("Error decoding data from primary server for shard %s:%v", shard_, err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				delete(g_shard_log_map, shard_)
-				return
-			}
-			err = db.Table(shard_).Create(&response.Data).Error
-			if err != nil {
-				log.Printf("Error writing data to shard %s:%v", shard_, err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				delete(g_shard_log_map, shard_)
-				return
-			}
-			// write log file to the shard
-			for _, logItem := range response.Logs {
-				err := writeToLog(logItem, shard_)
-				if err != nil {
-					log.Printf("Error writing to log for shard %s:%v", shard_, err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					delete(g_shard_log_map, shard_)
-					return
-				}
-			}
-			commitsDoneTill := res.Header.Get("Commit-Index")
-			*g_shard_log_map[shard_].index, err = strconv.Atoi(commitsDoneTill)
-			if err != nil {
-				log.Printf("Error converting commit index to int for shard %s:%v", shard_, err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				delete(g_shard_log_map, shard_)
-				return
-			}
-			err = os.WriteFile(fmt.Sprintf("/data/%s_index.log", shard_), []byte(commitsDoneTill), 0777)
-			if err != nil {
-				log.Printf("Error writing commit index to file for shard %s:%v", shard_, err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				delete(g_shard_log_map, shard_)
-				return
-			}
-			err = executeFromLog(shard_)
-			if err != nil {
-				log.Printf("Error executing from log for shard %s:%v", shard_, err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				delete(g_shard_log_map, shard_)
-				return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Shard added", "status": "success"})
+}
+
+// countRequest records one client request served for the shard, used by the
+// shard manager to find overloaded servers
+func countRequest(shard_ string) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	g_shard_stats[shard_]++
+}
 
+func statsHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	response := gin.H{}
+	// counting scans each table, so it runs without holding up config and index work
+	indexLock.Lock()
+	shards := make([]string, 0, len(g_shard_log_map))
+	for shard_ := range g_shard_log_map {
+		shards = append(shards, shard_)
+	}
+	indexLock.Unlock()
+	for _, shard_ := range shards {
+		var rows int64
+		err := db.Table(shard_).Count(&rows).Error
+		if err != nil {
+			indexLock.Lock()
+			_, held := g_shard_log_map[shard_]
+			indexLock.Unlock()
+			// the shard was removed while it was being counted
+			if !held {
+				continue
 			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
+		statsLock.Lock()
+		requests := g_shard_stats[shard_]
+		statsLock.Unlock()
+		response[shard_] = shardStats{Requests: requests, Rows: int(rows)}
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Shard added", "status": "success"})
+	c.JSON(http.StatusOK, response)
+}
+
+// appliedHandler reports, per shard, how many log entries have been applied to the table
+func appliedHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	response := gin.H{}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	for shard_, logT := range g_shard_log_map {
+		response[shard_] = *logT.index
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// rmShardHandler drops a replica that the shard manager moved to another server
+func rmShardHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	var payload struct {
+		Shard string
+	}
+	jsonData := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonData), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shard_ := payload.Shard
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	if _, ok := g_shard_log_map[shard_]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return
+	}
+	stopRaft(shard_)
+	stopShipping(shard_)
+	g_shard_log_map[shard_].close()
+	delete(g_shard_log_map, shard_)
+	delete(g_prepared, shard_)
+	delete(g_txn_decided, shard_)
+	delete(g_indexes, shard_)
+	delete(g_sequences, shard_)
+	statsLock.Lock()
+	delete(g_shard_stats, shard_)
+	statsLock.Unlock()
+	err = db.Migrator().DropTable(shard_)
+	if err != nil {
+		log.Printf("Error dropping table for shard %s:%v", shard_, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	removeSegments(shard_)
+	_ = os.Remove(checkpointPath(shard_))
+	_ = os.Remove(indexPath(shard_))
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Shard %s removed", shard_), "status": "success"})
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// queryColumns maps the columns a query may name to their table columns. Only these reach
+// the SQL, everything else is rejected.
+var queryColumns = map[string]string{
+	"Stud_id":    "stud_id",
+	"Stud_name":  "stud_name",
+	"Stud_marks": "stud_marks",
+	"Version":    "version",
+}
+
+var queryOps = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "prefix": true}
+
+func (row StudT) column(name string) interface{} {
+	switch name {
+	case "Stud_id":
+		return row.Stud_id
+	case "Stud_name":
+		return row.Stud_name
+	case "Stud_marks":
+		return row.Stud_marks
+	case "Version":
+		return row.Version
+	}
+	return nil
+}
+
+// applyWhere adds the predicates of a query to a statement
+func applyWhere(query *gorm.DB, where []predicate) (*gorm.DB, error) {
+	for _, pred := range where {
+		column, ok := queryColumns[pred.Column]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %s", pred.Column)
+		}
+		if !queryOps[pred.Op] {
+			return nil, fmt.Errorf("unknown operator %s", pred.Op)
+		}
+		if pred.Op == "prefix" {
+			prefix, ok := pred.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("prefix of %s must be a string", pred.Column)
+			}
+			escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+			query = query.Where(column+" LIKE ?", escaped+"%")
+			continue
+		}
+		query = query.Where(column+" "+pred.Op+" ?", pred.Value)
+	}
+	return query, nil
+}
+
+// buildQuery turns the predicates, sort and limit of a query into a statement on the shard
+// table
+func buildQuery(payload queryPayload) (*gorm.DB, error) {
+	query, err := applyWhere(db.Table(payload.Shard), payload.Where)
+	if err != nil {
+		return nil, err
+	}
+	var selected []string
+	for _, name := range payload.Select {
+		column, ok := queryColumns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %s", name)
+		}
+		selected = append(selected, column)
+	}
+	if len(selected) != 0 {
+		query = query.Select(selected)
+	}
+	if payload.Order_by != "" {
+		column, ok := queryColumns[payload.Order_by]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %s", payload.Order_by)
+		}
+		if payload.Desc {
+			column += " DESC"
+		}
+		query = query.Order(column)
+	}
+	// Stud_id breaks ties so every shard returns its rows in the order the balancer merges them
+	query = query.Order("stud_id")
+	if payload.Limit > 0 {
+		query = query.Limit(payload.Limit)
+	}
+	return query, nil
+}
+
+// queryHandler runs a filtered, projected and sorted query on one shard. Rows only carry
+// the selected columns, or all of them when none are selected.
+func queryHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	var payload queryPayload
+	jsonData := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonData), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON:%v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shard_ := payload.Shard
+	if _, ok := g_shard_log_map[shard_]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return
+	}
+	countRequest(shard_)
+	if !checkReady(c, shard_) {
+		return
+	}
+	query, err := buildQuery(payload)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var studs []StudT
+	err = query.Find(&studs).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	columns := payload.Select
+	if len(columns) == 0 {
+		columns = []string{"Stud_id", "Stud_name", "Stud_marks", "Version"}
+	}
+	rows := make([]map[string]interface{}, 0, len(studs))
+	for _, stud := range studs {
+		row := make(map[string]interface{})
+		for _, name := range columns {
+			row[name] = stud.column(name)
+		}
+		rows = append(rows, row)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": rows, "status": "success"})
+}
+
+// numericColumns are the columns sum, avg, min and max work on
+var numericColumns = map[string]bool{"Stud_id": true, "Stud_marks": true, "Version": true}
+
+// aggregateHandler computes the count and, for every requested column, the sum, min and max
+// of the matching rows of one shard per group. The balancer combines the partials of all
+// shards, so averages are left to it.
+func aggregateHandler(c *gin.Context) {
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return
+	}
+	var payload aggregatePayload
+	jsonData := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonData), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON:%v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shard_ := payload.Shard
+	if _, ok := g_shard_log_map[shard_]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return
+	}
+	countRequest(shard_)
+	if !checkReady(c, shard_) {
+		return
+	}
+	query, err := applyWhere(db.Table(shard_), payload.Where)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var selects, groups []string
+	for _, name := range payload.Group_by {
+		column, ok := queryColumns[name]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown column %s", name)})
+			return
+		}
+		selects = append(selects, column)
+		groups = append(groups, column)
+	}
+	selects = append(selects, "COUNT(*)")
+	for _, name := range payload.Columns {
+		column, ok := queryColumns[name]
+		if !ok || !numericColumns[name] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is not a numeric column", name)})
+			return
+		}
+		selects = append(selects, "SUM("+column+")", "MIN("+column+")", "MAX("+column+")")
+	}
+	query = query.Select(strings.Join(selects, ", "))
+	if len(groups) != 0 {
+		query = query.Group(strings.Join(groups, ", "))
+	}
+	rows, err := query.Rows()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	partials := []aggregatePartial{}
+	for rows.Next() {
+		keys := make([]interface{}, len(payload.Group_by))
+		dest := make([]interface{}, 0, len(selects))
+		for i, name := range payload.Group_by {
+			if numericColumns[name] {
+				keys[i] = new(int64)
+			} else {
+				keys[i] = new(string)
+			}
+			dest = append(dest, keys[i])
+		}
+		var count int64
+		dest = append(dest, &count)
+		values := make([]sql.NullFloat64, 3*len(payload.Columns))
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		partial := aggregatePartial{Key: make(map[string]interface{}), Count: count, Sum: make(map[string]float64), Min: make(map[string]float64), Max: make(map[string]float64)}
+		for i, name := range payload.Group_by {
+			switch key := keys[i].(type) {
+			case *int64:
+				partial.Key[name] = *key
+			case *string:
+				partial.Key[name] = *key
+			}
+		}
+		// an empty shard has one row of NULLs when nothing is grouped
+		for i, name := range payload.Columns {
+			if values[3*i].Valid {
+				partial.Sum[name] = values[3*i].Float64
+				partial.Min[name] = values[3*i+1].Float64
+				partial.Max[name] = values[3*i+2].Float64
+			}
+		}
+		partials = append(partials, partial)
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": partials, "status": "success"})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"reflect"
+	"testing"
+)
+
+// dryRun points db at a MySQL dialect that builds statements without a server behind it
+func dryRun(t *testing.T) {
+	t.Helper()
+	dry, err := gorm.Open(mysql.New(mysql.Config{DSN: "test@tcp(127.0.0.1:1)/test", SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = dry
+	t.Cleanup(func() { db = saved })
+}
+
+func TestBuildQuery(t *testing.T) {
+	dryRun(t)
+	tests := []struct {
+		name    string
+		payload queryPayload
+		sql     string
+		vars    []interface{}
+		err     bool
+	}{
+		{
+			name:    "whole shard",
+			payload: queryPayload{Shard: "sh1"},
+			sql:     "SELECT * FROM `sh1` ORDER BY stud_id",
+		},
+		{
+			name: "predicates",
+			payload: queryPayload{Shard: "sh1", Where: []predicate{
+				{Column: "Stud_marks", Op: ">=", Value: 50.0},
+				{Column: "Stud_name", Op: "!=", Value: "Bob"},
+			}},
+			sql:  "SELECT * FROM `sh1` WHERE stud_marks >= ? AND stud_name != ? ORDER BY stud_id",
+			vars: []interface{}{50.0, "Bob"},
+		},
+		{
+			name:    "prefix escapes wildcards",
+			payload: queryPayload{Shard: "sh1", Where: []predicate{{Column: "Stud_name", Op: "prefix", Value: `a_b%c\`}}},
+			sql:     "SELECT * FROM `sh1` WHERE stud_name LIKE ? ORDER BY stud_id",
+			vars:    []interface{}{`a\_b\%c\\%`},
+		},
+		{
+			name:    "projection, sort and limit",
+			payload: queryPayload{Shard: "sh1", Select: []string{"Stud_id", "Stud_marks"}, Order_by: "Stud_marks", Desc: true, Limit: 5},
+			sql:     "SELECT `stud_id`,`stud_marks` FROM `sh1` ORDER BY stud_marks DESC,stud_id LIMIT ?",
+			vars:    []interface{}{5},
+		},
+		{"unknown column", queryPayload{Shard: "sh1", Where: []predicate{{Column: "1=1; --", Op: "=", Value: 1.0}}}, "", nil, true},
+		{"unknown operator", queryPayload{Shard: "sh1", Where: []predicate{{Column: "Stud_id", Op: "OR", Value: 1.0}}}, "", nil, true},
+		{"prefix of a number", queryPayload{Shard: "sh1", Where: []predicate{{Column: "Stud_name", Op: "prefix", Value: 1.0}}}, "", nil, true},
+		{"unknown selected column", queryPayload{Shard: "sh1", Select: []string{"password"}}, "", nil, true},
+		{"unknown sort column", queryPayload{Shard: "sh1", Order_by: "stud_id desc"}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := buildQuery(tt.payload)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want one: %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			statement := query.Find(&[]StudT{}).Statement
+			if sql := statement.SQL.String(); sql != tt.sql {
+				t.Errorf("got %s, want %s", sql, tt.sql)
+			}
+			if len(statement.Vars) != 0 || len(tt.vars) != 0 {
+				if !reflect.DeepEqual(statement.Vars, tt.vars) {
+					t.Errorf("got vars %v, want %v", statement.Vars, tt.vars)
+				}
+			}
+		})
+	}
+}
+
+func TestRowColumn(t *testing.T) {
+	row := StudT{Stud_id: 3, Stud_name: "Ann", Stud_marks: 71, Version: 2}
+	tests := []struct {
+		name string
+		want interface{}
+	}{
+		{"Stud_id", 3},
+		{"Stud_name", "Ann"},
+		{"Stud_marks", 71},
+		{"Version", 2},
+		{"stud_id", nil},
+	}
+	for _, tt := range tests {
+		if got := row.column(tt.name); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,865 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	raftFollower  = "follower"
+	raftCandidate = "candidate"
+	raftLeader    = "leader"
+)
+
+var (
+	// how often a leader sends entries and heartbeats to its followers
+	raftHeartbeat = time.Duration(envInt("RAFT_HEARTBEAT_MS", 100)) * time.Millisecond
+	// how long a follower waits for its leader before standing for election, randomised up
+	// to twice as long so candidates rarely split the vote
+	raftElection = time.Duration(envInt("RAFT_ELECTION_MS", 1000)) * time.Millisecond
+	// how long a leader waits for a majority to log an entry before giving up on the request
+	raftCommitTimeout = time.Duration(envInt("RAFT_COMMIT_TIMEOUT_MS", 5000)) * time.Millisecond
+	// applied entries kept in the log before they are compacted into a snapshot
+	raftSnapshotEntries = envInt("RAFT_SNAPSHOT_ENTRIES", 1000)
+	// most entries sent to a follower in one append
+	raftBatch = envInt("RAFT_BATCH", 500)
+	// raft messages are not retried, the next heartbeat sends them again
+	raftCall = retryPolicy{attempts: 1, callTimeout: raftElection / 2}
+	// raft replicas per shard
+	g_rafts   = make(map[string]*raftNode)
+	raftsLock = &sync.RWMutex{}
+
+	errNotLeader = errors.New("not the leader")
+)
+
+// raftNode is this server's replica of a shard replicated with raft instead of by a primary
+// the shard manager elects. Entries go to the same log as in the primary mode and are applied
+// by executeFromLog once a majority logged them. Fields are guarded by mu, which is taken after
+// indexLock whenever both are held.
+type raftNode struct {
+	shard       string
+	mu          sync.Mutex
+	term        int
+	votedFor    string
+	role        string
+	leader      string
+	commitIndex int
+	lastContact time.Time
+	timeout     time.Duration
+	nextIndex   map[string]int
+	matchIndex  map[string]int
+	sending     map[string]bool
+	members     []string
+	membersAt   time.Time
+	// closed and replaced whenever commitIndex moves or the node steps down
+	commits chan struct{}
+	stop    chan struct{}
+}
+
+// raftState is what a replica persists before answering, so it never votes twice in a term
+type raftState struct {
+	Term      int
+	Voted_for string
+}
+
+func raftFile(shard_ string, name string) string {
+	return filepath.Join(dataDir, fmt.Sprintf("%s_%s.json", shard_, name))
+}
+
+// replaceFile writes data next to path, syncs it and renames it over path, so neither readers
+// nor a crash ever leave half of it
+func replaceFile(path string, data []byte) error {
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func electionTimeout() time.Duration {
+	return raftElection + time.Duration(rand.Int63n(int64(raftElection)))
+}
+
+func raftOf(shard_ string) *raftNode {
+	raftsLock.RLock()
+	defer raftsLock.RUnlock()
+	return g_rafts[shard_]
+}
+
+// startRaft runs a raft replica of the shard on this server over the log it holds, picking up
+// the term and vote from before. Applied entries count as committed. indexLock is held.
+func startRaft(shard_ string) error {
+	node := &raftNode{
+		shard:       shard_,
+		role:        raftFollower,
+		lastContact: time.Now(),
+		timeout:     electionTimeout(),
+		nextIndex:   make(map[string]int),
+		matchIndex:  make(map[string]int),
+		sending:     make(map[string]bool),
+		commits:     make(chan struct{}),
+		stop:        make(chan struct{}),
+		commitIndex: *g_shard_log_map[shard_].index,
+	}
+	data, err := os.ReadFile(raftFile(shard_, "raft"))
+	if err == nil {
+		var state raftState
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			return err
+		}
+		node.term = state.Term
+		node.votedFor = state.Voted_for
+		observeTerm(shard_, state.Term)
+	}
+	// a replica restarting before it ever voted is still known as a raft replica
+	node.persist()
+	raftsLock.Lock()
+	if old := g_rafts[shard_]; old != nil {
+		close(old.stop)
+	}
+	g_rafts[shard_] = node
+	raftsLock.Unlock()
+	go node.run()
+	return nil
+}
+
+// stopRaft stops the replica of a shard removed from this server
+func stopRaft(shard_ string) {
+	raftsLock.Lock()
+	node := g_rafts[shard_]
+	delete(g_rafts, shard_)
+	raftsLock.Unlock()
+	if node == nil {
+		return
+	}
+	close(node.stop)
+	_ = os.Remove(raftFile(shard_, "raft"))
+	_ = os.Remove(raftFile(shard_, "snapshot"))
+}
+
+func (node *raftNode) committed() int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.commitIndex
+}
+
+func (node *raftNode) currentTerm() int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.term
+}
+
+// signal wakes the requests waiting for a commit, mu is held
+func (node *raftNode) signal() {
+	close(node.commits)
+	node.commits = make(chan struct{})
+}
+
+// persist saves the term and vote, mu is held
+func (node *raftNode) persist() {
+	data, _ := json.Marshal(raftState{Term: node.term, Voted_for: node.votedFor})
+	err := replaceFile(raftFile(node.shard, "raft"), data)
+	if err != nil {
+		log.Printf("Error persisting raft state for shard %s:%v", node.shard, err)
+	}
+}
+
+// stepDown follows a term at least as new as the current one, mu is held
+func (node *raftNode) stepDown(term int) {
+	if term > node.term {
+		node.term = term
+		node.votedFor = ""
+		node.persist()
+		observeTerm(node.shard, term)
+	}
+	if node.role != raftFollower {
+		log.Printf("Shard %s: %s steps down in term %d", node.shard, node.role, node.term)
+		node.role = raftFollower
+		node.lastContact = time.Now()
+		node.signal()
+	}
+}
+
+// follow accepts a message from the leader of term and reports false when the term is stale,
+// mu is held
+func (node *raftNode) follow(term int, leader string) bool {
+	if term < node.term {
+		return false
+	}
+	node.stepDown(term)
+	node.leader = leader
+	node.lastContact = time.Now()
+	return true
+}
+
+// termAt is the term of the entry at index, -1 when it was compacted away or never logged.
+// indexLock is held.
+func (node *raftNode) termAt(logT *LogT, index int) int {
+	switch {
+	case index == 0:
+		return 0
+	case index == logT.base && logT.snapshot != nil:
+		return logT.snapshot.Term
+	case index <= logT.base || index > logT.lastIndex():
+		return -1
+	}
+	term, err := logT.termOf(index)
+	if err != nil {
+		return -1
+	}
+	return term
+}
+
+// lastLog is the index and term of the latest entry, indexLock is held
+func (node *raftNode) lastLog(logT *LogT) (int, int) {
+	last := logT.lastIndex()
+	return last, node.termAt(logT, last)
+}
+
+// membersOf lists the replicas the shard manager placed the shard on
+func (node *raftNode) membersOf() []string {
+	node.mu.Lock()
+	if time.Since(node.membersAt) < time.Second {
+		members := node.members
+		node.mu.Unlock()
+		return members
+	}
+	node.mu.Unlock()
+	var mapTs []MapT
+	err := mapdb.Model(&MapT{}).Where("shard_id = ?", node.shard).Find(&mapTs).Error
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if err != nil {
+		log.Printf("Error getting replicas of shard %s:%v", node.shard, err)
+		return node.members
+	}
+	node.members = nil
+	for _, mapT := range mapTs {
+		node.members = append(node.members, mapT.Server_id)
+	}
+	node.membersAt = time.Now()
+	return node.members
+}
+
+// call sends a raft message to another replica of the shard
+func (node *raftNode) call(member string, path string, body []byte, reply interface{}) bool {
+	_, answer, err := raftCall.send(context.Background(), http.MethodPost, fmt.Sprintf("http://%s:5000%s", member, path), body, nil, acceptOK)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(answer, reply) == nil
+}
+
+func (node *raftNode) run() {
+	ticker := time.NewTicker(raftHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-node.stop:
+			return
+		case <-ticker.C:
+		}
+		node.mu.Lock()
+		role := node.role
+		expired := time.Since(node.lastContact) > node.timeout
+		node.mu.Unlock()
+		if role == raftLeader {
+			node.broadcast()
+		} else if expired {
+			node.campaign()
+		}
+		node.apply()
+	}
+}
+
+// apply runs the committed entries against the table and compacts the log once enough of
+// them were applied
+func (node *raftNode) apply() {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	logT, ok := g_shard_log_map[node.shard]
+	if !ok || raftOf(node.shard) != node {
+		return
+	}
+	err := executeFromLog(node.shard)
+	if err != nil {
+		log.Printf("Error executing from log for shard %s:%v", node.shard, err)
+		return
+	}
+	if *logT.index-logT.base >= raftSnapshotEntries {
+		err = node.takeSnapshot(logT)
+		if err != nil {
+			log.Printf("Error taking snapshot of shard %s:%v", node.shard, err)
+		}
+	}
+}
+
+// campaign stands for election after the leader went quiet
+func (node *raftNode) campaign() {
+	self := os.Getenv("SERVER_ID")
+	members := node.membersOf()
+	placed := false
+	for _, member := range members {
+		placed = placed || member == self
+	}
+	if !placed {
+		return
+	}
+	indexLock.Lock()
+	logT, ok := g_shard_log_map[node.shard]
+	if !ok {
+		indexLock.Unlock()
+		return
+	}
+	lastIndex, lastTerm := node.lastLog(logT)
+	node.mu.Lock()
+	node.term++
+	node.role = raftCandidate
+	node.votedFor = self
+	node.leader = ""
+	node.lastContact = time.Now()
+	node.timeout = electionTimeout()
+	node.persist()
+	term := node.term
+	node.mu.Unlock()
+	indexLock.Unlock()
+	log.Printf("Shard %s: standing for election in term %d", node.shard, term)
+
+	request, _ := json.Marshal(raftVoteRequest{Shard: node.shard, Term: term, Candidate: self, Last_index: lastIndex, Last_term: lastTerm})
+	votes := 1
+	votesLock := &sync.Mutex{}
+	var wg sync.WaitGroup
+	for _, member := range members {
+		if member == self {
+			continue
+		}
+		wg.Add(1)
+		go func(member string) {
+			defer wg.Done()
+			var reply raftVoteReply
+			if !node.call(member, "/raft/vote", request, &reply) {
+				return
+			}
+			node.mu.Lock()
+			if reply.Term > node.term {
+				node.stepDown(reply.Term)
+			}
+			node.mu.Unlock()
+			if reply.Granted {
+				votesLock.Lock()
+				votes++
+				votesLock.Unlock()
+			}
+		}(member)
+	}
+	wg.Wait()
+	if votes*2 > len(members) {
+		node.lead(term)
+	}
+}
+
+// lead takes over the shard after winning the election of term. The no-op it logs commits the
+// entries of earlier terms along with it.
+func (node *raftNode) lead(term int) {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	if _, ok := g_shard_log_map[node.shard]; !ok {
+		return
+	}
+	node.mu.Lock()
+	if node.role != raftCandidate || node.term != term {
+		node.mu.Unlock()
+		return
+	}
+	node.role = raftLeader
+	node.leader = os.Getenv("SERVER_ID")
+	node.nextIndex = make(map[string]int)
+	node.matchIndex = make(map[string]int)
+	node.mu.Unlock()
+	log.Printf("Shard %s: leading in term %d", node.shard, term)
+	observeTerm(node.shard, term)
+	err := writeToLog(logPayload{Operation: "n", Raft_term: term}, node.shard)
+	if err != nil {
+		log.Printf("Error writing to log for shard %s:%v", node.shard, err)
+	}
+	go node.announce(term)
+}
+
+// announce tells the shard manager which replica leads the shard, so the balancers route
+// writes to it
+func (node *raftNode) announce(term int) {
+	body, _ := json.Marshal(gin.H{"shard": node.shard, "server": os.Getenv("SERVER_ID"), "term": term})
+	_, _, err := defaultRetry.send(context.Background(), http.MethodPost, "http://shard_manager:5000/leader", body, nil, acceptOK)
+	if err != nil {
+		log.Printf("Error announcing leader of shard %s in term %d:%v", node.shard, term, err)
+	}
+}
+
+// broadcast sends every follower the entries it is missing, skipping those still answering
+// the previous round
+func (node *raftNode) broadcast() {
+	self := os.Getenv("SERVER_ID")
+	members := node.membersOf()
+	for _, member := range members {
+		if member == self {
+			continue
+		}
+		node.mu.Lock()
+		busy := node.sending[member]
+		node.sending[member] = true
+		node.mu.Unlock()
+		if !busy {
+			go node.replicateTo(member)
+		}
+	}
+	// a shard without followers commits on its own
+	node.advance(members)
+}
+
+// replicateTo sends a follower the entries after the ones it has, or the snapshot when they
+// were compacted away
+func (node *raftNode) replicateTo(member string) {
+	defer func() {
+		node.mu.Lock()
+		node.sending[member] = false
+		node.mu.Unlock()
+	}()
+	self := os.Getenv("SERVER_ID")
+	indexLock.Lock()
+	logT, ok := g_shard_log_map[node.shard]
+	if !ok {
+		indexLock.Unlock()
+		return
+	}
+	node.mu.Lock()
+	if node.role != raftLeader {
+		node.mu.Unlock()
+		indexLock.Unlock()
+		return
+	}
+	term := node.term
+	next, ok := node.nextIndex[member]
+	if !ok {
+		next = logT.lastIndex() + 1
+	}
+	var path string
+	var body []byte
+	var match int
+	if next <= logT.base {
+		path = "/raft/snapshot"
+		var snapshot shardSnapshot
+		data, err := os.ReadFile(raftFile(node.shard, "snapshot"))
+		if err == nil {
+			err = json.Unmarshal(data, &snapshot)
+		}
+		if err != nil {
+			node.mu.Unlock()
+			indexLock.Unlock()
+			log.Printf("Error reading snapshot of shard %s:%v", node.shard, err)
+			return
+		}
+		body, _ = json.Marshal(raftSnapshotRequest{Shard: node.shard, Term: term, Leader: self, Snapshot: snapshot})
+		match = snapshot.Index
+	} else {
+		path = "/raft/append"
+		prev := next - 1
+		end := logT.lastIndex()
+		if end > prev+raftBatch {
+			end = prev + raftBatch
+		}
+		var batch []logPayload
+		_ = logT.each(prev+1, end, func(_ int, record []byte) error {
+			var logItem logPayload
+			_ = json.Unmarshal(record, &logItem)
+			batch = append(batch, logItem)
+			return nil
+		})
+		body, _ = json.Marshal(raftAppendRequest{
+			Shard:         node.shard,
+			Term:          term,
+			Leader:        self,
+			Prev_index:    prev,
+			Prev_term:     node.termAt(logT, prev),
+			Entries:       batch,
+			Leader_commit: node.commitIndex,
+		})
+		match = prev + len(batch)
+	}
+	node.mu.Unlock()
+	indexLock.Unlock()
+
+	var reply raftAppendReply
+	if !node.call(member, path, body, &reply) {
+		return
+	}
+	node.mu.Lock()
+	if reply.Term > node.term {
+		node.stepDown(reply.Term)
+	}
+	if node.role != raftLeader || node.term != term {
+		node.mu.Unlock()
+		return
+	}
+	if reply.Success {
+		if match > node.matchIndex[member] {
+			node.matchIndex[member] = match
+		}
+		node.nextIndex[member] = match + 1
+	} else {
+		// skip straight back to the end of a short follower log
+		next--
+		if reply.Last_index+1 < next {
+			next = reply.Last_index + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		node.nextIndex[member] = next
+	}
+	node.mu.Unlock()
+	if reply.Success {
+		node.advance(node.membersOf())
+	}
+}
+
+// advance commits the entries of the current term a majority of the members logged, earlier
+// entries are committed along with them
+func (node *raftNode) advance(members []string) {
+	self := os.Getenv("SERVER_ID")
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	logT, ok := g_shard_log_map[node.shard]
+	if !ok {
+		return
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.role != raftLeader {
+		return
+	}
+	for index := logT.lastIndex(); index > node.commitIndex; index-- {
+		if node.termAt(logT, index) != node.term {
+			return
+		}
+		count := 0
+		for _, member := range members {
+			if member == self || node.matchIndex[member] >= index {
+				count++
+			}
+		}
+		if count*2 > len(members) {
+			node.commitIndex = index
+			node.signal()
+			return
+		}
+	}
+}
+
+// awaitCommit waits until a majority logged the entries of this leader up to index
+func (node *raftNode) awaitCommit(ctx context.Context, index int) error {
+	node.broadcast()
+	timeout := time.NewTimer(raftCommitTimeout)
+	defer timeout.Stop()
+	for {
+		node.mu.Lock()
+		if node.role != raftLeader {
+			node.mu.Unlock()
+			return errNotLeader
+		}
+		if node.commitIndex >= index {
+			node.mu.Unlock()
+			return nil
+		}
+		commits := node.commits
+		node.mu.Unlock()
+		select {
+		case <-commits:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("entry %d of shard %s not committed: %w", index, node.shard, context.DeadlineExceeded)
+		}
+	}
+}
+
+// checkLeader refuses requests sent to a raft replica that is not leading its shard, naming
+// the leader it follows. Shards replicated by a primary are let through.
+func checkLeader(c *gin.Context, shard_ string) bool {
+	node := raftOf(shard_)
+	if node == nil {
+		return true
+	}
+	node.mu.Lock()
+	role, leader := node.role, node.leader
+	node.mu.Unlock()
+	if role == raftLeader {
+		return true
+	}
+	c.JSON(http.StatusMisdirectedRequest, gin.H{"error": "not the leader", "leader": leader})
+	return false
+}
+
+// truncateLog drops the entries after keep, which the leader that logged them never
+// committed. indexLock is held.
+func truncateLog(shard_ string, keep int) error {
+	logT := g_shard_log_map[shard_]
+	if keep < *logT.index {
+		return fmt.Errorf("entry %d of shard %s was applied already", keep+1, shard_)
+	}
+	err := logT.truncateAfter(keep)
+	if err != nil {
+		return err
+	}
+	err = loadSequences(shard_)
+	if err != nil {
+		return err
+	}
+	return loadTxns(shard_)
+}
+
+// saveSnapshot stores a snapshot and keeps it without its rows, indexLock is held
+func (node *raftNode) saveSnapshot(logT *LogT, snapshot shardSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	err = replaceFile(raftFile(node.shard, "snapshot"), data)
+	if err != nil {
+		return err
+	}
+	snapshot.Rows = nil
+	logT.snapshot = &snapshot
+	return nil
+}
+
+// takeSnapshot compacts the applied entries of the log into a snapshot of the table. The
+// transaction and sequence state of the snapshot is replayed up to the applied entry, the
+// in-memory state already covers the entries logged after it. indexLock is held.
+func (node *raftNode) takeSnapshot(logT *LogT) error {
+	index := *logT.index
+	snapshot, err := checkpointState(logT, index)
+	if err != nil {
+		return err
+	}
+	err = db.Table(node.shard).Find(&snapshot.Rows).Error
+	if err != nil {
+		return err
+	}
+	err = node.saveSnapshot(logT, snapshot)
+	if err != nil {
+		return err
+	}
+	err = logT.compact(index)
+	if err != nil {
+		return err
+	}
+	log.Printf("Shard %s: compacted the log up to entry %d", node.shard, index)
+	return nil
+}
+
+// install replaces the table and log of a follower that fell behind the start of the
+// leader's log with the leader's snapshot. indexLock is held.
+func (node *raftNode) install(logT *LogT, snapshot shardSnapshot) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Table(node.shard).Where("1 = 1").Delete(&StudT{}).Error
+		if err != nil {
+			return err
+		}
+		if len(snapshot.Rows) == 0 {
+			return nil
+		}
+		return tx.Table(node.shard).Create(&snapshot.Rows).Error
+	})
+	if err != nil {
+		return err
+	}
+	err = node.saveSnapshot(logT, snapshot)
+	if err != nil {
+		return err
+	}
+	return restartLog(node.shard, snapshot)
+}
+
+// raftVoteHandler answers a candidate asking for this replica's vote
+func raftVoteHandler(c *gin.Context) {
+	var payload raftVoteRequest
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON:%v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	node := raftOf(payload.Shard)
+	logT, ok := g_shard_log_map[payload.Shard]
+	if node == nil || !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return
+	}
+	lastIndex, lastTerm := node.lastLog(logT)
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if payload.Term > node.term {
+		node.stepDown(payload.Term)
+	}
+	upToDate := payload.Last_term > lastTerm || (payload.Last_term == lastTerm && payload.Last_index >= lastIndex)
+	granted := payload.Term == node.term && (node.votedFor == "" || node.votedFor == payload.Candidate) && upToDate
+	if granted {
+		node.votedFor = payload.Candidate
+		node.persist()
+		node.lastContact = time.Now()
+	}
+	c.JSON(http.StatusOK, raftVoteReply{Term: node.term, Granted: granted})
+}
+
+// raftAppendHandler logs the entries a leader sent after checking they continue this
+// replica's log, dropping any uncommitted entries they conflict with
+func raftAppendHandler(c *gin.Context) {
+	var payload raftAppendRequest
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON:%v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shard_ := payload.Shard
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	node := raftOf(shard_)
+	logT, ok := g_shard_log_map[shard_]
+	if node == nil || !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	last := logT.lastIndex()
+	reply := raftAppendReply{Term: node.term, Last_index: last}
+	if !node.follow(payload.Term, payload.Leader) {
+		c.JSON(http.StatusOK, reply)
+		return
+	}
+	reply.Term = node.term
+	if payload.Prev_index > last {
+		c.JSON(http.StatusOK, reply)
+		return
+	}
+	if payload.Prev_index > logT.base && node.termAt(logT, payload.Prev_index) != payload.Prev_term {
+		reply.Last_index = payload.Prev_index - 1
+		c.JSON(http.StatusOK, reply)
+		return
+	}
+	index := payload.Prev_index
+	for _, entry := range payload.Entries {
+		index++
+		if index <= logT.base {
+			continue
+		}
+		if index <= last {
+			if node.termAt(logT, index) == entry.Raft_term {
+				continue
+			}
+			err = truncateLog(shard_, index-1)
+			if err != nil {
+				log.Printf("Error truncating log for shard %s:%v", shard_, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		err = writeToLog(entry, shard_)
+		if err != nil {
+			log.Printf("Error writing to log for shard %s:%v", shard_, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		last = index
+	}
+	// the leader counts this replica towards a majority once it answers
+	err = logT.syncNow()
+	if err != nil {
+		log.Printf("Error syncing log for shard %s:%v", shard_, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	commit := payload.Leader_commit
+	if commit > index {
+		commit = index
+	}
+	if commit > node.commitIndex {
+		node.commitIndex = commit
+		node.signal()
+	}
+	reply.Success = true
+	reply.Last_index = last
+	c.JSON(http.StatusOK, reply)
+}
+
+// raftSnapshotHandler installs the snapshot a leader sent in place of entries it compacted
+func raftSnapshotHandler(c *gin.Context) {
+	var payload raftSnapshotRequest
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON:%v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shard_ := payload.Shard
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	node := raftOf(shard_)
+	logT, ok := g_shard_log_map[shard_]
+	if node == nil || !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	reply := raftAppendReply{Term: node.term, Last_index: logT.lastIndex()}
+	if !node.follow(payload.Term, payload.Leader) {
+		c.JSON(http.StatusOK, reply)
+		return
+	}
+	reply.Term = node.term
+	reply.Success = true
+	// entries applied already cover the snapshot
+	if payload.Snapshot.Index <= *logT.index {
+		c.JSON(http.StatusOK, reply)
+		return
+	}
+	err = node.install(logT, payload.Snapshot)
+	if err != nil {
+		log.Printf("Error installing snapshot for shard %s:%v", shard_, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if payload.Snapshot.Index > node.commitIndex {
+		node.commitIndex = payload.Snapshot.Index
+		node.signal()
+	}
+	reply.Last_index = payload.Snapshot.Index
+	c.JSON(http.StatusOK, reply)
+}
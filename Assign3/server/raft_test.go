@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// raftShard gives shard sh1 a log with one entry per term in terms and a raft node in term
+// with role
+func raftShard(t *testing.T, term int, role string, terms ...int) *raftNode {
+	t.Helper()
+	var entries []logPayload
+	for _, entryTerm := range terms {
+		entries = append(entries, logPayload{Operation: "w", Raft_term: entryTerm})
+	}
+	logOf(t, "sh1", entries)
+	node := &raftNode{shard: "sh1", term: term, role: role, matchIndex: make(map[string]int), commits: make(chan struct{})}
+	raftsLock.Lock()
+	g_rafts["sh1"] = node
+	raftsLock.Unlock()
+	t.Cleanup(func() {
+		raftsLock.Lock()
+		delete(g_rafts, "sh1")
+		raftsLock.Unlock()
+		// stepping down adopts the term for the fencing of the primary mode too
+		termsLock.Lock()
+		delete(g_terms, "sh1")
+		termsLock.Unlock()
+	})
+	return node
+}
+
+func TestRaftAdvance(t *testing.T) {
+	t.Setenv("SERVER_ID", "Server0")
+	members := []string{"Server0", "Server1", "Server2"}
+	tests := []struct {
+		name   string
+		term   int
+		role   string
+		terms  []int
+		match  map[string]int
+		commit int
+		want   int
+	}{
+		{"majority logged", 2, raftLeader, []int{1, 2, 2}, map[string]int{"Server1": 3}, 0, 3},
+		{"majority of an earlier entry", 2, raftLeader, []int{2, 2, 2}, map[string]int{"Server1": 2, "Server2": 1}, 0, 2},
+		{"only the leader logged", 2, raftLeader, []int{2, 2}, map[string]int{}, 0, 0},
+		{"entries of an older term wait", 3, raftLeader, []int{1, 2}, map[string]int{"Server1": 2, "Server2": 2}, 0, 0},
+		{"commit never moves back", 2, raftLeader, []int{2, 2, 2}, map[string]int{"Server1": 1}, 2, 2},
+		{"followers do not commit", 2, raftFollower, []int{2, 2}, map[string]int{"Server1": 2, "Server2": 2}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := raftShard(t, tt.term, tt.role, tt.terms...)
+			node.matchIndex = tt.match
+			node.commitIndex = tt.commit
+			node.advance(members)
+			if node.commitIndex != tt.want {
+				t.Errorf("got commit index %d, want %d", node.commitIndex, tt.want)
+			}
+		})
+	}
+}
+
+func TestRaftVote(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/raft/vote", raftVoteHandler)
+	// this replica logged entries of terms 1, 1 and 2 and is in term 2
+	tests := []struct {
+		name    string
+		votes   []raftVoteRequest
+		granted []bool
+		term    int
+	}{
+		{"up to date candidate", []raftVoteRequest{{Term: 3, Candidate: "Server1", Last_index: 3, Last_term: 2}}, []bool{true}, 3},
+		{"longer log of the same term", []raftVoteRequest{{Term: 3, Candidate: "Server1", Last_index: 5, Last_term: 2}}, []bool{true}, 3},
+		{"shorter log", []raftVoteRequest{{Term: 3, Candidate: "Server1", Last_index: 2, Last_term: 2}}, []bool{false}, 3},
+		{"older last term", []raftVoteRequest{{Term: 3, Candidate: "Server1", Last_index: 9, Last_term: 1}}, []bool{false}, 3},
+		{"stale term", []raftVoteRequest{{Term: 1, Candidate: "Server1", Last_index: 3, Last_term: 2}}, []bool{false}, 2},
+		{"one vote per term", []raftVoteRequest{
+			{Term: 3, Candidate: "Server1", Last_index: 3, Last_term: 2},
+			{Term: 3, Candidate: "Server2", Last_index: 3, Last_term: 2},
+			{Term: 3, Candidate: "Server1", Last_index: 3, Last_term: 2},
+		}, []bool{true, false, true}, 3},
+		{"new term frees the vote", []raftVoteRequest{
+			{Term: 3, Candidate: "Server1", Last_index: 3, Last_term: 2},
+			{Term: 4, Candidate: "Server2", Last_index: 3, Last_term: 2},
+		}, []bool{true, true}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := raftShard(t, 2, raftLeader, 1, 1, 2)
+			for i, vote := range tt.votes {
+				vote.Shard = "sh1"
+				body, _ := json.Marshal(vote)
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/raft/vote", strings.NewReader(string(body))))
+				var reply raftVoteReply
+				err := json.Unmarshal(recorder.Body.Bytes(), &reply)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if reply.Granted != tt.granted[i] {
+					t.Errorf("vote %d: got granted %v, want %v", i, reply.Granted, tt.granted[i])
+				}
+			}
+			if node.term != tt.term {
+				t.Errorf("got term %d, want %d", node.term, tt.term)
+			}
+			// a newer term always deposes the leader
+			if tt.term > 2 && node.role != raftFollower {
+				t.Errorf("still %s in term %d", node.role, node.term)
+			}
+		})
+	}
+}
+
+func TestRaftFollow(t *testing.T) {
+	tests := []struct {
+		name     string
+		term     int
+		ok       bool
+		role     string
+		votedFor string
+	}{
+		{"stale leader", 2, false, raftCandidate, "Server0"},
+		{"leader of the same term", 3, true, raftFollower, "Server0"},
+		{"leader of a newer term", 4, true, raftFollower, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := raftShard(t, 3, raftCandidate)
+			node.votedFor = "Server0"
+			ok := node.follow(tt.term, "Server1")
+			if ok != tt.ok || node.role != tt.role || node.votedFor != tt.votedFor {
+				t.Errorf("got %v as %s voted for %q, want %v as %s voted for %q", ok, node.role, node.votedFor, tt.ok, tt.role, tt.votedFor)
+			}
+			if ok && node.leader != "Server1" {
+				t.Errorf("got leader %q", node.leader)
+			}
+		})
+	}
+}
+
+func TestRaftAppend(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/raft/append", raftAppendHandler)
+	entry := func(term int) logPayload {
+		return logPayload{Operation: "w", Raft_term: term}
+	}
+	// this replica logged entries of terms 1, 1 and 2 and follows term 2
+	tests := []struct {
+		name     string
+		append   raftAppendRequest
+		success  bool
+		reply    int
+		last     int
+		lastTerm int
+		commit   int
+	}{
+		{"continues the log", raftAppendRequest{Term: 2, Prev_index: 3, Prev_term: 2, Entries: []logPayload{entry(2)}, Leader_commit: 3}, true, 4, 4, 2, 3},
+		{"heartbeat", raftAppendRequest{Term: 2, Prev_index: 3, Prev_term: 2}, true, 3, 3, 2, 0},
+		{"gap before the entries", raftAppendRequest{Term: 2, Prev_index: 5, Prev_term: 2, Entries: []logPayload{entry(2)}}, false, 3, 3, 2, 0},
+		{"previous term differs", raftAppendRequest{Term: 2, Prev_index: 3, Prev_term: 1, Entries: []logPayload{entry(2)}}, false, 2, 3, 2, 0},
+		{"conflicting entries are dropped", raftAppendRequest{Term: 3, Prev_index: 1, Prev_term: 1, Entries: []logPayload{entry(3)}}, true, 2, 2, 3, 0},
+		{"entries already logged are kept", raftAppendRequest{Term: 2, Prev_index: 1, Prev_term: 1, Entries: []logPayload{entry(1)}}, true, 3, 3, 2, 0},
+		{"commit stops at the last entry sent", raftAppendRequest{Term: 2, Prev_index: 3, Prev_term: 2, Entries: []logPayload{entry(2)}, Leader_commit: 9}, true, 4, 4, 2, 4},
+		{"stale leader", raftAppendRequest{Term: 1, Prev_index: 3, Prev_term: 2, Entries: []logPayload{entry(1)}}, false, 3, 3, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := raftShard(t, 2, raftFollower, 1, 1, 2)
+			tt.append.Shard = "sh1"
+			tt.append.Leader = "Server1"
+			body, _ := json.Marshal(tt.append)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/raft/append", strings.NewReader(string(body))))
+			var reply raftAppendReply
+			err := json.Unmarshal(recorder.Body.Bytes(), &reply)
+			if err != nil {
+				t.Fatalf("%v: %s", err, recorder.Body.String())
+			}
+			if reply.Success != tt.success || reply.Last_index != tt.reply {
+				t.Errorf("got success %v up to %d, want %v up to %d", reply.Success, reply.Last_index, tt.success, tt.reply)
+			}
+			last, lastTerm := node.lastLog(g_shard_log_map["sh1"])
+			if last != tt.last || lastTerm != tt.lastTerm {
+				t.Errorf("log ends at %d in term %d, want %d in term %d", last, lastTerm, tt.last, tt.lastTerm)
+			}
+			if node.commitIndex != tt.commit {
+				t.Errorf("got commit index %d, want %d", node.commitIndex, tt.commit)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// how long a recovered replica waits for one round of catching up with its primary
+	recoveryTimeout = time.Duration(envInt("RECOVERY_TIMEOUT_S", 30)) * time.Second
+	// recovered replicas that have not caught up with their primary yet
+	g_recovering   = make(map[string]bool)
+	recoveringLock = &sync.Mutex{}
+)
+
+// recoverShards picks up the shards this server held before it restarted from the files they
+// left in /data, so it serves them again without waiting for /config. Each shard replays the
+// entries it logged but had not applied. Replicas catch up with their primary in the
+// background, so an unreachable primary does not hold back startup.
+func recoverShards() {
+	paths, err := filepath.Glob(indexPath("*"))
+	if err != nil {
+		log.Printf("Error listing shards in /data:%v", err)
+		return
+	}
+	var behind []string
+	indexLock.Lock()
+	for _, path := range paths {
+		shard_ := strings.TrimSuffix(filepath.Base(path), "_index.log")
+		replica, err := recoverShard(shard_)
+		if err != nil {
+			log.Printf("Error recovering shard %s:%v", shard_, err)
+			continue
+		}
+		if replica {
+			setRecovering(shard_, true)
+			behind = append(behind, shard_)
+		}
+		configDone = true
+	}
+	indexLock.Unlock()
+	for _, shard_ := range behind {
+		go finishRecovery(shard_, primaryOf)
+	}
+}
+
+func setRecovering(shard_ string, recovering bool) {
+	recoveringLock.Lock()
+	defer recoveringLock.Unlock()
+	if recovering {
+		g_recovering[shard_] = true
+	} else {
+		delete(g_recovering, shard_)
+	}
+}
+
+// checkReady answers 503 for a shard still catching up after a restart, whose rows and log
+// are behind its primary
+func checkReady(c *gin.Context, shard_ string) bool {
+	recoveringLock.Lock()
+	recovering := g_recovering[shard_]
+	recoveringLock.Unlock()
+	if recovering {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("shard %s is recovering", shard_)})
+		return false
+	}
+	return true
+}
+
+// finishRecovery catches a recovered replica up with the primary lookup names, one bounded
+// round at a time, and marks the shard ready once it is level. Each round holds the shard
+// order lock so no shipped request is logged in between.
+func finishRecovery(shard_ string, lookup func(shard_ string) (string, error)) {
+	for {
+		release := lockShardOrder(shard_)
+		primaryServer, err := lookup(shard_)
+		if err == nil && primaryServer != "" && primaryServer != os.Getenv("SERVER_ID") {
+			ctx, cancel := context.WithTimeout(context.Background(), recoveryTimeout)
+			indexLock.Lock()
+			if _, ok := g_shard_log_map[shard_]; ok {
+				err = catchUp(ctx, shard_, primaryServer)
+			}
+			indexLock.Unlock()
+			cancel()
+		}
+		if err == nil {
+			setRecovering(shard_, false)
+		}
+		release()
+		if err == nil {
+			log.Printf("Shard %s recovered", shard_)
+			return
+		}
+		log.Printf("Error catching up shard %s from %s:%v", shard_, primaryServer, err)
+		time.Sleep(defaultRetry.maxDelay)
+	}
+}
+
+// primaryOf names the primary of a shard, empty when it has none
+func primaryOf(shard_ string) (string, error) {
+	var mapTs []MapT
+	err := mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Find(&mapTs).Error
+	if err != nil {
+		return "", err
+	}
+	for _, mapT := range mapTs {
+		if mapT.Primary {
+			return mapT.Server_id, nil
+		}
+	}
+	return "", nil
+}
+
+// readSnapshot reads the checkpoint or raft snapshot a shard was compacted into, nil when it
+// never was
+func readSnapshot(path string) (*shardSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot shardSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Rows = nil
+	return &snapshot, nil
+}
+
+// recoverShard reloads the log of one shard and brings its table up to date with it. It
+// reports whether the shard is a replica that still has to catch up with its primary.
+// indexLock is held.
+func recoverShard(shard_ string) (bool, error) {
+	self := os.Getenv("SERVER_ID")
+	var mapTs []MapT
+	err := mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Find(&mapTs).Error
+	if err != nil {
+		return false, err
+	}
+	placed := false
+	var primaryServer string
+	for _, mapT := range mapTs {
+		if mapT.Server_id == self {
+			placed = true
+		}
+		if mapT.Primary {
+			primaryServer = mapT.Server_id
+		}
+	}
+	if !placed {
+		return false, fmt.Errorf("the shard is no longer placed on %s", self)
+	}
+
+	// a raft replica compacts into its snapshot, a primary-mode one into its checkpoint
+	_, err = os.Stat(raftFile(shard_, "raft"))
+	raftMode := err == nil
+	snapshotFile := checkpointPath(shard_)
+	if raftMode {
+		snapshotFile = raftFile(shard_, "snapshot")
+	}
+	snapshot, err := readSnapshot(snapshotFile)
+	if err != nil {
+		return false, err
+	}
+	base := 0
+	if snapshot != nil {
+		base = snapshot.Index
+	}
+	applied := 0
+	data, err := os.ReadFile(indexPath(shard_))
+	if err != nil {
+		return false, err
+	}
+	if text := strings.TrimSpace(string(data)); text != "" {
+		applied, err = strconv.Atoi(text)
+		if err != nil {
+			return false, err
+		}
+	}
+	if applied < base {
+		return false, fmt.Errorf("applied index %d is behind the compacted entries up to %d", applied, base)
+	}
+
+	logT, err := loadLog(shard_, base)
+	if err != nil {
+		return false, err
+	}
+	logT.snapshot = snapshot
+	if applied > logT.lastIndex() {
+		// the tail lost to the crash had been applied already, catch-up brings the entries
+		// after it
+		log.Printf("Shard %s applied entry %d but its log ends at %d, restarting the log after it", shard_, applied, logT.lastIndex())
+		err = logT.reset(applied)
+		if err != nil {
+			logT.close()
+			return false, err
+		}
+	}
+	*logT.index = applied
+	err = db.Table(shard_).AutoMigrate(&StudT{})
+	if err != nil {
+		logT.close()
+		return false, err
+	}
+	g_shard_log_map[shard_] = logT
+	err = loadIndexes(shard_)
+	if err == nil {
+		err = loadSequences(shard_)
+	}
+	if err == nil {
+		err = loadTxns(shard_)
+	}
+	if err != nil {
+		logT.close()
+		delete(g_shard_log_map, shard_)
+		return false, err
+	}
+	log.Printf("Recovered shard %s: entries %d-%d, %d applied", shard_, base+1, logT.lastIndex(), applied)
+
+	// the leader tells a raft replica what was committed after the entries it applied
+	if raftMode {
+		return false, startRaft(shard_)
+	}
+	err = executeFromLog(shard_)
+	if err != nil {
+		return false, err
+	}
+	return primaryServer != "" && primaryServer != self, nil
+}
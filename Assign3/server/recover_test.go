@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadSnapshot(t *testing.T) {
+	rows := []StudT{{Stud_id: 1, Stud_name: "a"}}
+	tests := []struct {
+		name string
+		data string
+		want *shardSnapshot
+		err  bool
+	}{
+		{"never compacted", "", nil, false},
+		{
+			name: "rows left out",
+			data: `{"Index":7,"Term":2,"Rows":[{"Stud_id":1,"Stud_name":"a"}],"Last_seq":4}`,
+			want: &shardSnapshot{Index: 7, Term: 2, Last_seq: 4},
+		},
+		{
+			name: "open transactions kept",
+			data: `{"Index":3,"Prepared":{"t1":[{"Stud_id":1,"Stud_name":"a"}]},"Decided":{"t0":"c"}}`,
+			want: &shardSnapshot{Index: 3, Prepared: map[string][]StudT{"t1": rows}, Decided: map[string]string{"t0": "c"}},
+		},
+		{"garbled", `{"Index":`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sh1_checkpoint.json")
+			if tt.data != "" {
+				err := os.WriteFile(path, []byte(tt.data), 0777)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			snapshot, err := readSnapshot(path)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want one: %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(snapshot, tt.want) {
+				t.Errorf("got %+v, want %+v", snapshot, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckReady(t *testing.T) {
+	defer setRecovering("sh1", false)
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		recovering []string
+		ready      bool
+	}{
+		{"never recovered", nil, true},
+		{"catching up", []string{"sh1"}, false},
+		{"another shard catching up", []string{"sh2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, shard_ := range tt.recovering {
+				setRecovering(shard_, true)
+				defer setRecovering(shard_, false)
+			}
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			if ready := checkReady(c, "sh1"); ready != tt.ready {
+				t.Fatalf("got ready %v, want %v", ready, tt.ready)
+			}
+			if !tt.ready && recorder.Code != http.StatusServiceUnavailable {
+				t.Errorf("got status %d, want 503", recorder.Code)
+			}
+		})
+	}
+}
+
+// fakePrimary serves /catchup from the entries of its log, failing every call while it is down
+type fakePrimary struct {
+	mu      sync.Mutex
+	down    bool
+	entries []logPayload
+}
+
+func (f *fakePrimary) RoundTrip(request *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down || request.URL.Path != "/catchup" {
+		return nil, errors.New("connection refused")
+	}
+	var payload catchupPayload
+	err := json.NewDecoder(request.Body).Decode(&payload)
+	if err != nil {
+		return nil, err
+	}
+	entries := []logPayload{}
+	if payload.From < len(f.entries) {
+		entries = f.entries[payload.From:]
+	}
+	body, _ := json.Marshal(catchupResponse{Entries: entries, Last_index: len(f.entries)})
+	return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(body)), Request: request}, nil
+}
+
+func TestRestartedSecondaryServesAgain(t *testing.T) {
+	defer func(dir string, done bool, retry retryPolicy, transport http.RoundTripper) {
+		dataDir, configDone, defaultRetry, http.DefaultClient.Transport = dir, done, retry, transport
+	}(dataDir, configDone, defaultRetry, http.DefaultClient.Transport)
+	defer func() {
+		delete(g_sequences, "sh1")
+		delete(g_prepared, "sh1")
+		delete(g_txn_decided, "sh1")
+	}()
+	dataDir = t.TempDir()
+	configDone = true
+	defaultRetry = retryPolicy{attempts: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond, callTimeout: time.Second}
+	t.Setenv("SERVER_ID", "Server1")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/lookup", lookupHandler)
+	lookup := func() int {
+		recorder := httptest.NewRecorder()
+		body := strings.NewReader(`{"shard":"sh1","column":"Stud_name","value":"ann"}`)
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/lookup", body))
+		return recorder.Code
+	}
+
+	// the secondary restarted with entries 1 and 2 applied, the primary logged 3 to 5 since
+	held := []logPayload{{Operation: "n"}, {Operation: "n"}}
+	primary := &fakePrimary{down: true, entries: append(append([]logPayload{}, held...), logPayload{Operation: "n"}, logPayload{Operation: "n"}, logPayload{Operation: "n"})}
+	http.DefaultClient.Transport = primary
+	logOf(t, "sh1", held)
+	logT := g_shard_log_map["sh1"]
+	*logT.index = 2
+	indexedShard(t)
+	setRecovering("sh1", true)
+	defer setRecovering("sh1", false)
+
+	done := make(chan bool)
+	go func() {
+		finishRecovery("sh1", func(string) (string, error) { return "Server0", nil })
+		done <- true
+	}()
+	// behind the primary the shard refuses requests
+	time.Sleep(20 * time.Millisecond)
+	if status := lookup(); status != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d while the primary is down, want 503", status)
+	}
+	primary.mu.Lock()
+	primary.down = false
+	primary.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the shard never caught up")
+	}
+
+	indexLock.Lock()
+	last, applied := logT.lastIndex(), *logT.index
+	indexLock.Unlock()
+	if last != 5 || applied != 5 {
+		t.Errorf("got entries up to %d, %d applied, want 5 and 5", last, applied)
+	}
+	saved, err := os.ReadFile(indexPath("sh1"))
+	if err != nil || string(saved) != "5" {
+		t.Errorf("got applied index file %q, %v, want 5", saved, err)
+	}
+	if status := lookup(); status != http.StatusOK {
+		t.Errorf("got status %d once level with the primary, want 200", status)
+	}
+}
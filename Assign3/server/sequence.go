@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"sync"
+)
+
+// sequenceEntry is where a sequenced entry landed in the log, the request it came from and,
+// for updates, the version it gave the row
+type sequenceEntry struct {
+	index   int
+	request string
+	version int
+}
+
+// sequenceState tracks the sequence numbers the primaries of a shard allocated to writes,
+// updates and deletes. Sequences are stored in the log entries, so they survive restarts of
+// the balancer and are rebuilt from the log whenever a shard is configured or copied.
+type sequenceState struct {
+	entries  int
+	last     int
+	recent   map[int]sequenceEntry
+	order    []int
+	requests map[string]int
+}
+
+var (
+	// how many of the latest sequences a server remembers to recognise resends
+	dedupeWindow = envInt("DEDUPE_WINDOW", 10000)
+	// sequence state per shard, guarded by indexLock
+	g_sequences = make(map[string]*sequenceState)
+	// per-shard locks keeping logged requests in one order from sequencing through
+	// replication, whichever balancer sent them
+	g_shard_order = make(map[string]*sync.Mutex)
+	orderLock     = &sync.Mutex{}
+)
+
+// lockShardOrder waits for the logged requests of a shard before this one and returns the
+// unlock, which may be called more than once. On a primary it spans queueing for the
+// secondaries, so they see entries in log order; it is released before waiting for the log
+// sync and the replicas so the next request can share them.
+func lockShardOrder(shard_ string) func() {
+	orderLock.Lock()
+	lock, ok := g_shard_order[shard_]
+	if !ok {
+		lock = &sync.Mutex{}
+		g_shard_order[shard_] = lock
+	}
+	orderLock.Unlock()
+	lock.Lock()
+	var once sync.Once
+	return func() {
+		once.Do(lock.Unlock)
+	}
+}
+
+func newSequenceState() *sequenceState {
+	return &sequenceState{recent: make(map[int]sequenceEntry), requests: make(map[string]int)}
+}
+
+func sequencesOf(shard_ string) *sequenceState {
+	state, ok := g_sequences[shard_]
+	if !ok {
+		state = newSequenceState()
+		g_sequences[shard_] = state
+	}
+	return state
+}
+
+// observe accounts for an entry appended to the log
+func (state *sequenceState) observe(logItem logPayload) {
+	state.entries++
+	if logItem.Seq == 0 {
+		return
+	}
+	entry := sequenceEntry{index: state.entries, request: logItem.Request_id}
+	if logItem.Operation == "u" {
+		entry.version = logItem.U_Data.Version
+	}
+	state.remember(logItem.Seq, entry)
+}
+
+// remember adds a sequence to the window, forgetting the oldest one beyond it
+func (state *sequenceState) remember(seq int, entry sequenceEntry) {
+	if seq > state.last {
+		state.last = seq
+	}
+	state.recent[seq] = entry
+	if entry.request != "" {
+		state.requests[entry.request] = seq
+	}
+	state.order = append(state.order, seq)
+	for len(state.order) > dedupeWindow {
+		oldest := state.order[0]
+		state.order = state.order[1:]
+		if request := state.recent[oldest].request; state.requests[request] == oldest {
+			delete(state.requests, request)
+		}
+		delete(state.recent, oldest)
+	}
+}
+
+// restore remembers the sequences a checkpoint or snapshot carried
+func (state *sequenceState) restore(records []sequenceRecord) {
+	for _, record := range records {
+		state.remember(record.Seq, sequenceEntry{index: record.Index, request: record.Request, version: record.Version})
+	}
+}
+
+// loadSequences rebuilds the sequence state of a shard from its log
+func loadSequences(shard_ string) error {
+	delete(g_sequences, shard_)
+	state := sequencesOf(shard_)
+	logT := g_shard_log_map[shard_]
+	state.entries = logT.base
+	if snapshot := logT.snapshot; snapshot != nil {
+		state.last = snapshot.Last_seq
+		state.restore(snapshot.Recent)
+	}
+	return logT.each(logT.base+1, logT.lastIndex(), func(_ int, record []byte) error {
+		var logItem logPayload
+		err := json.Unmarshal(record, &logItem)
+		if err != nil {
+			return err
+		}
+		state.observe(logItem)
+		return nil
+	})
+}
+
+// sequenceFor decides the sequence of a write, update or delete and whether it was logged
+// already. The primary allocates the next sequence unless it has seen the Request-Id the
+// balancer sent; secondaries take the Sequence their primary forwarded. The log index of a
+// logged entry is returned when it is still known.
+func sequenceFor(c *gin.Context, shard_ string) (int, int, bool, error) {
+	state := sequencesOf(shard_)
+	if forwarded := c.GetHeader("Sequence"); forwarded != "" {
+		seq, err := strconv.Atoi(forwarded)
+		if err != nil || seq <= 0 {
+			return 0, 0, false, fmt.Errorf("invalid Sequence %q", forwarded)
+		}
+		if entry, ok := state.recent[seq]; ok {
+			return seq, entry.index, true, nil
+		}
+		// below the window only entries that were applied long ago can be resent
+		if len(state.order) != 0 && seq < state.order[0] && len(state.order) == dedupeWindow {
+			return seq, 0, true, nil
+		}
+		return seq, 0, false, nil
+	}
+	requestId := c.GetHeader("Request-Id")
+	if requestId == "" {
+		return 0, 0, false, fmt.Errorf("missing Request-Id")
+	}
+	if seq, ok := state.requests[requestId]; ok {
+		return seq, state.recent[seq].index, true, nil
+	}
+	return state.last + 1, 0, false, nil
+}
+
+// records lists the remembered sequences of the entries up to upTo oldest first, as
+// checkpoints and snapshots carry them
+func (state *sequenceState) records(upTo int) []sequenceRecord {
+	records := make([]sequenceRecord, 0, len(state.order))
+	for _, seq := range state.order {
+		entry := state.recent[seq]
+		if entry.index > upTo {
+			continue
+		}
+		records = append(records, sequenceRecord{Seq: seq, Index: entry.index, Request: entry.request, Version: entry.version})
+	}
+	return records
+}
+
+// sequenced adds the Sequence header forwarded to the secondaries to headers
+func sequenced(seq int, headers map[string]string) map[string]string {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers["Sequence"] = strconv.Itoa(seq)
+	return headers
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSequenceWindow(t *testing.T) {
+	defer func(window int) { dedupeWindow = window }(dedupeWindow)
+	dedupeWindow = 3
+	tests := []struct {
+		name     string
+		entries  []logPayload
+		recent   map[int]sequenceEntry
+		requests map[string]int
+		last     int
+	}{
+		{
+			name: "unsequenced entries only count",
+			entries: []logPayload{
+				{Operation: "p", Tx_id: "t1"},
+				{Operation: "w", Seq: 1, Request_id: "r1"},
+				{Operation: "c", Tx_id: "t1"},
+				{Operation: "u", Seq: 2, Request_id: "r2"},
+			},
+			recent:   map[int]sequenceEntry{1: {index: 2, request: "r1"}, 2: {index: 4, request: "r2"}},
+			requests: map[string]int{"r1": 1, "r2": 2},
+			last:     2,
+		},
+		{
+			name: "oldest sequences leave the window",
+			entries: []logPayload{
+				{Operation: "w", Seq: 1, Request_id: "r1"},
+				{Operation: "d", Seq: 2, Request_id: "r2"},
+				{Operation: "u", Seq: 3, Request_id: "r3"},
+				{Operation: "w", Seq: 4, Request_id: "r4"},
+			},
+			recent:   map[int]sequenceEntry{2: {index: 2, request: "r2"}, 3: {index: 3, request: "r3"}, 4: {index: 4, request: "r4"}},
+			requests: map[string]int{"r2": 2, "r3": 3, "r4": 4},
+			last:     4,
+		},
+		{
+			name: "request resent under a new sequence",
+			entries: []logPayload{
+				{Operation: "w", Seq: 1, Request_id: "r1"},
+				{Operation: "w", Seq: 2, Request_id: "r1"},
+				{Operation: "w", Seq: 3, Request_id: "r2"},
+				{Operation: "w", Seq: 4, Request_id: "r3"},
+			},
+			recent:   map[int]sequenceEntry{2: {index: 2, request: "r1"}, 3: {index: 3, request: "r2"}, 4: {index: 4, request: "r3"}},
+			requests: map[string]int{"r1": 2, "r2": 3, "r3": 4},
+			last:     4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &sequenceState{recent: make(map[int]sequenceEntry), requests: make(map[string]int)}
+			for _, entry := range tt.entries {
+				state.observe(entry)
+			}
+			if !reflect.DeepEqual(state.recent, tt.recent) {
+				t.Errorf("got recent %+v, want %+v", state.recent, tt.recent)
+			}
+			if !reflect.DeepEqual(state.requests, tt.requests) {
+				t.Errorf("got requests %v, want %v", state.requests, tt.requests)
+			}
+			if state.last != tt.last || state.entries != len(tt.entries) {
+				t.Errorf("got last %d after %d entries, want %d after %d", state.last, state.entries, tt.last, len(tt.entries))
+			}
+		})
+	}
+}
+
+func TestSequenceRecords(t *testing.T) {
+	defer func(window int) { dedupeWindow = window }(dedupeWindow)
+	dedupeWindow = 3
+	tests := []struct {
+		name    string
+		entries []logPayload
+		upTo    int
+		want    []sequenceRecord
+	}{
+		{
+			name: "unsequenced entries only count",
+			entries: []logPayload{
+				{Operation: "p", Tx_id: "t1"},
+				{Operation: "w", Seq: 1, Request_id: "r1"},
+				{Operation: "c", Tx_id: "t1"},
+				{Operation: "u", Seq: 2, Request_id: "r2", U_Data: StudT{Version: 4}},
+			},
+			upTo: 4,
+			want: []sequenceRecord{{Seq: 1, Index: 2, Request: "r1"}, {Seq: 2, Index: 4, Request: "r2", Version: 4}},
+		},
+		{
+			name: "oldest sequences leave the window",
+			entries: []logPayload{
+				{Operation: "w", Seq: 1, Request_id: "r1"},
+				{Operation: "d", Seq: 2, Request_id: "r2"},
+				{Operation: "u", Seq: 3, Request_id: "r3", U_Data: StudT{Version: 2}},
+				{Operation: "w", Seq: 4, Request_id: "r4"},
+			},
+			upTo: 4,
+			want: []sequenceRecord{{Seq: 2, Index: 2, Request: "r2"}, {Seq: 3, Index: 3, Request: "r3", Version: 2}, {Seq: 4, Index: 4, Request: "r4"}},
+		},
+		{
+			name: "entries past the checkpoint are left out",
+			entries: []logPayload{
+				{Operation: "w", Seq: 1, Request_id: "r1"},
+				{Operation: "u", Seq: 2, Request_id: "r2", U_Data: StudT{Version: 3}},
+			},
+			upTo: 1,
+			want: []sequenceRecord{{Seq: 1, Index: 1, Request: "r1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newSequenceState()
+			for _, entry := range tt.entries {
+				state.observe(entry)
+			}
+			records := state.records(tt.upTo)
+			if !reflect.DeepEqual(records, tt.want) {
+				t.Fatalf("got %+v, want %+v", records, tt.want)
+			}
+			// a checkpoint brings back the sequences and versions it carried
+			restored := newSequenceState()
+			restored.restore(records)
+			for _, record := range tt.want {
+				entry, ok := restored.recent[record.Seq]
+				if !ok || entry.index != record.Index || entry.version != record.Version {
+					t.Errorf("sequence %d restored as %+v, %v", record.Seq, entry, ok)
+				}
+				if restored.requests[record.Request] != record.Seq {
+					t.Errorf("request %s restored as sequence %d, want %d", record.Request, restored.requests[record.Request], record.Seq)
+				}
+			}
+			if last := tt.want[len(tt.want)-1].Seq; restored.last != last {
+				t.Errorf("got last sequence %d, want %d", restored.last, last)
+			}
+		})
+	}
+}
+
+func TestSequenceFor(t *testing.T) {
+	defer func(window int) { dedupeWindow = window }(dedupeWindow)
+	dedupeWindow = 2
+	// sequences 1 to 3 were logged at indices 1 to 3, 1 has left the window
+	defer delete(g_sequences, "sh1")
+	delete(g_sequences, "sh1")
+	state := sequencesOf("sh1")
+	for seq := 1; seq <= 3; seq++ {
+		state.observe(logPayload{Operation: "w", Seq: seq, Request_id: "r" + strconv.Itoa(seq)})
+	}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		seq     int
+		index   int
+		logged  bool
+		err     bool
+	}{
+		{"new request", map[string]string{"Request-Id": "r9"}, 4, 0, false, false},
+		{"resent request", map[string]string{"Request-Id": "r3"}, 3, 3, true, false},
+		{"resent below the window", map[string]string{"Request-Id": "r1"}, 4, 0, false, false},
+		{"no Request-Id", nil, 0, 0, false, true},
+		{"forwarded new", map[string]string{"Sequence": "4"}, 4, 0, false, false},
+		{"forwarded logged", map[string]string{"Sequence": "2"}, 2, 2, true, false},
+		{"forwarded below the window", map[string]string{"Sequence": "1"}, 1, 0, true, false},
+		{"forwarded garbled", map[string]string{"Sequence": "x"}, 0, 0, false, true},
+		{"forwarded zero", map[string]string{"Sequence": "0"}, 0, 0, false, true},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/write", nil)
+			for name, value := range tt.headers {
+				c.Request.Header.Set(name, value)
+			}
+			seq, index, logged, err := sequenceFor(c, "sh1")
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want one: %v", err, tt.err)
+			}
+			if seq != tt.seq || index != tt.index || logged != tt.logged {
+				t.Errorf("got %d, %d, %v, want %d, %d, %v", seq, index, logged, tt.seq, tt.index, tt.logged)
+			}
+		})
+	}
+}
+
+func TestSequenced(t *testing.T) {
+	if got := sequenced(7, nil); !reflect.DeepEqual(got, map[string]string{"Sequence": "7"}) {
+		t.Errorf("got %v", got)
+	}
+	headers := map[string]string{"Row-Version": "2"}
+	if got := sequenced(8, headers); !reflect.DeepEqual(got, map[string]string{"Row-Version": "2", "Sequence": "8"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestLockShardOrder(t *testing.T) {
+	release := lockShardOrder("sh1")
+	done := make(chan int, 3)
+	go func() {
+		unlock := lockShardOrder("sh1")
+		done <- 1
+		unlock()
+	}()
+	go func() {
+		// other shards do not wait
+		unlock := lockShardOrder("sh2")
+		done <- 2
+		unlock()
+	}()
+	if got := <-done; got != 2 {
+		t.Fatalf("sh1 was taken while it was held")
+	}
+	select {
+	case <-done:
+		t.Fatal("sh1 was taken while it was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	if got := <-done; got != 1 {
+		t.Fatalf("got %d, want the waiting sh1 request", got)
+	}
+}
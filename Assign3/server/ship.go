@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// how many replicas of a shard, the primary included, log a request before the client is
+	// answered: "majority", "all" or a number
+	writeQuorum = os.Getenv("WRITE_QUORUM")
+	// requests a secondary may fall behind by before the primary stops shipping to it and
+	// has it catch up from the log instead
+	replicaBacklog = envInt("REPLICA_BACKLOG", 10000)
+	// shippers per shard and secondary
+	g_shippers   = make(map[string]*shipper)
+	shippersLock = &sync.Mutex{}
+)
+
+// shipment is a logged request on its way to one secondary
+type shipment struct {
+	method   string
+	path     string
+	jsonData string
+	headers  map[string]string
+	// receives the outcome of the first attempt and, if that failed, of the last one
+	acked chan error
+}
+
+// shipper delivers the requests a primary logged to one secondary in log order, so a slow
+// secondary catches up in the background without holding back the others
+type shipper struct {
+	shard   string
+	server  string
+	queue   []*shipment
+	running bool
+	// set while the secondary catches up from the log after falling too far behind
+	lagging bool
+}
+
+// quorumOf is the number of acknowledgements a request needs on a shard with replicas
+// replicas
+func quorumOf(replicas int) int {
+	quorum := replicas/2 + 1
+	switch writeQuorum {
+	case "", "majority":
+	case "all":
+		quorum = replicas
+	default:
+		n, err := strconv.Atoi(writeQuorum)
+		if err != nil || n < 1 {
+			log.Printf("Invalid WRITE_QUORUM %q, using a majority", writeQuorum)
+		} else {
+			quorum = n
+		}
+	}
+	if quorum > replicas {
+		quorum = replicas
+	}
+	return quorum
+}
+
+// ship queues a request for a secondary and starts its shipper if it was idle
+func ship(shard_ string, server string, item *shipment) {
+	shippersLock.Lock()
+	defer shippersLock.Unlock()
+	key := shard_ + "/" + server
+	s, ok := g_shippers[key]
+	if !ok {
+		s = &shipper{shard: shard_, server: server}
+		g_shippers[key] = s
+	}
+	if s.lagging {
+		item.acked <- fmt.Errorf("secondary %s is catching up", server)
+		return
+	}
+	if len(s.queue) >= replicaBacklog {
+		// shipping on after dropping the backlog would leave the secondary without those
+		// entries for good, so it fetches them from the log instead
+		log.Printf("Secondary %s is %d requests behind on shard %s, having it catch up from the log", server, len(s.queue), shard_)
+		err := fmt.Errorf("secondary %s fell too far behind", server)
+		s.fail(err)
+		item.acked <- err
+		s.lagging = true
+		go s.resync()
+		return
+	}
+	s.queue = append(s.queue, item)
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+}
+
+// fail answers every queued request with err, shippersLock is held
+func (s *shipper) fail(err error) {
+	for _, item := range s.queue {
+		item.acked <- err
+	}
+	s.queue = nil
+}
+
+// stopShipping drops what is queued for the secondaries of a shard removed from this server
+func stopShipping(shard_ string) {
+	shippersLock.Lock()
+	defer shippersLock.Unlock()
+	for key, s := range g_shippers {
+		if s.shard == shard_ {
+			s.fail(fmt.Errorf("shard %s removed", shard_))
+			delete(g_shippers, key)
+		}
+	}
+}
+
+func (s *shipper) run() {
+	for {
+		shippersLock.Lock()
+		if len(s.queue) == 0 {
+			s.running = false
+			shippersLock.Unlock()
+			return
+		}
+		item := s.queue[0]
+		shippersLock.Unlock()
+
+		err := s.deliver(item)
+		shippersLock.Lock()
+		if len(s.queue) != 0 && s.queue[0] == item {
+			s.queue = s.queue[1:]
+			item.acked <- err
+		}
+		shippersLock.Unlock()
+	}
+}
+
+// deliver sends one request until the secondary takes it. The request waiting for it hears
+// about the first failure while delivery goes on; only a newer term ends it for good.
+func (s *shipper) deliver(item *shipment) error {
+	url := fmt.Sprintf("http://%s:5000%s", s.server, item.path)
+	reported := false
+	for {
+		status, _, err := defaultRetry.send(context.Background(), item.method, url, []byte(item.jsonData), item.headers, func(status int) bool {
+			// a secondary that saw a newer term will not change its mind on a retry
+			return status == http.StatusOK || status == http.StatusMisdirectedRequest
+		})
+		if err == nil && status == http.StatusMisdirectedRequest {
+			return fmt.Errorf("forwarding %s to %s: fenced by a newer term", item.path, s.server)
+		}
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("forwarding %s to %s: %w", item.path, s.server, err)
+		if !reported {
+			log.Printf("Secondary %s is lagging on shard %s: %v", s.server, s.shard, err)
+			item.acked <- err
+			reported = true
+		}
+		shippersLock.Lock()
+		dropped := len(s.queue) == 0 || s.queue[0] != item
+		shippersLock.Unlock()
+		if dropped {
+			return err
+		}
+		time.Sleep(defaultRetry.maxDelay)
+	}
+}
+
+// resync has a lagging secondary catch up from the log until it is level again. The last
+// round holds the shard order lock, so nothing is logged between the secondary catching up
+// and shipping to it again.
+func (s *shipper) resync() {
+	for {
+		err := s.requestCatchUp()
+		if err == nil {
+			release := lockShardOrder(s.shard)
+			err = s.requestCatchUp()
+			if err == nil {
+				shippersLock.Lock()
+				s.lagging = false
+				shippersLock.Unlock()
+			}
+			release()
+		}
+		if err == nil {
+			log.Printf("Secondary %s caught up on shard %s, shipping to it again", s.server, s.shard)
+			return
+		}
+		log.Printf("Error resyncing secondary %s on shard %s:%v", s.server, s.shard, err)
+		shippersLock.Lock()
+		stopped := g_shippers[s.shard+"/"+s.server] != s
+		shippersLock.Unlock()
+		if stopped {
+			return
+		}
+		time.Sleep(defaultRetry.maxDelay)
+	}
+}
+
+// requestCatchUp asks the secondary to fetch the entries it is missing from this primary
+func (s *shipper) requestCatchUp() error {
+	body, _ := json.Marshal(resyncPayload{Shard: s.shard, Primary: os.Getenv("SERVER_ID")})
+	headers := make(map[string]string)
+	if term := termOf(s.shard); term > 0 {
+		headers["Term"] = strconv.Itoa(term)
+	}
+	url := fmt.Sprintf("http://%s:5000/resync", s.server)
+	_, _, err := defaultRetry.send(context.Background(), http.MethodPost, url, body, headers, acceptOK)
+	return err
+}
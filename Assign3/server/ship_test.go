@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeReplicas answers the requests sent to each server with its status, servers without
+// one cannot be reached
+type fakeReplicas struct {
+	mu       sync.Mutex
+	statuses map[string]int
+	received map[string][]string
+}
+
+func (f *fakeReplicas) RoundTrip(request *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	server := request.URL.Hostname()
+	status, ok := f.statuses[server]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	body, _ := io.ReadAll(request.Body)
+	f.received[server] = append(f.received[server], string(body))
+	return &http.Response{StatusCode: status, Header: make(http.Header), Body: io.NopCloser(strings.NewReader("{}")), Request: request}, nil
+}
+
+// replicasOf routes the calls of this server to fake secondaries for a test
+func replicasOf(t *testing.T, statuses map[string]int) *fakeReplicas {
+	t.Helper()
+	f := &fakeReplicas{statuses: statuses, received: make(map[string][]string)}
+	transport, retry := http.DefaultClient.Transport, defaultRetry
+	http.DefaultClient.Transport = f
+	defaultRetry = retryPolicy{attempts: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond, callTimeout: time.Second}
+	t.Cleanup(func() {
+		stopShipping("sh1")
+		// let shippers still retrying see they were dropped
+		time.Sleep(10 * time.Millisecond)
+		http.DefaultClient.Transport, defaultRetry = transport, retry
+	})
+	return f
+}
+
+func TestQuorumOf(t *testing.T) {
+	defer func(quorum string) { writeQuorum = quorum }(writeQuorum)
+	tests := []struct {
+		quorum   string
+		replicas int
+		want     int
+	}{
+		{"", 3, 2},
+		{"majority", 4, 3},
+		{"majority", 1, 1},
+		{"all", 3, 3},
+		{"2", 3, 2},
+		{"5", 3, 3},
+		{"0", 3, 2},
+		{"most", 5, 3},
+	}
+	for _, tt := range tests {
+		writeQuorum = tt.quorum
+		if got := quorumOf(tt.replicas); got != tt.want {
+			t.Errorf("%q of %d replicas: got %d, want %d", tt.quorum, tt.replicas, got, tt.want)
+		}
+	}
+}
+
+func TestAwaitQuorum(t *testing.T) {
+	defer func(quorum string) { writeQuorum = quorum }(writeQuorum)
+	secondaries := []string{"Server1", "Server2", "Server3"}
+	tests := []struct {
+		name     string
+		quorum   string
+		statuses map[string]int
+		err      bool
+	}{
+		{"every secondary", "", map[string]int{"Server1": http.StatusOK, "Server2": http.StatusOK, "Server3": http.StatusOK}, false},
+		{"one unreachable", "", map[string]int{"Server1": http.StatusOK, "Server2": http.StatusOK}, false},
+		{"two unreachable", "", map[string]int{"Server1": http.StatusOK}, true},
+		{"fenced by a newer term", "", map[string]int{"Server1": http.StatusOK, "Server2": http.StatusMisdirectedRequest, "Server3": http.StatusServiceUnavailable}, true},
+		{"all of them", "all", map[string]int{"Server1": http.StatusOK, "Server2": http.StatusOK}, true},
+		{"primary alone", "1", map[string]int{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeQuorum = tt.quorum
+			replicasOf(t, tt.statuses)
+			items := shipToSecondaries("sh1", secondaries, http.MethodPost, "/write", "{}", nil)
+			err := awaitQuorum(context.Background(), items)
+			if (err != nil) != tt.err {
+				t.Errorf("got error %v, want one: %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestShipInOrder(t *testing.T) {
+	f := replicasOf(t, map[string]int{"Server1": http.StatusOK})
+	var items []*shipment
+	var want []string
+	for i := 0; i < 20; i++ {
+		body := strings.Repeat("x", i)
+		item := &shipment{method: http.MethodPost, path: "/write", jsonData: body, acked: make(chan error, 2)}
+		ship("sh1", "Server1", item)
+		items = append(items, item)
+		want = append(want, body)
+	}
+	for i, item := range items {
+		if err := <-item.acked; err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !reflect.DeepEqual(f.received["Server1"], want) {
+		t.Errorf("got %q, want %q", f.received["Server1"], want)
+	}
+}
+
+func TestShipResyncsLaggingSecondary(t *testing.T) {
+	defer func(backlog int) { replicaBacklog = backlog }(replicaBacklog)
+	t.Setenv("SERVER_ID", "Server0")
+	// the secondary cannot catch up at first
+	f := replicasOf(t, map[string]int{"Server1": http.StatusServiceUnavailable})
+	shipped := func(body string) error {
+		item := &shipment{method: http.MethodPost, path: "/write", jsonData: body, acked: make(chan error, 2)}
+		ship("sh1", "Server1", item)
+		return <-item.acked
+	}
+	lagging := func() bool {
+		shippersLock.Lock()
+		defer shippersLock.Unlock()
+		return g_shippers["sh1/Server1"].lagging
+	}
+
+	replicaBacklog = 0
+	if err := shipped("dropped"); err == nil {
+		t.Fatal("request past the backlog was acknowledged")
+	}
+	replicaBacklog = 10
+	if !lagging() {
+		t.Fatal("secondary past the backlog is not catching up")
+	}
+	if err := shipped("while catching up"); err == nil {
+		t.Fatal("request to a catching up secondary was acknowledged")
+	}
+
+	f.mu.Lock()
+	f.statuses["Server1"] = http.StatusOK
+	f.mu.Unlock()
+	for deadline := time.Now().Add(time.Second); lagging(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("secondary never caught up")
+		}
+	}
+	if err := shipped("after catching up"); err != nil {
+		t.Fatalf("request after catching up: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	received := f.received["Server1"]
+	if len(received) < 3 || received[len(received)-1] != "after catching up" {
+		t.Fatalf("got %q, want catch up requests followed by the next write", received)
+	}
+	for _, body := range received[:len(received)-1] {
+		if body != `{"shard":"sh1","primary":"Server0"}` {
+			t.Errorf("got %q, want only catch up requests before the next write", body)
+		}
+	}
+}
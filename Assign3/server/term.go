@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var (
+	// the highest election term seen per shard
+	g_terms   = make(map[string]int)
+	termsLock = &sync.Mutex{}
+)
+
+func termOf(shard_ string) int {
+	termsLock.Lock()
+	defer termsLock.Unlock()
+	return g_terms[shard_]
+}
+
+// observeTerm adopts term if it is newer and reports false if it is stale
+func observeTerm(shard_ string, term int) bool {
+	termsLock.Lock()
+	defer termsLock.Unlock()
+	if term < g_terms[shard_] {
+		return false
+	}
+	g_terms[shard_] = term
+	return true
+}
+
+// checkTerm fences requests routed under an older term than this server has seen, so a
+// deposed primary can neither accept writes nor replicate them. Requests without a Term
+// header are let through.
+func checkTerm(c *gin.Context, shard_ string) bool {
+	header := c.GetHeader("Term")
+	if header == "" {
+		return true
+	}
+	term, err := strconv.Atoi(header)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Term"})
+		return false
+	}
+	if !observeTerm(shard_, term) {
+		log.Printf("Rejecting request for shard %s with stale term %d", shard_, term)
+		c.JSON(http.StatusMisdirectedRequest, gin.H{"error": fmt.Sprintf("stale term %d, shard %s is in term %d", term, shard_, termOf(shard_))})
+		return false
+	}
+	return true
+}
+
+// termHandler takes the term of a new election from the shard manager
+func termHandler(c *gin.Context) {
+	var payload struct {
+		Shard string `json:"shard"`
+		Term  int    `json:"term"`
+	}
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON:%v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	observeTerm(payload.Shard, payload.Term)
+	c.JSON(http.StatusOK, gin.H{"term": termOf(payload.Shard), "status": "success"})
+}
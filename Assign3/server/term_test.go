@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckTerm(t *testing.T) {
+	defer func() {
+		termsLock.Lock()
+		delete(g_terms, "sh1")
+		termsLock.Unlock()
+	}()
+	gin.SetMode(gin.TestMode)
+	// requests arrive in this order, each after the ones above it
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+		status int
+		term   int
+	}{
+		{"no term", "", true, http.StatusOK, 0},
+		{"first term", "2", true, http.StatusOK, 2},
+		{"same term", "2", true, http.StatusOK, 2},
+		{"stale term", "1", false, http.StatusMisdirectedRequest, 2},
+		{"newer term", "5", true, http.StatusOK, 5},
+		{"deposed primary", "2", false, http.StatusMisdirectedRequest, 5},
+		{"garbled", "five", false, http.StatusBadRequest, 5},
+		{"no term after fencing", "", true, http.StatusOK, 5},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/write", nil)
+		if tt.header != "" {
+			c.Request.Header.Set("Term", tt.header)
+		}
+		ok := checkTerm(c, "sh1")
+		if ok != tt.ok || recorder.Code != tt.status {
+			t.Errorf("%s: got %v with status %d, want %v with %d", tt.name, ok, recorder.Code, tt.ok, tt.status)
+		}
+		if term := termOf("sh1"); term != tt.term {
+			t.Errorf("%s: shard is in term %d, want %d", tt.name, term, tt.term)
+		}
+	}
+	// terms are kept per shard
+	if term := termOf("sh2"); term != 0 {
+		t.Errorf("got term %d for another shard", term)
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// prepared rows and decided outcomes of two-phase commit transactions, guarded by indexLock
+var (
+	g_prepared    = make(map[string]map[string][]StudT)
+	g_txn_decided = make(map[string]map[string]string)
+)
+
+// getSecondaries reports whether this server is the primary of the shard along with the
+// other replicas of the shard
+func getSecondaries(shard_ string) ([]string, bool, error) {
+	var mapTs []MapT
+	err := mapdb.Model(&MapT{}).Where("shard_id = ?", shard_).Find(&mapTs).Error
+	if err != nil {
+		return nil, false, err
+	}
+	primary := false
+	var secondaries []string
+	for _, mapT := range mapTs {
+		if mapT.Server_id == os.Getenv("SERVER_ID") {
+			primary = mapT.Primary
+			continue
+		}
+		secondaries = append(secondaries, mapT.Server_id)
+	}
+	return secondaries, primary, nil
+}
+
+// replication is a logged request on its way to the other replicas of its shard
+type replication struct {
+	shard string
+	path  string
+	// the raft entry a majority has to log
+	node  *raftNode
+	index int
+	// the shipments to the secondaries when this server is the primary
+	items []*shipment
+}
+
+// shipToSecondaries queues a request for every secondary, which receive it in parallel
+func shipToSecondaries(shard_ string, secondaries []string, method string, path string, jsonData string, headers map[string]string) []*shipment {
+	items := make([]*shipment, 0, len(secondaries))
+	for _, server := range secondaries {
+		fmt.Printf("\nForwarding to %s\n", server)
+		item := &shipment{method: method, path: path, jsonData: jsonData, headers: headers, acked: make(chan error, 2)}
+		ship(shard_, server, item)
+		items = append(items, item)
+	}
+	return items
+}
+
+// awaitQuorum returns once enough secondaries logged a shipped request to make up the write
+// quorum with the primary. The others keep receiving it in the background.
+func awaitQuorum(ctx context.Context, items []*shipment) error {
+	needed := quorumOf(len(items)+1) - 1
+	acks := make(chan error, len(items))
+	for _, item := range items {
+		item := item
+		go func() {
+			acks <- <-item.acked
+		}()
+	}
+	acked, failed := 0, 0
+	for acked < needed {
+		select {
+		case err := <-acks:
+			if err == nil {
+				acked++
+				continue
+			}
+			failed++
+			if len(items)-failed < needed {
+				return fmt.Errorf("write quorum of %d replicas not reached: %w", needed+1, err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// startReplication queues a logged request for the other replicas of its shard while the
+// shard order lock is held, so they see the entries in log order. A raft shard only notes
+// the entry its leader waits for. It answers 500 itself and returns nil when the replicas
+// are unknown.
+func startReplication(c *gin.Context, shard_ string, method string, path string, jsonData string, headers map[string]string) *replication {
+	r := &replication{shard: shard_, path: path}
+	if node := raftOf(shard_); node != nil {
+		r.node = node
+		indexLock.Lock()
+		if logT, ok := g_shard_log_map[shard_]; ok {
+			r.index = logT.lastIndex()
+		}
+		indexLock.Unlock()
+		return r
+	}
+	secondaries, primary, err := getSecondaries(shard_)
+	if err != nil {
+		log.Printf("Error getting primary server for shard %s:%v", shard_, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil
+	}
+	if !primary {
+		return r
+	}
+	log.Printf("Forwarding %s to secondary servers for shard:%s\n", path, shard_)
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	if requestId := c.GetHeader("Request-Id"); requestId != "" {
+		headers["Request-Id"] = requestId
+	}
+	if term := termOf(shard_); term > 0 {
+		headers["Term"] = strconv.Itoa(term)
+	}
+	r.items = shipToSecondaries(shard_, secondaries, method, path, jsonData, headers)
+	return r
+}
+
+// await waits for the replicas the request needs, answering 503 or 504 itself if too few of
+// them could be reached for the write quorum. The entry stays logged, so the caller's retry
+// lands on the old request path and forwards it again. It needs no lock, so the next request
+// of the shard can be logged meanwhile.
+func (r *replication) await(c *gin.Context) bool {
+	// a raft shard is replicated by its leader, the request waits for a majority to log it
+	if r.node != nil {
+		err := r.node.awaitCommit(c.Request.Context(), r.index)
+		if errors.Is(err, errNotLeader) {
+			c.JSON(http.StatusMisdirectedRequest, gin.H{"error": err.Error()})
+			return false
+		}
+		if err != nil {
+			log.Printf("Error committing to shard %s:%v", r.shard, err)
+			c.JSON(retryStatus(err), gin.H{"error": err.Error()})
+			return false
+		}
+		return true
+	}
+	if len(r.items) == 0 {
+		return true
+	}
+	err := awaitQuorum(c.Request.Context(), r.items)
+	if err != nil {
+		log.Printf("Error replicating to secondaries of shard %s:%v", r.shard, err)
+		c.JSON(retryStatus(err), gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// commitLogged finishes a request whose entry the handler just logged and queued for the
+// replicas, pending being nil when that failed and was answered already. It releases the
+// shard order lock first: the entry holds its place in the log and in every shipping queue,
+// so the next request of the shard can be logged while this one waits. Concurrent writers
+// share the sync that puts their records on disk, then the entry waits for the replicas it
+// needs and is applied. It returns the index the shard applied up to, or answers the failure
+// itself.
+func commitLogged(c *gin.Context, logT *LogT, pending *replication, release func()) (int, bool) {
+	release()
+	if pending == nil {
+		return 0, false
+	}
+	err := logT.awaitSync()
+	if err != nil {
+		log.Printf("Error syncing log for shard %s:%v", logT.shard, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if !pending.await(c) {
+		return 0, false
+	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	err = executeFromLog(logT.shard)
+	if err != nil {
+		log.Printf("Error executing from log for shard %s:%v", logT.shard, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	return *logT.index, true
+}
+
+// replicate forwards a logged request to the other replicas of its shard and waits for them
+func replicate(c *gin.Context, shard_ string, method string, path string, jsonData string, headers map[string]string) bool {
+	r := startReplication(c, shard_, method, path, jsonData, headers)
+	return r != nil && r.await(c)
+}
+
+func setDecided(shard_ string, tx_id string, outcome string) {
+	if g_txn_decided[shard_] == nil {
+		g_txn_decided[shard_] = make(map[string]string)
+	}
+	g_txn_decided[shard_][tx_id] = outcome
+	delete(g_prepared[shard_], tx_id)
+}
+
+// trackTxn follows the transaction records appended to the log
+func trackTxn(shard_ string, logItem logPayload) {
+	switch logItem.Operation {
+	case "p":
+		if g_prepared[shard_] == nil {
+			g_prepared[shard_] = make(map[string][]StudT)
+		}
+		g_prepared[shard_][logItem.Tx_id] = logItem.W_Data
+	case "c", "a":
+		setDecided(shard_, logItem.Tx_id, logItem.Operation)
+	}
+}
+
+// loadTxns rebuilds the transaction state of a shard from its log after it was copied
+func loadTxns(shard_ string) error {
+	g_prepared[shard_] = make(map[string][]StudT)
+	g_txn_decided[shard_] = make(map[string]string)
+	// the entries compacted into a snapshot left their state in it
+	if snapshot := g_shard_log_map[shard_].snapshot; snapshot != nil {
+		for tx_id, data := range snapshot.Prepared {
+			g_prepared[shard_][tx_id] = data
+		}
+		for tx_id, outcome := range snapshot.Decided {
+			g_txn_decided[shard_][tx_id] = outcome
+		}
+	}
+	logT := g_shard_log_map[shard_]
+	return logT.each(logT.base+1, logT.lastIndex(), func(_ int, record []byte) error {
+		var logItem logPayload
+		err := json.Unmarshal(record, &logItem)
+		if err != nil {
+			return err
+		}
+		trackTxn(shard_, logItem)
+		return nil
+	})
+}
+
+// findConflicts lists the ids of a prepared batch that already exist in the shard, are held
+// by another prepared transaction or repeat within the batch
+func findConflicts(shard_ string, data []StudT) ([]int, error) {
+	var ids []int
+	for _, row := range data {
+		ids = append(ids, row.Stud_id)
+	}
+	var existing []int
+	err := db.Table(shard_).Where("stud_id IN ?", ids).Pluck("stud_id", &existing).Error
+	if err != nil {
+		return nil, err
+	}
+	held := preparedIds(shard_)
+	seen := make(map[int]bool)
+	conflicts := existing
+	for _, id := range ids {
+		if held[id] || seen[id] {
+			conflicts = append(conflicts, id)
+		}
+		seen[id] = true
+	}
+	return conflicts, nil
+}
+
+// preparedIds is the set of Stud_ids the prepared transactions of a shard hold. indexLock is
+// held.
+func preparedIds(shard_ string) map[int]bool {
+	held := make(map[int]bool)
+	for _, rows := range g_prepared[shard_] {
+		for _, row := range rows {
+			held[row.Stud_id] = true
+		}
+	}
+	return held
+}
+
+// refuseHeld answers 409 when a write, update or delete touches a Stud_id a prepared
+// transaction holds, whose commit would otherwise collide with it. Requests a primary
+// forwarded were checked there already. indexLock is held.
+func refuseHeld(c *gin.Context, shard_ string, ids []int) bool {
+	if c.GetHeader("Sequence") != "" {
+		return false
+	}
+	held := preparedIds(shard_)
+	conflicts := make([]int, 0)
+	for _, id := range ids {
+		if held[id] {
+			conflicts = append(conflicts, id)
+		}
+	}
+	if len(conflicts) == 0 {
+		return false
+	}
+	// the rows are free again once the transaction is decided
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusConflict, gin.H{"message": "Stud_id held by a prepared transaction", "conflicts": conflicts, "status": "failure"})
+	return true
+}
+
+// replayCommit inserts the rows of a committed transaction. Nothing else may take the rows a
+// transaction holds, so one already in the table was put there by this commit, replayed again
+// over a snapshot that holds it.
+func replayCommit(tx *gorm.DB, shard_ string, rows []StudT) error {
+	ids := make([]int, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.Stud_id)
+	}
+	var existing []StudT
+	err := tx.Table(shard_).Where("Stud_id IN ?", ids).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	missing, err := committedRows(rows, existing)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+	return tx.Table(shard_).Create(&missing).Error
+}
+
+// committedRows is the rows of a commit still missing from the table. A row already there
+// counts as applied when it holds the committed data or was updated since, any other row
+// collides with the commit.
+func committedRows(rows []StudT, existing []StudT) ([]StudT, error) {
+	present := make(map[int]StudT, len(existing))
+	for _, row := range existing {
+		present[row.Stud_id] = row
+	}
+	missing := make([]StudT, 0, len(rows))
+	for _, row := range rows {
+		current, ok := present[row.Stud_id]
+		if !ok {
+			missing = append(missing, row)
+			continue
+		}
+		if current.Version > row.Version || current.Stud_name == row.Stud_name && current.Stud_marks == row.Stud_marks {
+			continue
+		}
+		return nil, fmt.Errorf("committed Stud_id %d collides with a different row", row.Stud_id)
+	}
+	return missing, nil
+}
+
+func decodeTxn(c *gin.Context) (txnPayload, string, bool) {
+	var payload txnPayload
+	if !configDone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Configuration not done"})
+		return payload, "", false
+	}
+	jsonData := getJSONstring(c)
+	err := json.Unmarshal([]byte(jsonData), &payload)
+	if err != nil {
+		log.Printf("Error decoding JSON: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return payload, "", false
+	}
+	if _, ok := g_shard_log_map[payload.Shard]; !ok || payload.Tx_id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shard does not exist"})
+		return payload, "", false
+	}
+	countRequest(payload.Shard)
+	return payload, jsonData, true
+}
+
+// prepareHandler logs the rows of a transaction without applying them. The primary votes no
+// with 409 if any row conflicts, secondaries accept whatever their primary prepared.
+func prepareHandler(c *gin.Context) {
+	payload, jsonData, ok := decodeTxn(c)
+	if !ok {
+		return
+	}
+	shard_ := payload.Shard
+	release := lockShardOrder(shard_)
+	defer release()
+	if !checkReady(c, shard_) {
+		return
+	}
+	if !checkTerm(c, shard_) {
+		return
+	}
+	if !checkLeader(c, shard_) {
+		return
+	}
+	_, primary, err := getSecondaries(shard_)
+	if err != nil {
+		log.Printf("Error getting primary server for shard %s:%v", shard_, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	indexLock.Lock()
+	if outcome, ok := g_txn_decided[shard_][payload.Tx_id]; ok {
+		indexLock.Unlock()
+		if outcome == "c" {
+			c.JSON(http.StatusOK, gin.H{"message": "Transaction committed", "status": "success"})
+		} else {
+			c.JSON(http.StatusConflict, gin.H{"message": "Transaction aborted", "status": "failure"})
+		}
+		return
+	}
+	if _, ok := g_prepared[shard_][payload.Tx_id]; ok {
+		indexLock.Unlock()
+		if !replicate(c, shard_, http.MethodPost, "/prepare", jsonData, nil) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Transaction prepared", "status": "success"})
+		return
+	}
+	if primary {
+		// apply everything logged so far so the conflict check sees the latest rows
+		err = executeFromLog(shard_)
+		if err != nil {
+			indexLock.Unlock()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		conflicts, err := findConflicts(shard_, payload.Data)
+		if err != nil {
+			indexLock.Unlock()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(conflicts) != 0 {
+			indexLock.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"message": "Stud_id already exists", "conflicts": conflicts, "status": "failure"})
+			return
+		}
+	}
+	err = writeToLog(logPayload{Operation: "p", W_Data: payload.Data, Tx_id: payload.Tx_id}, shard_)
+	if err != nil {
+		indexLock.Unlock()
+		log.Printf("Error writing to log for shard %s:%v", shard_, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if g_prepared[shard_] == nil {
+		g_prepared[shard_] = make(map[string][]StudT)
+	}
+	g_prepared[shard_][payload.Tx_id] = payload.Data
+	logT := g_shard_log_map[shard_]
+	indexLock.Unlock()
+
+	pending := startReplication(c, shard_, http.MethodPost, "/prepare", jsonData, nil)
+	if _, ok := commitLogged(c, logT, pending, release); !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Transaction prepared", "status": "success"})
+}
+
+// commitHandler applies the rows prepared by the transaction
+func commitHandler(c *gin.Context) {
+	payload, jsonData, ok := decodeTxn(c)
+	if !ok {
+		return
+	}
+	shard_ := payload.Shard
+	release := lockShardOrder(shard_)
+	defer release()
+	if !checkReady(c, shard_) {
+		return
+	}
+	if !checkTerm(c, shard_) {
+		return
+	}
+	if !checkLeader(c, shard_) {
+		return
+	}
+	indexLock.Lock()
+	if outcome, ok := g_txn_decided[shard_][payload.Tx_id]; ok {
+		indexLock.Unlock()
+		if outcome == "c" {
+			if !replicate(c, shard_, http.MethodPost, "/commit", jsonData, nil) {
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Transaction committed", "status": "success"})
+		} else {
+			c.JSON(http.StatusConflict, gin.H{"message": "Transaction aborted", "status": "failure"})
+		}
+		return
+	}
+	data, ok := g_prepared[shard_][payload.Tx_id]
+	if !ok {
+		indexLock.Unlock()
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Transaction not prepared", "status": "failure"})
+		return
+	}
+	err := writeToLog(logPayload{Operation: "c", W_Data: data, Tx_id: payload.Tx_id}, shard_)
+	if err != nil {
+		indexLock.Unlock()
+		log.Printf("Error writing to log for shard %s:%v", shard_, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	setDecided(shard_, payload.Tx_id, "c")
+	logT := g_shard_log_map[shard_]
+	indexLock.Unlock()
+
+	pending := startReplication(c, shard_, http.MethodPost, "/commit", jsonData, nil)
+	index, ok := commitLogged(c, logT, pending, release)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Transaction committed", "index": index, "status": "success"})
+}
+
+// abortHandler drops the rows prepared by the transaction. Aborting a transaction that was
+// never prepared here is recorded as well so a late prepare is refused.
+func abortHandler(c *gin.Context) {
+	payload, jsonData, ok := decodeTxn(c)
+	if !ok {
+		return
+	}
+	shard_ := payload.Shard
+	release := lockShardOrder(shard_)
+	defer release()
+	if !checkReady(c, shard_) {
+		return
+	}
+	if !checkTerm(c, shard_) {
+		return
+	}
+	if !checkLeader(c, shard_) {
+		return
+	}
+	indexLock.Lock()
+	if outcome, ok := g_txn_decided[shard_][payload.Tx_id]; ok {
+		indexLock.Unlock()
+		if outcome == "a" {
+			if !replicate(c, shard_, http.MethodPost, "/abort", jsonData, nil) {
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Transaction aborted", "status": "success"})
+		} else {
+			c.JSON(http.StatusConflict, gin.H{"message": "Transaction already committed", "status": "failure"})
+		}
+		return
+	}
+	err := writeToLog(logPayload{Operation: "a", Tx_id: payload.Tx_id}, shard_)
+	if err != nil {
+		indexLock.Unlock()
+		log.Printf("Error writing to log for shard %s:%v", shard_, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	setDecided(shard_, payload.Tx_id, "a")
+	logT := g_shard_log_map[shard_]
+	indexLock.Unlock()
+
+	pending := startReplication(c, shard_, http.MethodPost, "/abort", jsonData, nil)
+	if _, ok := commitLogged(c, logT, pending, release); !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Transaction aborted", "status": "success"})
+}
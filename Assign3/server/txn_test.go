@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// logOf gives shard_ a log holding entries
+func logOf(t *testing.T, shard_ string, entries []logPayload) {
+	t.Helper()
+	logFrom(t, shard_, 0, entries)
+}
+
+// logFrom gives shard_ a log compacted up to base holding entries after it
+func logFrom(t *testing.T, shard_ string, base int, entries []logPayload) {
+	t.Helper()
+	l := testLog(t, base, base+1)
+	for _, entry := range entries {
+		jsonData, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = l.Write(entry.Raft_term, jsonData)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	g_shard_log_map[shard_] = l
+	t.Cleanup(func() { delete(g_shard_log_map, shard_) })
+}
+
+func TestLoadTxns(t *testing.T) {
+	rows := []StudT{{Stud_id: 1, Stud_name: "a"}, {Stud_id: 2, Stud_name: "b"}}
+	tests := []struct {
+		name     string
+		entries  []logPayload
+		prepared map[string][]StudT
+		decided  map[string]string
+	}{
+		{"empty log", nil, map[string][]StudT{}, map[string]string{}},
+		{
+			name:     "prepared only",
+			entries:  []logPayload{{Operation: "w", W_Data: rows}, {Operation: "p", Tx_id: "t1", W_Data: rows}},
+			prepared: map[string][]StudT{"t1": rows},
+			decided:  map[string]string{},
+		},
+		{
+			name: "committed and aborted",
+			entries: []logPayload{
+				{Operation: "p", Tx_id: "t1", W_Data: rows[:1]},
+				{Operation: "p", Tx_id: "t2", W_Data: rows[1:]},
+				{Operation: "c", Tx_id: "t1"},
+				{Operation: "a", Tx_id: "t2"},
+			},
+			prepared: map[string][]StudT{},
+			decided:  map[string]string{"t1": "c", "t2": "a"},
+		},
+		{
+			name: "one still in doubt",
+			entries: []logPayload{
+				{Operation: "p", Tx_id: "t1", W_Data: rows[:1]},
+				{Operation: "p", Tx_id: "t2", W_Data: rows[1:]},
+				{Operation: "c", Tx_id: "t2"},
+			},
+			prepared: map[string][]StudT{"t1": rows[:1]},
+			decided:  map[string]string{"t2": "c"},
+		},
+		{
+			name:     "aborted without a prepare",
+			entries:  []logPayload{{Operation: "a", Tx_id: "t1"}},
+			prepared: map[string][]StudT{},
+			decided:  map[string]string{"t1": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logOf(t, "sh1", tt.entries)
+			// state left from before the log was copied is dropped
+			g_prepared["sh1"] = map[string][]StudT{"old": rows}
+			err := loadTxns("sh1")
+			if err != nil {
+				t.Fatalf("loadTxns: %v", err)
+			}
+			if !reflect.DeepEqual(g_prepared["sh1"], tt.prepared) {
+				t.Errorf("got prepared %v, want %v", g_prepared["sh1"], tt.prepared)
+			}
+			if !reflect.DeepEqual(g_txn_decided["sh1"], tt.decided) {
+				t.Errorf("got decided %v, want %v", g_txn_decided["sh1"], tt.decided)
+			}
+		})
+	}
+}
+
+func TestRefuseHeld(t *testing.T) {
+	defer delete(g_prepared, "sh1")
+	g_prepared["sh1"] = map[string][]StudT{"t1": {{Stud_id: 3}, {Stud_id: 4}}, "t2": {{Stud_id: 9}}}
+	tests := []struct {
+		name      string
+		ids       []int
+		forwarded bool
+		conflicts []int
+	}{
+		{"free rows", []int{1, 2}, false, nil},
+		{"one row held", []int{1, 4}, false, []int{4}},
+		{"rows of two transactions", []int{9, 3}, false, []int{9, 3}},
+		{"forwarded by the primary", []int{4}, true, nil},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPost, "/write", nil)
+			if tt.forwarded {
+				c.Request.Header.Set("Sequence", "5")
+			}
+			refused := refuseHeld(c, "sh1", tt.ids)
+			if refused != (tt.conflicts != nil) {
+				t.Fatalf("got refused %v, want %v", refused, tt.conflicts != nil)
+			}
+			if !refused {
+				return
+			}
+			var response struct{ Conflicts []int }
+			err := json.Unmarshal(recorder.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recorder.Code != http.StatusConflict || !reflect.DeepEqual(response.Conflicts, tt.conflicts) {
+				t.Errorf("got %d with conflicts %v, want 409 with %v", recorder.Code, response.Conflicts, tt.conflicts)
+			}
+			// the balancer does not store the refusal under the Idempotency-Key
+			if recorder.Header().Get("Retry-After") == "" {
+				t.Error("refusal carries no Retry-After")
+			}
+		})
+	}
+}
+
+func TestCommittedRows(t *testing.T) {
+	rows := []StudT{{Stud_id: 1, Stud_name: "a", Stud_marks: 10, Version: 1}, {Stud_id: 2, Stud_name: "b", Stud_marks: 20, Version: 1}}
+	tests := []struct {
+		name     string
+		existing []StudT
+		missing  []StudT
+		err      bool
+	}{
+		{"none applied", nil, rows, false},
+		{"applied already", []StudT{{Stud_id: 1, Stud_name: "a", Stud_marks: 10, Version: 1}, {Stud_id: 2, Stud_name: "b", Stud_marks: 20, Version: 1}}, []StudT{}, false},
+		{"one row in the snapshot", []StudT{{Stud_id: 2, Stud_name: "b", Stud_marks: 20, Version: 1}}, rows[:1], false},
+		{"updated since", []StudT{{Stud_id: 1, Stud_name: "a", Stud_marks: 55, Version: 3}}, rows[1:], false},
+		{"another row", []StudT{{Stud_id: 1, Stud_name: "x", Stud_marks: 10, Version: 1}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing, err := committedRows(rows, tt.existing)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want one: %v", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("got %+v, want %+v", missing, tt.missing)
+			}
+		})
+	}
+}
+
+func TestCommitLoggedFailures(t *testing.T) {
+	defer func(quorum string) { writeQuorum = quorum }(writeQuorum)
+	writeQuorum = "all"
+	tests := []struct {
+		name string
+		// servers the entry was shipped to, nil when starting the replication failed
+		shipped []string
+		status  int
+	}{
+		{"replication never started", nil, http.StatusOK},
+		{"quorum not reached", []string{"Server1", "Server2"}, http.StatusServiceUnavailable},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logOf(t, "sh1", []logPayload{{Operation: "w"}})
+			replicasOf(t, map[string]int{"Server1": http.StatusOK})
+			var pending *replication
+			if tt.shipped != nil {
+				pending = &replication{shard: "sh1", path: "/write", items: shipToSecondaries("sh1", tt.shipped, http.MethodPost, "/write", "{}", nil)}
+			}
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPost, "/write", nil)
+			release := lockShardOrder("sh1")
+			defer release()
+			if _, ok := commitLogged(c, g_shard_log_map["sh1"], pending, release); ok {
+				t.Fatal("failed request was committed")
+			}
+			if recorder.Code != tt.status {
+				t.Errorf("got status %d, want %d", recorder.Code, tt.status)
+			}
+			// the next request of the shard does not wait for this one
+			taken := make(chan bool)
+			go func() {
+				lockShardOrder("sh1")()
+				taken <- true
+			}()
+			select {
+			case <-taken:
+			case <-time.After(time.Second):
+				t.Fatal("shard order lock still held")
+			}
+		})
+	}
+}
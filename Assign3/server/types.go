@@ -6,6 +6,7 @@ type StudT struct {
 	Stud_id    int `gorm:"primaryKey"`
 	Stud_name  string
 	Stud_marks int
+	Version    int
 }
 
 type MapT struct {
@@ -13,34 +14,116 @@ type MapT struct {
 	Server_id string
 	Primary   bool
 }
+
+// IndexT declares a secondary index on a column of the student table
+type IndexT struct {
+	Column string `gorm:"primaryKey"`
+}
+
+// LogT is the WAL of a shard, kept in segment files with the position of every entry after
+// base in memory
 type LogT struct {
-	file      *os.File
-	data      []byte
-	index     *int
-	indexFile *os.File
+	shard    string
+	segments []*segment
+	offsets  []entryPos
+	index    *int
+	// records written but not yet synced
+	sync *walSync
+	// entries compacted into a checkpoint or snapshot, offsets[0] is entry base+1
+	base int
+	// what the compacted entries left besides the rows, nil while nothing was compacted
+	snapshot *shardSnapshot
 }
 
-func (l *LogT) Write(data []byte) error {
-	l.data = append(l.data, data...)
-	_, err := l.file.Write(data)
-	if err != nil {
-		return err
-	}
-	return nil
+// segment is one file of a WAL holding the entries from first on
+type segment struct {
+	first int
+	path  string
+	file  *os.File
+	size  int64
+}
+
+// entryPos locates an entry in the segments of a WAL
+type entryPos struct {
+	seg    *segment
+	offset int64
+	length int
 }
 
 type configPayload struct {
 	Shards []string `json:"shards" binding:"required"`
+	// replication mode of the shards that are not replicated by their primary
+	Modes map[string]string `json:"modes"`
 }
 
 type readPayload struct {
 	Shard   string         `json:"shard" binding:"required"`
 	Stud_id map[string]int `json:"Stud_id" binding:"required"`
+	Limit   int            `json:"limit"`
+}
+
+type predicate struct {
+	Column string      `json:"column" binding:"required"`
+	Op     string      `json:"op" binding:"required"`
+	Value  interface{} `json:"value" binding:"required"`
+}
+
+type queryPayload struct {
+	Shard    string      `json:"shard" binding:"required"`
+	Where    []predicate `json:"where"`
+	Select   []string    `json:"select"`
+	Order_by string      `json:"order_by"`
+	Desc     bool        `json:"desc"`
+	Limit    int         `json:"limit"`
+}
+
+type lookupPayload struct {
+	Shard  string      `json:"shard" binding:"required"`
+	Column string      `json:"column" binding:"required"`
+	Value  interface{} `json:"value" binding:"required"`
+}
+
+type aggregatePayload struct {
+	Shard    string      `json:"shard" binding:"required"`
+	Where    []predicate `json:"where"`
+	Group_by []string    `json:"group_by"`
+	Columns  []string    `json:"columns"`
+}
+
+// aggregatePartial is the aggregate of one group on one shard
+type aggregatePartial struct {
+	Key   map[string]interface{}
+	Count int64
+	Sum   map[string]float64
+	Min   map[string]float64
+	Max   map[string]float64
+}
+
+type catchupPayload struct {
+	Shard string `json:"shard" binding:"required"`
+	From  int    `json:"from"`
+	Limit int    `json:"limit"`
+}
+
+// resyncPayload asks a secondary to catch up from its primary
+type resyncPayload struct {
+	Shard   string `json:"shard" binding:"required"`
+	Primary string `json:"primary" binding:"required"`
+}
+
+// catchupResponse holds the entries after the one a replica asked from and the index of the
+// primary's latest entry
+type catchupResponse struct {
+	Entries    []logPayload
+	Last_index int
 }
 
-type copyPayload struct {
+type snapshotPayload struct {
 	Shard string `json:"shard" binding:"required"`
+	After int    `json:"after"`
+	Limit int    `json:"limit"`
 }
+
 type writePayload struct {
 	Shard string  `json:"shard" binding:"required"`
 	Data  []StudT `json:"data" binding:"required"`
@@ -57,4 +140,90 @@ type logPayload struct {
 	W_Data     []StudT
 	UD_Stud_id int
 	U_Data     StudT
+	Tx_id      string `json:",omitempty"`
+	Seq        int    `json:",omitempty"`
+	Request_id string `json:",omitempty"`
+	Raft_term  int    `json:",omitempty"`
+}
+
+type txnPayload struct {
+	Shard string  `json:"shard" binding:"required"`
+	Tx_id string  `json:"tx_id" binding:"required"`
+	Data  []StudT `json:"data"`
+}
+
+type shardStats struct {
+	Requests int
+	Rows     int
+}
+
+// walReport is what /metrics says about the WAL of a server
+type walReport struct {
+	Sync_mode        string
+	Records          int64
+	Bytes            int64
+	Records_per_sec  float64
+	Bytes_per_sec    float64
+	Fsyncs           int64
+	Records_per_sync float64
+	Fsync_avg_ms     float64
+	Fsync_max_ms     float64
+}
+
+type raftVoteRequest struct {
+	Shard      string
+	Term       int
+	Candidate  string
+	Last_index int
+	Last_term  int
+}
+
+type raftVoteReply struct {
+	Term    int
+	Granted bool
+}
+
+type raftAppendRequest struct {
+	Shard         string
+	Term          int
+	Leader        string
+	Prev_index    int
+	Prev_term     int
+	Entries       []logPayload
+	Leader_commit int
+}
+
+// raftAppendReply carries the last index of the follower's log so the leader can skip back
+// over a missing tail in one step
+type raftAppendReply struct {
+	Term       int
+	Success    bool
+	Last_index int
+}
+
+// shardSnapshot is the state of a shard after applying every entry up to Index, Term is the
+// raft term of that entry
+type shardSnapshot struct {
+	Index    int
+	Term     int
+	Rows     []StudT
+	Prepared map[string][]StudT
+	Decided  map[string]string
+	Last_seq int
+	// the sequences within the dedupe window, so resends of compacted entries are recognised
+	Recent []sequenceRecord
+}
+
+type sequenceRecord struct {
+	Seq     int
+	Index   int
+	Request string
+	Version int
+}
+
+type raftSnapshotRequest struct {
+	Shard    string
+	Term     int
+	Leader   string
+	Snapshot shardSnapshot
 }
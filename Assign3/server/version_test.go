@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckIfMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch string
+		found   bool
+		version int
+		ok      bool
+		status  int
+	}{
+		{"no If-Match", "", true, 3, true, http.StatusOK},
+		{"no If-Match and no row", "", false, 0, true, http.StatusOK},
+		{"matching version", "3", true, 3, true, http.StatusOK},
+		{"quoted version", `"3"`, true, 3, true, http.StatusOK},
+		{"stale version", "2", true, 3, false, http.StatusConflict},
+		{"missing row", "1", false, 0, false, http.StatusConflict},
+		{"not a number", "v3", true, 3, false, http.StatusBadRequest},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPut, "/update", nil)
+			if tt.ifMatch != "" {
+				c.Request.Header.Set("If-Match", tt.ifMatch)
+			}
+			ok := checkIfMatch(c, 1, tt.found, tt.version)
+			if ok != tt.ok || recorder.Code != tt.status {
+				t.Errorf("got %v with status %d, want %v with %d", ok, recorder.Code, tt.ok, tt.status)
+			}
+		})
+	}
+}
+
+func TestForwardedVersion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name    string
+		header  string
+		version int
+		ok      bool
+	}{
+		{"forwarded by the primary", "4", 4, true},
+		{"first version", "0", 0, true},
+		{"garbled", "four", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPut, "/update", nil)
+			c.Request.Header.Set("Row-Version", tt.header)
+			// a secondary trusts the version and never looks at If-Match
+			c.Request.Header.Set("If-Match", "1")
+			version, ok := resolveVersion(c, "sh1", 1)
+			if version != tt.version || ok != tt.ok {
+				t.Errorf("got %d, %v, want %d, %v", version, ok, tt.version, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	// where a server keeps the logs, checkpoints and raft state of its shards, a volume that
+	// outlives the container
+	dataDir = "/data"
+	// a WAL segment is closed and a new one started once it grows past this size
+	segmentBytes = int64(envInt("WAL_SEGMENT_BYTES", 4<<20))
+	// applied entries a shard keeps in its log before a checkpoint truncates them
+	checkpointEntries = envInt("CHECKPOINT_ENTRIES", 1000)
+	// how often a server looks for entries every replica of its shards has applied
+	checkpointInterval = time.Duration(envInt("CHECKPOINT_INTERVAL_S", 30)) * time.Second
+	// replicas are asked once per round, an unreachable one only delays the checkpoint
+	appliedCall = retryPolicy{attempts: 1, callTimeout: 5 * time.Second}
+)
+
+// a record is framed by the length of its payload, a CRC of everything after the CRC, the raft
+// term and the index of the entry, all big-endian
+const recordHeader = 24
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// a record that was cut short or does not match its CRC
+	errTornRecord = errors.New("torn WAL record")
+)
+
+func encodeRecord(index int, term int, payload []byte) []byte {
+	record := make([]byte, recordHeader+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[8:16], uint64(term))
+	binary.BigEndian.PutUint64(record[16:24], uint64(index))
+	copy(record[recordHeader:], payload)
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], crcTable))
+	return record
+}
+
+// decodeRecord checks the record at the start of data and returns its index, term and payload
+// along with its full length
+func decodeRecord(data []byte) (int, int, []byte, int, error) {
+	if len(data) < recordHeader {
+		return 0, 0, nil, 0, errTornRecord
+	}
+	length := recordHeader + int(binary.BigEndian.Uint32(data[0:4]))
+	if len(data) < length || crc32.Checksum(data[8:length], crcTable) != binary.BigEndian.Uint32(data[4:8]) {
+		return 0, 0, nil, 0, errTornRecord
+	}
+	term := int(binary.BigEndian.Uint64(data[8:16]))
+	index := int(binary.BigEndian.Uint64(data[16:24]))
+	return index, term, data[recordHeader:length], length, nil
+}
+
+func segmentPath(shard_ string, first int) string {
+	return filepath.Join(dataDir, fmt.Sprintf("%s_%010d.wal", shard_, first))
+}
+
+func checkpointPath(shard_ string) string {
+	return filepath.Join(dataDir, shard_+"_checkpoint.json")
+}
+
+func indexPath(shard_ string) string {
+	return filepath.Join(dataDir, shard_+"_index.log")
+}
+
+// saveIndex records how far the log of a shard has been applied
+func saveIndex(shard_ string, index int) error {
+	return replaceFile(indexPath(shard_), []byte(fmt.Sprintf("%v", index)))
+}
+
+// removeSegments deletes the WAL files of a shard
+func removeSegments(shard_ string) {
+	paths, _ := filepath.Glob(filepath.Join(dataDir, shard_+"_[0-9]*.wal"))
+	for _, path := range paths {
+		_ = os.Remove(path)
+	}
+}
+
+// openLog starts an empty WAL for a shard, dropping the files of an earlier copy
+func openLog(shard_ string) (*LogT, error) {
+	removeSegments(shard_)
+	_ = os.Remove(checkpointPath(shard_))
+	_ = os.Remove(raftFile(shard_, "snapshot"))
+	l := &LogT{shard: shard_, index: new(int), sync: newWalSync()}
+	err := saveIndex(shard_, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = l.roll(1)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// loadLog opens the WAL a shard left in /data, starting after base. The first record that is
+// cut short or fails its CRC ends the log: the segment is truncated there and any later
+// segments are dropped, since a crash can only have torn the tail.
+func loadLog(shard_ string, base int) (*LogT, error) {
+	paths, err := filepath.Glob(filepath.Join(dataDir, shard_+"_[0-9]*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	// zero-padded names sort by their first index
+	sort.Strings(paths)
+	l := &LogT{shard: shard_, index: new(int), base: base, sync: newWalSync()}
+	torn := false
+	for _, path := range paths {
+		var first int
+		_, err = fmt.Sscanf(filepath.Base(path), shard_+"_%d.wal", &first)
+		if err != nil {
+			continue
+		}
+		if torn || first > l.lastIndex()+1 {
+			log.Printf("Dropping WAL segment %s after the end of shard %s", path, shard_)
+			_ = os.Remove(path)
+			continue
+		}
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0777)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		seg := &segment{first: first, path: path, file: file}
+		torn, err = l.scan(seg)
+		if err != nil {
+			_ = file.Close()
+			l.close()
+			return nil, err
+		}
+		l.segments = append(l.segments, seg)
+	}
+	if len(l.segments) == 0 {
+		err = l.roll(base + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// scan records the position of every entry in a segment, skipping those up to base, and
+// truncates the segment at the first torn record. It reports whether it found one.
+func (l *LogT) scan(seg *segment) (bool, error) {
+	data, err := io.ReadAll(seg.file)
+	if err != nil {
+		return false, err
+	}
+	var offset int64
+	expected := seg.first
+	for offset < int64(len(data)) {
+		index, _, _, length, err := decodeRecord(data[offset:])
+		if err == nil && index != expected {
+			err = fmt.Errorf("record %d where %d was expected", index, expected)
+		}
+		if err != nil {
+			log.Printf("Truncating torn tail of %s at byte %d:%v", seg.path, offset, err)
+			err = seg.file.Truncate(offset)
+			if err != nil {
+				return true, err
+			}
+			seg.size = offset
+			return true, nil
+		}
+		if index > l.base {
+			l.offsets = append(l.offsets, entryPos{seg: seg, offset: offset, length: length})
+		}
+		offset += int64(length)
+		expected++
+	}
+	seg.size = offset
+	return false, nil
+}
+
+// roll starts a new segment whose first entry will be first
+func (l *LogT) roll(first int) error {
+	path := segmentPath(l.shard, first)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, &segment{first: first, path: path, file: file})
+	return nil
+}
+
+// Write appends one entry to the last segment, rolling over to a new one when it is full. A
+// record only partly written is cut off again, so the next one starts on a clean tail.
+func (l *LogT) Write(term int, payload []byte) error {
+	current := l.segments[len(l.segments)-1]
+	if current.size >= segmentBytes {
+		err := l.roll(l.lastIndex() + 1)
+		if err != nil {
+			return err
+		}
+		current = l.segments[len(l.segments)-1]
+	}
+	data := encodeRecord(l.lastIndex()+1, term, payload)
+	_, err := current.file.Write(data)
+	if err != nil {
+		_ = current.file.Truncate(current.size)
+		return err
+	}
+	l.offsets = append(l.offsets, entryPos{seg: current, offset: current.size, length: len(data)})
+	current.size += int64(len(data))
+	g_wal_metrics.wrote(len(data))
+	return l.sync.appended(current.file)
+}
+
+// lastIndex is the index of the latest entry, counting compacted ones
+func (l *LogT) lastIndex() int {
+	return l.base + len(l.offsets)
+}
+
+// record reads and checks the record of the entry at index, returning its term and payload
+func (l *LogT) record(index int) (int, []byte, error) {
+	if index <= l.base || index > l.lastIndex() {
+		return 0, nil, fmt.Errorf("entry %d of shard %s is not in the log (%d-%d)", index, l.shard, l.base+1, l.lastIndex())
+	}
+	pos := l.offsets[index-l.base-1]
+	data := make([]byte, pos.length)
+	_, err := pos.seg.file.ReadAt(data, pos.offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	found, term, payload, _, err := decodeRecord(data)
+	if err == nil && found != index {
+		err = fmt.Errorf("record %d where %d was expected", found, index)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("entry %d of shard %s: %w", index, l.shard, err)
+	}
+	return term, payload, nil
+}
+
+// entry reads the payload of the entry at index from its segment
+func (l *LogT) entry(index int) ([]byte, error) {
+	_, payload, err := l.record(index)
+	return payload, err
+}
+
+// termOf reads the raft term the entry at index was logged in
+func (l *LogT) termOf(index int) (int, error) {
+	term, _, err := l.record(index)
+	return term, err
+}
+
+// each calls fn with the entries from from to to
+func (l *LogT) each(from int, to int, fn func(index int, record []byte) error) error {
+	for index := from; index <= to; index++ {
+		record, err := l.entry(index)
+		if err != nil {
+			return err
+		}
+		err = fn(index, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateAfter drops the entries after keep
+func (l *LogT) truncateAfter(keep int) error {
+	if keep < l.base {
+		return fmt.Errorf("entry %d of shard %s was compacted", keep+1, l.shard)
+	}
+	if keep >= l.lastIndex() {
+		return nil
+	}
+	pos := l.offsets[keep-l.base]
+	for l.segments[len(l.segments)-1] != pos.seg {
+		last := l.segments[len(l.segments)-1]
+		_ = last.file.Close()
+		_ = os.Remove(last.path)
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+	err := pos.seg.file.Truncate(pos.offset)
+	if err != nil {
+		return err
+	}
+	pos.seg.size = pos.offset
+	l.offsets = l.offsets[:keep-l.base]
+	return nil
+}
+
+// compact forgets the entries up to upTo and deletes the segments holding nothing else. The
+// segment being written to is kept.
+func (l *LogT) compact(upTo int) error {
+	if upTo <= l.base {
+		return nil
+	}
+	if upTo > l.lastIndex() {
+		return fmt.Errorf("cannot compact shard %s past its last entry %d", l.shard, l.lastIndex())
+	}
+	l.offsets = append([]entryPos(nil), l.offsets[upTo-l.base:]...)
+	l.base = upTo
+	for len(l.segments) > 1 && l.segments[1].first <= upTo+1 {
+		_ = l.segments[0].file.Close()
+		err := os.Remove(l.segments[0].path)
+		if err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// reset drops every entry and continues the log after base
+func (l *LogT) reset(base int) error {
+	for _, seg := range l.segments {
+		_ = seg.file.Close()
+		_ = os.Remove(seg.path)
+	}
+	l.segments = nil
+	l.offsets = nil
+	l.base = base
+	return l.roll(base + 1)
+}
+
+func (l *LogT) close() {
+	for _, seg := range l.segments {
+		_ = seg.file.Close()
+	}
+}
+
+// checkpointState replays the entries up to upTo onto the state the compacted entries left,
+// giving the transaction and sequence state a snapshot at upTo carries. indexLock is held.
+func checkpointState(logT *LogT, upTo int) (shardSnapshot, error) {
+	state := shardSnapshot{
+		Index:    upTo,
+		Prepared: make(map[string][]StudT),
+		Decided:  make(map[string]string),
+	}
+	sequences := newSequenceState()
+	if logT.snapshot != nil {
+		for tx_id, data := range logT.snapshot.Prepared {
+			state.Prepared[tx_id] = data
+		}
+		for tx_id, outcome := range logT.snapshot.Decided {
+			state.Decided[tx_id] = outcome
+		}
+		state.Last_seq = logT.snapshot.Last_seq
+		state.Term = logT.snapshot.Term
+		sequences.restore(logT.snapshot.Recent)
+	}
+	sequences.entries = logT.base
+	err := logT.each(logT.base+1, upTo, func(index int, record []byte) error {
+		var logItem logPayload
+		err := json.Unmarshal(record, &logItem)
+		if err != nil {
+			return err
+		}
+		switch logItem.Operation {
+		case "p":
+			state.Prepared[logItem.Tx_id] = logItem.W_Data
+		case "c", "a":
+			state.Decided[logItem.Tx_id] = logItem.Operation
+			delete(state.Prepared, logItem.Tx_id)
+		}
+		if logItem.Seq > state.Last_seq {
+			state.Last_seq = logItem.Seq
+		}
+		sequences.observe(logItem)
+		state.Term = logItem.Raft_term
+		return nil
+	})
+	state.Recent = sequences.records(upTo)
+	return state, err
+}
+
+// checkpoint truncates the log of a shard up to upTo, or as far as this server applied it,
+// once enough entries piled up. The state the dropped entries leave besides the rows is saved
+// next to the applied index first. indexLock is held.
+func checkpoint(shard_ string, upTo int) error {
+	logT, ok := g_shard_log_map[shard_]
+	if !ok {
+		return nil
+	}
+	if upTo > *logT.index {
+		upTo = *logT.index
+	}
+	if upTo-logT.base < checkpointEntries {
+		return nil
+	}
+	state, err := checkpointState(logT, upTo)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = replaceFile(checkpointPath(shard_), data)
+	if err != nil {
+		return err
+	}
+	logT.snapshot = &state
+	err = logT.compact(upTo)
+	if err != nil {
+		return err
+	}
+	log.Printf("Checkpointed shard %s at entry %d", shard_, upTo)
+	return nil
+}
+
+// appliedEverywhere is the lowest index every replica of a shard has applied, false when a
+// replica could not tell
+func appliedEverywhere(shard_ string, own int) (int, bool) {
+	others, _, err := getSecondaries(shard_)
+	if err != nil {
+		log.Printf("Error getting replicas of shard %s:%v", shard_, err)
+		return 0, false
+	}
+	lowest := own
+	for _, server := range others {
+		_, body, err := appliedCall.send(context.Background(), http.MethodGet, fmt.Sprintf("http://%s:5000/applied", server), nil, nil, acceptOK)
+		if err != nil {
+			return 0, false
+		}
+		var applied map[string]int
+		err = json.Unmarshal(body, &applied)
+		if err != nil {
+			return 0, false
+		}
+		index, ok := applied[shard_]
+		if !ok {
+			return 0, false
+		}
+		if index < lowest {
+			lowest = index
+		}
+	}
+	return lowest, true
+}
+
+// checkpointLogs periodically truncates the entries every replica of a shard has applied, so
+// a replica catching up never needs entries that are gone. Raft shards compact through their
+// snapshots instead.
+func checkpointLogs() {
+	for {
+		time.Sleep(checkpointInterval)
+		applied := make(map[string]int)
+		indexLock.Lock()
+		for shard_, logT := range g_shard_log_map {
+			if raftOf(shard_) == nil && *logT.index-logT.base >= checkpointEntries {
+				applied[shard_] = *logT.index
+			}
+		}
+		indexLock.Unlock()
+		for shard_, own := range applied {
+			upTo, ok := appliedEverywhere(shard_, own)
+			if !ok {
+				continue
+			}
+			indexLock.Lock()
+			err := checkpoint(shard_, upTo)
+			indexLock.Unlock()
+			if err != nil {
+				log.Printf("Error checkpointing shard %s:%v", shard_, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLog starts a log in a temporary directory with a segment starting at each of firsts.
+// Entries are written to the last segment.
+func testLog(t *testing.T, base int, firsts ...int) *LogT {
+	t.Helper()
+	l := &LogT{shard: "sh1", index: new(int), base: base, sync: newWalSync()}
+	for _, first := range firsts {
+		addSegment(t, l, first)
+	}
+	t.Cleanup(l.close)
+	return l
+}
+
+func addSegment(t *testing.T, l *LogT, first int) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), fmt.Sprintf("%s_%010d.wal", l.shard, first))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.segments = append(l.segments, &segment{first: first, path: path, file: file})
+}
+
+func payloadOf(index int) []byte {
+	return []byte(fmt.Sprintf(`{"Operation":"w","Seq":%d}`, index))
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		index   int
+		term    int
+		payload []byte
+	}{
+		{"empty payload", 1, 0, []byte{}},
+		{"json entry", 42, 3, payloadOf(42)},
+		{"large indices", 1 << 40, 1 << 33, []byte("x")},
+		{"large payload", 7, 1, bytes.Repeat([]byte("ab"), 1<<15)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := encodeRecord(tt.index, tt.term, tt.payload)
+			// a following record must not be read into this one
+			data := append(record, encodeRecord(tt.index+1, tt.term, []byte("next"))...)
+			index, term, payload, length, err := decodeRecord(data)
+			if err != nil {
+				t.Fatalf("decodeRecord: %v", err)
+			}
+			if index != tt.index || term != tt.term {
+				t.Errorf("got index %d term %d, want %d and %d", index, term, tt.index, tt.term)
+			}
+			if !bytes.Equal(payload, tt.payload) {
+				t.Errorf("got payload %q, want %q", payload, tt.payload)
+			}
+			if length != len(record) {
+				t.Errorf("got length %d, want %d", length, len(record))
+			}
+		})
+	}
+}
+
+func TestDecodeTornRecord(t *testing.T) {
+	record := encodeRecord(5, 2, payloadOf(5))
+	flip := func(at int) []byte {
+		data := append([]byte(nil), record...)
+		data[at] ^= 0xff
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"nothing", nil},
+		{"partial header", record[:recordHeader-1]},
+		{"header only", record[:recordHeader]},
+		{"partial payload", record[:len(record)-1]},
+		{"corrupt length", flip(3)},
+		{"corrupt crc", flip(4)},
+		{"corrupt term", flip(8)},
+		{"corrupt index", flip(16)},
+		{"corrupt payload", flip(len(record) - 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, _, err := decodeRecord(tt.data)
+			if !errors.Is(err, errTornRecord) {
+				t.Errorf("got %v, want %v", err, errTornRecord)
+			}
+		})
+	}
+}
+
+func TestScanCutsTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		// entries written before the tail
+		entries int
+		base    int
+		tail    func(next int) []byte
+		torn    bool
+	}{
+		{"clean", 3, 0, func(int) []byte { return nil }, false},
+		{"partial record", 3, 0, func(next int) []byte { return encodeRecord(next, 1, payloadOf(next))[:30] }, true},
+		{"corrupt record", 3, 0, func(next int) []byte {
+			data := encodeRecord(next, 1, payloadOf(next))
+			data[len(data)-1] ^= 0xff
+			return data
+		}, true},
+		{"out of order record", 3, 0, func(next int) []byte { return encodeRecord(next+1, 1, payloadOf(next+1)) }, true},
+		{"garbage", 2, 0, func(int) []byte { return []byte("garbage") }, true},
+		{"entries compacted", 4, 2, func(int) []byte { return nil }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sh1_0000000001.wal")
+			var data []byte
+			for index := 1; index <= tt.entries; index++ {
+				data = append(data, encodeRecord(index, 1, payloadOf(index))...)
+			}
+			good := int64(len(data))
+			err := os.WriteFile(path, append(data, tt.tail(tt.entries+1)...), 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			l := &LogT{shard: "sh1", index: new(int), base: tt.base, sync: newWalSync()}
+			seg := &segment{first: 1, path: path, file: file}
+			torn, err := l.scan(seg)
+			if err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			if torn != tt.torn {
+				t.Errorf("got torn %v, want %v", torn, tt.torn)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != good || seg.size != good {
+				t.Errorf("segment is %d bytes, size %d, want %d", info.Size(), seg.size, good)
+			}
+			l.segments = []*segment{seg}
+			if l.lastIndex() != tt.entries {
+				t.Fatalf("got last index %d, want %d", l.lastIndex(), tt.entries)
+			}
+			for index := tt.base + 1; index <= tt.entries; index++ {
+				payload, err := l.entry(index)
+				if err != nil || !bytes.Equal(payload, payloadOf(index)) {
+					t.Errorf("entry %d: got %q, %v", index, payload, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		keep     int
+		segments int
+		err      bool
+	}{
+		{"nothing to drop", 6, 2, false},
+		{"within the last segment", 5, 2, false},
+		{"emptying the last segment", 3, 2, false},
+		{"into the first segment", 2, 1, false},
+		{"everything after the base", 1, 1, false},
+		{"compacted entry", 0, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// entries 2-3 in the first segment, 4-6 in the second, entry 1 compacted
+			l := testLog(t, 1, 2)
+			for index := 2; index <= 6; index++ {
+				if index == 4 {
+					addSegment(t, l, 4)
+				}
+				err := l.Write(1, payloadOf(index))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			dropped := l.segments[1].path
+			err := l.truncateAfter(tt.keep)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want one: %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if l.lastIndex() != tt.keep || len(l.segments) != tt.segments {
+				t.Errorf("got last index %d in %d segments, want %d in %d", l.lastIndex(), len(l.segments), tt.keep, tt.segments)
+			}
+			if _, err := os.Stat(dropped); (err == nil) != (tt.segments == 2) {
+				t.Errorf("second segment exists: %v, want %v", err == nil, tt.segments == 2)
+			}
+			// the next entry continues right after keep
+			err = l.Write(2, payloadOf(tt.keep+1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for index := 2; index <= tt.keep+1; index++ {
+				payload, err := l.entry(index)
+				if err != nil || !bytes.Equal(payload, payloadOf(index)) {
+					t.Errorf("entry %d: got %q, %v", index, payload, err)
+				}
+			}
+			if term, err := l.termOf(tt.keep + 1); err != nil || term != 2 {
+				t.Errorf("got term %d, %v for the new entry, want 2", term, err)
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		name     string
+		upTo     int
+		base     int
+		segments int
+		err      bool
+	}{
+		{"nothing compacted", 0, 0, 3, false},
+		{"part of the first segment", 2, 2, 3, false},
+		{"whole first segment", 3, 3, 2, false},
+		{"into the last segment", 8, 8, 1, false},
+		{"every entry", 9, 9, 1, false},
+		{"past the last entry", 10, 0, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := testLog(t, 0, 1)
+			for index := 1; index <= 9; index++ {
+				if index == 4 || index == 7 {
+					addSegment(t, l, index)
+				}
+				err := l.Write(1, payloadOf(index))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := l.compact(tt.upTo)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want one: %v", err, tt.err)
+			}
+			if l.base != tt.base || len(l.segments) != tt.segments || l.lastIndex() != 9 {
+				t.Errorf("got base %d, %d segments, last index %d, want %d, %d, 9", l.base, len(l.segments), l.lastIndex(), tt.base, tt.segments)
+			}
+			if _, err := l.entry(tt.base); tt.base > 0 && err == nil {
+				t.Errorf("compacted entry %d is still readable", tt.base)
+			}
+			for index := tt.base + 1; index <= 9; index++ {
+				payload, err := l.entry(index)
+				if err != nil || !bytes.Equal(payload, payloadOf(index)) {
+					t.Errorf("entry %d: got %q, %v", index, payload, err)
+				}
+			}
+		})
+	}
+}
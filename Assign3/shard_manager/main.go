@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +9,7 @@ import (
 	"github.com/go-co-op/gocron"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"log"
 	"net/http"
 	"os/exec"
@@ -20,15 +21,49 @@ var (
 	mapdb             = &gorm.DB{}
 	active_containers = make(map[string]bool)
 	heartRmLock       = &sync.Mutex{}
+	// heartbeats and stats make one bounded attempt, the next round asks again
+	singleCall = retryPolicy{attempts: 1, callTimeout: defaultRetry.callTimeout}
+	// adding a shard copies it from the primary and is not repeated blindly
+	addCall = retryPolicy{attempts: 1, callTimeout: time.Duration(envInt("ADD_TIMEOUT_S", 120)) * time.Second}
 )
 
+// configureServer sends the shards of a freshly spawned server, retrying while it starts up
+func configureServer(server string, body configPayload) error {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	status, _, err := startupRetry.send(context.Background(), http.MethodPost, fmt.Sprintf("http://%s:5000/config", server), jsonBody, nil, acceptAnswer)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("server responded with %d", status)
+	}
+	return err
+}
+
+// dataVolume names the volume a server keeps its /data in
+func dataVolume(server string) string {
+	return server + "_data"
+}
+
+// runArgs starts a server container with its data volume mounted at /data
+func runArgs(server string) []string {
+	return []string{"run", "-d", "--name", server, "-p", ":5000", "--network", "assign3_net1", "--network-alias", server, "-e", fmt.Sprintf("SERVER_ID=%s", server), "-v", dataVolume(server) + ":/data", "server_image"}
+}
+
 func spawnContainer(server string) error {
 	cmd := exec.Command("docker", "rm", "-f", server)
 	err := cmd.Run()
 	if err != nil {
 		return err
 	}
-	cmd = exec.Command("docker", "run", "-d", "--name", server, "-p", ":5000", "--network", "assign3_net1", "--network-alias", server, "-e", fmt.Sprintf("SERVER_ID=%s", server), "server_image")
+	// the volume outlives the container, so a respawned server recovers its shards from it
+	cmd = exec.Command("docker", "volume", "create", "--label", "assign3.server="+server, dataVolume(server))
+	err = cmd.Run()
+	if err != nil {
+		log.Printf("Error creating data volume for %s: %v", server, err)
+		return err
+	}
+	cmd = exec.Command("docker", runArgs(server)...)
 	err = cmd.Run()
 	if err != nil {
 		log.Printf("Error spawning new server container for %s: %v", server, err)
@@ -46,6 +81,12 @@ func removeContainer(server string) error {
 		log.Printf("Error removing server container for %s: %v", server, err)
 		return err
 	}
+	// a server removed for good takes its data along, a later one of the same name starts empty
+	cmd = exec.Command("docker", "volume", "rm", dataVolume(server))
+	err = cmd.Run()
+	if err != nil {
+		log.Printf("Error removing data volume of %s: %v", server, err)
+	}
 	fmt.Printf("\n%s removed successfully. \n", server)
 
 	delete(active_containers, server)
@@ -62,6 +103,30 @@ func initHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
 		return
 	}
+	err = checkModes(payload.Shards)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("<Error> %v", err), "status": "failure"})
+		return
+	}
+	planLock.Lock()
+	defer planLock.Unlock()
+	// several balancers may forward /init, only the first one configures the database
+	var configured int64
+	err = mapdb.Model(&ShardT{}).Count(&configured).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error reading map_db", "status": "failure"})
+		return
+	}
+	if configured != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Database already configured", "status": "failure"})
+		return
+	}
+	payload.Servers, err = planServers(payload.N, payload.Shards, payload.Servers)
+	if err != nil {
+		log.Printf("Error planning placement: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("<Error> %v", err), "status": "failure"})
+		return
+	}
 	var spawned []string
 	for server := range payload.Servers {
 		err := spawnContainer(server)
@@ -74,19 +139,11 @@ func initHandler(c *gin.Context) {
 	}
 	for _, server := range spawned {
 		shards := payload.Servers[server]
-		var body configPayload
-		body.Shards = shards
-		jsonBody, err := json.Marshal(body)
-		configEndpoint := fmt.Sprintf("http://%s:5000/config", server)
-		post, err := http.Post(configEndpoint, "application/json", bytes.NewReader(jsonBody))
-		for {
-			if err == nil {
-				break
-			}
-			post, err = http.Post(configEndpoint, "application/json", bytes.NewReader(jsonBody))
-		}
-		if post.StatusCode != http.StatusOK {
-			log.Printf("\nError configuring server: %v, %v\n", server, err)
+		err := configureServer(server, configPayload{Shards: shards, Modes: modesOf(shards, payload.Shards)})
+		if err != nil {
+			log.Printf("Error configuring server %s: %v", server, err)
+			c.JSON(retryStatus(err), gin.H{"message": "Error configuring server", "status": "failure"})
+			return
 		}
 		var mapTs []MapT
 		for _, shard_ := range shards {
@@ -99,12 +156,19 @@ func initHandler(c *gin.Context) {
 			return
 		}
 	}
+	err = createShards(payload.Shards)
+	if err != nil {
+		log.Printf("Error adding shards: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error adding shards", "status": "failure"})
+		return
+	}
 	for _, shard_ := range payload.Shards {
 		reElect(shard_.Shard_id)
 	}
 
 	// return OK
-	c.JSON(http.StatusOK, gin.H{"message": "Configured Database", "status": "success"})
+	go notifyBalancer(syncPayload{})
+	c.JSON(http.StatusOK, gin.H{"message": "Configured Database", "servers": payload.Servers, "status": "success"})
 }
 
 func addHandler(c *gin.Context) {
@@ -117,6 +181,19 @@ func addHandler(c *gin.Context) {
 		return
 	}
 	log.Printf("add Payload: %v", payload)
+	err = checkModes(payload.New_shards)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("<Error> %v", err), "status": "failure"})
+		return
+	}
+	planLock.Lock()
+	defer planLock.Unlock()
+	payload.Servers, err = planServers(payload.N, payload.New_shards, payload.Servers)
+	if err != nil {
+		log.Printf("Error planning placement: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("<Error> %v", err), "status": "failure"})
+		return
+	}
 	var spawned map[string]configPayload
 	spawned = make(map[string]configPayload)
 	for server, shards := range payload.Servers {
@@ -127,7 +204,7 @@ func addHandler(c *gin.Context) {
 				c.JSON(http.StatusInternalServerError, gin.H{"message": "Error spawning new servers", "status": "failure"})
 				return
 			}
-			spawned[server] = configPayload{Shards: shards}
+			spawned[server] = configPayload{Shards: shards, Modes: modesOf(shards, payload.New_shards)}
 		} else {
 			for _, shard_ := range shards {
 				// check if shard already exists for server
@@ -139,10 +216,10 @@ func addHandler(c *gin.Context) {
 					return
 				}
 				if err != nil {
-					res, err := http.Post(fmt.Sprintf("http://%s:5000/add", server), "application/json", bytes.NewBuffer([]byte(fmt.Sprintf(`{"shard": "%s"}`, shard_))))
-					if err != nil || res.StatusCode != http.StatusOK {
+					err := addShard(server, shard_, modesOf([]string{shard_}, payload.New_shards)[shard_])
+					if err != nil {
 						log.Printf("Error adding shard %s to server %s: %v", shard_, server, err)
-						c.JSON(http.StatusInternalServerError, gin.H{"message": "Error adding shard to new servers", "status": "failure"})
+						c.JSON(retryStatus(err), gin.H{"message": "Error adding shard to new servers", "status": "failure"})
 						return
 					}
 					err = mapdb.Create(&MapT{Shard_id: shard_, Server_id: server, Primary: false}).Error
@@ -156,18 +233,10 @@ func addHandler(c *gin.Context) {
 		}
 	}
 	for server, body := range spawned {
-		jsonBody, err := json.Marshal(body)
-		configEndpoint := fmt.Sprintf("http://%s:5000/config", server)
-		post, err := http.Post(configEndpoint, "application/json", bytes.NewReader(jsonBody))
-		for {
-			if err == nil {
-				break
-			}
-			post, err = http.Post(configEndpoint, "application/json", bytes.NewReader(jsonBody))
-		}
-		if post.StatusCode != http.StatusOK {
+		err := configureServer(server, body)
+		if err != nil {
 			log.Printf("Error configuring server %s: %v", server, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error configuring server", "status": "failure"})
+			c.JSON(retryStatus(err), gin.H{"message": "Error configuring server", "status": "failure"})
 			return
 		}
 		var mapTs []MapT
@@ -181,11 +250,18 @@ func addHandler(c *gin.Context) {
 			return
 		}
 	}
+	err = createShards(payload.New_shards)
+	if err != nil {
+		log.Printf("Error adding shards: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error adding shards", "status": "failure"})
+		return
+	}
 	for _, shard_ := range payload.New_shards {
 		reElect(shard_.Shard_id)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Added new servers", "status": "success"})
+	go notifyBalancer(syncPayload{})
+	c.JSON(http.StatusOK, gin.H{"message": "Added new servers", "servers": payload.Servers, "status": "success"})
 }
 
 func rmHandler(c *gin.Context) {
@@ -200,6 +276,47 @@ func rmHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
 		return
 	}
+	planLock.Lock()
+	defer planLock.Unlock()
+	// re-replicate the shards of the removed servers while their primaries are still up
+	p, _, err := getPlacement()
+	if err != nil {
+		log.Printf("Error getting placement: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error getting servers", "status": "failure"})
+		return
+	}
+	removing := make(map[string]bool)
+	for _, server := range payload.Servers {
+		removing[server] = true
+	}
+	targets, err := getTargets()
+	if err != nil {
+		log.Printf("Error getting replica targets: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error getting shards", "status": "failure"})
+		return
+	}
+	remaining := p.without(removing)
+	added := make(map[string][]string)
+	for _, server := range payload.Servers {
+		for shard_ := range p[server] {
+			want, ok := targets[shard_]
+			if !ok {
+				want = replicationFactor
+			}
+			for _, target := range remaining.placeShard(shard_, want, nil) {
+				err := addReplica(target, shard_)
+				if err != nil {
+					log.Printf("Error adding shard %s to server %s: %v", shard_, target, err)
+					delete(remaining[target], shard_)
+					continue
+				}
+				added[target] = append(added[target], shard_)
+			}
+			if remaining.replicas(shard_) == 0 {
+				log.Printf("Shard %s has no replicas left after removing %v", shard_, payload.Servers)
+			}
+		}
+	}
 	heartRmLock.Lock()
 	err = mapdb.Where("server_id IN ?", payload.Servers).Delete(&MapT{}).Error
 	if err != nil {
@@ -246,10 +363,15 @@ func rmHandler(c *gin.Context) {
 			reElect(shard_)
 		}
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Removed servers", "status": "success"})
+	go notifyBalancer(syncPayload{})
+	c.JSON(http.StatusOK, gin.H{"message": "Removed servers", "added": added, "status": "success"})
 }
 
 func reElect(shard string) {
+	// raft replicas elect their leader themselves and report it to leaderHandler
+	if modesOf([]string{shard}, nil)[shard] == "raft" {
+		return
+	}
 	mostUpdated := ""
 	longestLog := -1
 	//get list of servers in shard
@@ -259,13 +381,24 @@ func reElect(shard string) {
 		log.Printf("Error getting servers for shard %s: %v", shard, err)
 		return
 	}
+	// count primaries per server so that ties go to the server leading the fewest shards
+	var primaryTs []MapT
+	err = mapdb.Where("`primary` = ? AND shard_id <> ?", true, shard).Find(&primaryTs).Error
+	if err != nil {
+		log.Printf("Error getting primaries: %v", err)
+		return
+	}
+	primaryCount := make(map[string]int)
+	for _, mapT := range primaryTs {
+		primaryCount[mapT.Server_id]++
+	}
 
 	for _, mapT := range mapTs {
 		server := mapT.Server_id
 		// get log length
 		jsonValue, _ := json.Marshal(gin.H{"shard": shard})
-		res, err := http.Post(fmt.Sprintf("http://%s:5000/lenlog", server), "application/json", bytes.NewBuffer(jsonValue))
-		if err != nil || res.StatusCode != http.StatusOK {
+		_, body, err := defaultRetry.send(context.Background(), http.MethodPost, fmt.Sprintf("http://%s:5000/lenlog", server), jsonValue, nil, acceptOK)
+		if err != nil {
 			log.Printf("Error getting log length from %s: %v", server, err)
 			continue
 		}
@@ -273,12 +406,12 @@ func reElect(shard string) {
 		var resStruct struct {
 			Length int
 		}
-		err = json.NewDecoder(res.Body).Decode(&resStruct)
+		err = json.Unmarshal(body, &resStruct)
 		if err != nil {
 			log.Printf("Error decoding response from %s: %v", server, err)
 			continue
 		}
-		if resStruct.Length > longestLog {
+		if resStruct.Length > longestLog || (resStruct.Length == longestLog && primaryCount[server] < primaryCount[mostUpdated]) {
 			longestLog = resStruct.Length
 			mostUpdated = server
 		}
@@ -288,6 +421,7 @@ func reElect(shard string) {
 		return
 	}
 	// set primary
+	var term int
 	err = mapdb.Transaction(func(tx *gorm.DB) error {
 		err := tx.Model(&MapT{}).Where("shard_id = ?", shard).Update("primary", false).Error
 		if err != nil {
@@ -299,13 +433,89 @@ func reElect(shard string) {
 			log.Printf("Error updating primary for shard %s: %v", shard, err)
 			return err
 		}
-		return nil
+		// every election starts a new term
+		err = tx.Model(&ShardT{}).Where("shard_id = ?", shard).Update("term", gorm.Expr("term + 1")).Error
+		if err != nil {
+			log.Printf("Error updating term for shard %s: %v", shard, err)
+			return err
+		}
+		return tx.Model(&ShardT{}).Where("shard_id = ?", shard).Pluck("term", &term).Error
 	})
 	if err != nil {
 		log.Printf("Error updating primary for shard %s: %v", shard, err)
 		return
 	}
-	fmt.Printf("\n%s elected as primary for shard %s\n", mostUpdated, shard)
+	fmt.Printf("\n%s elected as primary for shard %s in term %d\n", mostUpdated, shard, term)
+	// fence the old primary on the replicas before the balancers route to the new one
+	announceTerm(shard, term, mapTs)
+	go notifyBalancer(syncPayload{})
+}
+
+// announceTerm tells the replicas of a shard about a new term, after which they refuse
+// requests carrying an older one. Replicas that cannot be reached learn it from the next
+// replicated request.
+func announceTerm(shard string, term int, mapTs []MapT) {
+	body, _ := json.Marshal(gin.H{"shard": shard, "term": term})
+	var wg sync.WaitGroup
+	for _, mapT := range mapTs {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			_, _, err := singleCall.send(context.Background(), http.MethodPost, fmt.Sprintf("http://%s:5000/term", server), body, nil, acceptOK)
+			if err != nil {
+				log.Printf("Error announcing term %d of shard %s to %s: %v", term, shard, server, err)
+			}
+		}(mapT.Server_id)
+	}
+	wg.Wait()
+}
+
+// leaderHandler records the leader a raft shard elected as its primary and pushes it to the
+// balancers. Reports from a term older than the recorded one are ignored.
+func leaderHandler(c *gin.Context) {
+	var payload struct {
+		Shard  string `json:"shard"`
+		Server string `json:"server"`
+		Term   int    `json:"term"`
+	}
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
+		return
+	}
+	stale := false
+	err = mapdb.Transaction(func(tx *gorm.DB) error {
+		var shardT ShardT
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("shard_id = ?", payload.Shard).First(&shardT).Error
+		if err != nil {
+			return err
+		}
+		if payload.Term < shardT.Term {
+			stale = true
+			return nil
+		}
+		err = tx.Model(&MapT{}).Where("shard_id = ?", payload.Shard).Update("primary", false).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&MapT{}).Where("shard_id = ? AND server_id = ?", payload.Shard, payload.Server).Update("primary", true).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&ShardT{}).Where("shard_id = ?", payload.Shard).Update("term", payload.Term).Error
+	})
+	if err != nil {
+		log.Printf("Error recording leader of shard %s: %v", payload.Shard, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error recording leader", "status": "failure"})
+		return
+	}
+	if stale {
+		c.JSON(http.StatusOK, gin.H{"message": "Stale term", "status": "failure"})
+		return
+	}
+	fmt.Printf("\n%s elected as leader for shard %s in term %d\n", payload.Server, payload.Shard, payload.Term)
+	go notifyBalancer(syncPayload{})
+	c.JSON(http.StatusOK, gin.H{"message": "Leader recorded", "status": "success"})
 }
 
 func main() {
@@ -315,6 +525,9 @@ func main() {
 	r.POST("/init", initHandler)
 	r.POST("/add", addHandler)
 	r.POST("/rm", rmHandler)
+	r.GET("/view", viewHandler)
+	r.POST("/register", registerHandler)
+	r.POST("/leader", leaderHandler)
 	mapdb = initDB()
 
 	//check heartbeat and respawn if needed
@@ -323,6 +536,16 @@ func main() {
 	if err != nil {
 		return
 	}
+	//top up under-replicated shards
+	_, err = s.Every(10).Seconds().SingletonMode().Do(checkReplication)
+	if err != nil {
+		return
+	}
+	//move replicas off overloaded servers
+	_, err = s.Every(30).Seconds().SingletonMode().Do(rebalance)
+	if err != nil {
+		return
+	}
 	s.StartAsync()
 
 	port := "5000"
@@ -334,11 +557,16 @@ func main() {
 
 func initDB() *gorm.DB {
 	dsn := "root:abc@tcp(map_db)/map_db?charset=utf8mb4&parseTime=True&loc=Local"
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
-	for err != nil {
+	var db *gorm.DB
+	err := startupRetry.do(context.Background(), func(ctx context.Context) error {
+		var err error
 		db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Error connecting to database: %v", err)
 	}
-	err = db.AutoMigrate(&MapT{})
+	err = db.AutoMigrate(&MapT{}, &ShardT{}, &IndexT{})
 	if err != nil {
 		log.Fatalf("Error migrating database: %v", err)
 	}
@@ -368,7 +596,7 @@ func checkHeartbeat() {
 	spawned = make(map[string]configPayload)
 	// get heartbeat from all servers and store unresponsive servers
 	for server := range server_shard_mapping {
-		_, err := http.Get(fmt.Sprintf("http://%s:5000/heartbeat", server))
+		_, _, err := singleCall.send(context.Background(), http.MethodGet, fmt.Sprintf("http://%s:5000/heartbeat", server), nil, nil, acceptAnswer)
 		if err != nil {
 			log.Printf("Error getting heartbeat from %s: %v", server, err)
 			var body configPayload
@@ -381,6 +609,7 @@ func checkHeartbeat() {
 			err = spawnContainer(server)
 			if err != nil {
 				log.Printf("%v", err)
+				dropServer(server, body.Shards)
 				continue
 			}
 			spawned[server] = body
@@ -391,18 +620,23 @@ func checkHeartbeat() {
 	}
 	// spawn new containers for failed servers
 	for server, body := range spawned {
-		jsonBody, err := json.Marshal(body)
-		configEndpoint := fmt.Sprintf("http://%s:5000/config", server)
-		post, err := http.Post(configEndpoint, "application/json", bytes.NewReader(jsonBody))
-		for {
-			if err == nil {
-				break
-			}
-			post, err = http.Post(configEndpoint, "application/json", bytes.NewReader(jsonBody))
-		}
-		if post.StatusCode != http.StatusOK {
-			fmt.Printf("Error configuring server %s: %v", server, err)
+		body.Modes = modesOf(body.Shards, nil)
+		err := configureServer(server, body)
+		if err != nil {
+			log.Printf("Error configuring server %s: %v", server, err)
+			dropServer(server, body.Shards)
 			continue
 		}
 	}
 }
+
+// dropServer forgets a server that could not be brought back so that its shards count as
+// under-replicated and checkReplication places them elsewhere
+func dropServer(server string, shards []string) {
+	err := mapdb.Where("server_id = ?", server).Delete(&MapT{}).Error
+	if err != nil {
+		log.Printf("Error removing server %s: %v", server, err)
+		return
+	}
+	go notifyBalancer(syncPayload{Removed: map[string][]string{server: shards}})
+}
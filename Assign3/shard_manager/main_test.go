@@ -0,0 +1,16 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunArgsMountsDataVolume(t *testing.T) {
+	args := strings.Join(runArgs("Server7"), " ")
+	if !strings.Contains(args, "-v Server7_data:/data") {
+		t.Errorf("got %s, want Server7_data mounted at /data", args)
+	}
+	if !strings.HasSuffix(args, "server_image") {
+		t.Errorf("got %s, want the image last", args)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	replicationFactor  = envInt("REPLICATION_FACTOR", 3)
+	serverCapacity     = envInt("SERVER_CAPACITY", 0)
+	rebalanceThreshold = envFloat("REBALANCE_THRESHOLD", 0.25)
+	rowWeight          = envFloat("ROW_WEIGHT", 0.01)
+	lastRequests       = make(map[string]map[string]int)
+	planLock           = &sync.Mutex{}
+	// how often balancers pull the view, so one that missed a push has it after this long
+	balancerReconcile = time.Duration(envInt("VIEW_RECONCILE_S", 10)) * time.Second
+)
+
+// placement maps every server to the set of shards it holds
+type placement map[string]map[string]bool
+
+func envFloat(name string, def float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// getPlacement reads the current placement and the primary of every shard from map_db
+func getPlacement() (placement, map[string]string, error) {
+	var mapTs []MapT
+	err := mapdb.Find(&mapTs).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	p := make(placement)
+	primaries := make(map[string]string)
+	for _, mapT := range mapTs {
+		p.add(mapT.Server_id, mapT.Shard_id)
+		if mapT.Primary {
+			primaries[mapT.Shard_id] = mapT.Server_id
+		}
+	}
+	return p, primaries, nil
+}
+
+// getTargets reads the desired replica count of every shard from map_db
+func getTargets() (map[string]int, error) {
+	var shardTs []ShardT
+	err := mapdb.Find(&shardTs).Error
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]int)
+	for _, shardT := range shardTs {
+		targets[shardT.Shard_id] = shardT.Target_replicas
+	}
+	return targets, nil
+}
+
+func targetOf(shard_ shard) int {
+	if shard_.Target_replicas > 0 {
+		return shard_.Target_replicas
+	}
+	return replicationFactor
+}
+
+// createShards stores the range and desired replica count of new shards next to MapT, so a
+// restarted balancer can rebuild its routing table
+func createShards(shards []shard) error {
+	if len(shards) == 0 {
+		return nil
+	}
+	var shardTs []ShardT
+	for _, shard_ := range shards {
+		shardTs = append(shardTs, ShardT{Shard_id: shard_.Shard_id, Target_replicas: targetOf(shard_), Stud_id_low: shard_.Stud_id_low, Shard_size: shard_.Shard_size, Mode: shard_.Mode})
+	}
+	return mapdb.Create(&shardTs).Error
+}
+
+// checkModes rejects replication modes other than raft
+func checkModes(shards []shard) error {
+	for _, shard_ := range shards {
+		if shard_.Mode != "" && shard_.Mode != "raft" {
+			return fmt.Errorf("unknown mode %q for shard %s", shard_.Mode, shard_.Shard_id)
+		}
+	}
+	return nil
+}
+
+// modesOf finds the replication mode of the listed shards that are not replicated by their
+// primary, taking shards that are not stored yet from fresh
+func modesOf(shards []string, fresh []shard) map[string]string {
+	listed := make(map[string]bool)
+	for _, shard_ := range shards {
+		listed[shard_] = true
+	}
+	modes := make(map[string]string)
+	for _, shard_ := range fresh {
+		if listed[shard_.Shard_id] && shard_.Mode != "" {
+			modes[shard_.Shard_id] = shard_.Mode
+		}
+	}
+	var shardTs []ShardT
+	err := mapdb.Where("shard_id IN ? AND mode <> ?", shards, "").Find(&shardTs).Error
+	if err != nil {
+		log.Printf("Error getting modes of shards: %v", err)
+	}
+	for _, shardT := range shardTs {
+		modes[shardT.Shard_id] = shardT.Mode
+	}
+	return modes
+}
+
+func (p placement) add(server string, shard_ string) {
+	if p[server] == nil {
+		p[server] = make(map[string]bool)
+	}
+	p[server][shard_] = true
+}
+
+func (p placement) replicas(shard_ string) int {
+	count := 0
+	for _, shards := range p {
+		if shards[shard_] {
+			count++
+		}
+	}
+	return count
+}
+
+func (p placement) hasCapacity(server string) bool {
+	return serverCapacity <= 0 || len(p[server]) < serverCapacity
+}
+
+// without returns a copy of the placement that leaves out the given servers
+func (p placement) without(servers map[string]bool) placement {
+	q := make(placement)
+	for server, shards := range p {
+		if servers[server] {
+			continue
+		}
+		q[server] = make(map[string]bool)
+		for shard_ := range shards {
+			q[server][shard_] = true
+		}
+	}
+	return q
+}
+
+// candidates lists the servers that can take a replica of the shard, least loaded first
+func (p placement) candidates(shard_ string, exclude map[string]bool) []string {
+	var servers []string
+	for server, shards := range p {
+		if shards[shard_] || exclude[server] || !p.hasCapacity(server) {
+			continue
+		}
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if len(p[servers[i]]) != len(p[servers[j]]) {
+			return len(p[servers[i]]) < len(p[servers[j]])
+		}
+		return servers[i] < servers[j]
+	})
+	return servers
+}
+
+// placeShard tops the shard up to want replicas and returns the servers it was placed on
+func (p placement) placeShard(shard_ string, want int, exclude map[string]bool) []string {
+	var chosen []string
+	for _, server := range p.candidates(shard_, exclude) {
+		if p.replicas(shard_) >= want {
+			break
+		}
+		p.add(server, shard_)
+		chosen = append(chosen, server)
+	}
+	return chosen
+}
+
+// freeName picks the next ServerX name that is neither placed nor running
+func (p placement) freeName() string {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("Server%d", i)
+		if _, ok := p[name]; ok {
+			continue
+		}
+		if _, ok := active_containers[name]; ok {
+			continue
+		}
+		return name
+	}
+}
+
+// planServers completes the placement requested at /init or /add. Explicit placements are
+// kept, missing servers are named up to n new ones and every new shard is spread over the
+// least loaded servers until it reaches the replication factor.
+func planServers(n int, newShards []shard, requested map[string][]string) (map[string][]string, error) {
+	p, _, err := getPlacement()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]string)
+	newServers := 0
+	for server, shards := range requested {
+		if _, ok := p[server]; !ok {
+			if _, ok := active_containers[server]; !ok {
+				newServers++
+			}
+			p[server] = make(map[string]bool)
+		}
+		for _, shard_ := range shards {
+			p.add(server, shard_)
+		}
+		if serverCapacity > 0 && len(p[server]) > serverCapacity {
+			return nil, fmt.Errorf("server %s exceeds capacity of %d shards", server, serverCapacity)
+		}
+		result[server] = append(result[server], shards...)
+	}
+	for ; newServers < n; newServers++ {
+		name := p.freeName()
+		p[name] = make(map[string]bool)
+		result[name] = make([]string, 0)
+	}
+	for _, shard_ := range newShards {
+		want := targetOf(shard_)
+		for _, server := range p.placeShard(shard_.Shard_id, want, nil) {
+			result[server] = append(result[server], shard_.Shard_id)
+		}
+		if p.replicas(shard_.Shard_id) == 0 {
+			return nil, fmt.Errorf("no capacity left for shard %s", shard_.Shard_id)
+		}
+		if p.replicas(shard_.Shard_id) < want {
+			log.Printf("Shard %s placed on %d of %d replicas", shard_.Shard_id, p.replicas(shard_.Shard_id), want)
+		}
+	}
+	return result, nil
+}
+
+// addReplica registers the replica first so the primary starts forwarding to it, then lets
+// the server copy the shard from the primary
+func addReplica(server string, shard_ string) error {
+	err := mapdb.Create(&MapT{Shard_id: shard_, Server_id: server, Primary: false}).Error
+	if err != nil {
+		return err
+	}
+	err = addShard(server, shard_, modesOf([]string{shard_}, nil)[shard_])
+	if err != nil {
+		mapdb.Where("shard_id = ? AND server_id = ?", shard_, server).Delete(&MapT{})
+		return err
+	}
+	return nil
+}
+
+// addShard has a running server copy a shard from its primary, or join the raft group of
+// the shard
+func addShard(server string, shard_ string, mode string) error {
+	body := []byte(fmt.Sprintf(`{"shard": "%s", "mode": "%s"}`, shard_, mode))
+	status, _, err := addCall.send(context.Background(), http.MethodPost, fmt.Sprintf("http://%s:5000/add", server), body, nil, acceptAnswer)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("server responded with %d", status)
+	}
+	return err
+}
+
+// unregisterReplica takes a secondary replica out of map_db, so views built from now on
+// leave it out
+func unregisterReplica(server string, shard_ string) error {
+	return mapdb.Where("shard_id = ? AND server_id = ? AND `primary` = ?", shard_, server, false).Delete(&MapT{}).Error
+}
+
+// removeCopy has a server drop its copy of a shard
+func removeCopy(server string, shard_ string) error {
+	body := []byte(fmt.Sprintf(`{"shard": "%s"}`, shard_))
+	_, _, err := defaultRetry.send(context.Background(), http.MethodDelete, fmt.Sprintf("http://%s:5000/rmshard", server), body, nil, acceptOK)
+	return err
+}
+
+// retireReplica removes the copy a moved replica left behind once the balancers route
+// without it. A balancer that did not confirm the push has pulled the view after its
+// reconcile interval.
+func retireReplica(source string, target string, shard_ string) {
+	err := notifyBalancer(syncPayload{Added: map[string][]string{target: {shard_}}, Removed: map[string][]string{source: {shard_}}})
+	if err != nil {
+		time.Sleep(balancerReconcile)
+	}
+	err = removeCopy(source, shard_)
+	if err != nil {
+		log.Printf("Error removing shard %s from %s: %v", shard_, source, err)
+	}
+}
+
+// notifyBalancer tells every registered load balancer about replicas that moved without going
+// through it and pushes the current view of every shard. It returns once every balancer
+// answered, with the first error if one did not take the view.
+func notifyBalancer(body syncPayload) error {
+	var err error
+	body.Version, body.View, err = buildView()
+	if err != nil {
+		log.Printf("Error building view: %v", err)
+	}
+	jsonBody, _ := json.Marshal(body)
+	var wg sync.WaitGroup
+	var failedLock sync.Mutex
+	var failed error
+	for _, balancer := range registeredBalancers() {
+		wg.Add(1)
+		go func(balancer string) {
+			defer wg.Done()
+			// views are versioned, so a push that arrived before its answer was lost is harmless
+			_, _, err := defaultRetry.send(context.Background(), http.MethodPost, fmt.Sprintf("http://%s:5000/sync", balancer), jsonBody, nil, acceptOK)
+			if err != nil {
+				log.Printf("Error syncing load balancer %s: %v", balancer, err)
+				failedLock.Lock()
+				if failed == nil {
+					failed = err
+				}
+				failedLock.Unlock()
+			}
+		}(balancer)
+	}
+	wg.Wait()
+	return failed
+}
+
+// collectStats asks every server for its per-shard request and row counts
+func collectStats(p placement) map[string]map[string]shardStats {
+	stats := make(map[string]map[string]shardStats)
+	for server := range p {
+		_, body, err := singleCall.send(context.Background(), http.MethodGet, fmt.Sprintf("http://%s:5000/stats", server), nil, nil, acceptOK)
+		if err != nil {
+			log.Printf("Error getting stats from %s: %v", server, err)
+			continue
+		}
+		var serverStats map[string]shardStats
+		err = json.Unmarshal(body, &serverStats)
+		if err != nil {
+			log.Printf("Error decoding stats from %s: %v", server, err)
+			continue
+		}
+		stats[server] = serverStats
+	}
+	return stats
+}
+
+// replicaLoad weighs the requests served since the last round together with the stored rows
+func replicaLoad(server string, shard_ string, stats shardStats) float64 {
+	if lastRequests[server] == nil {
+		lastRequests[server] = make(map[string]int)
+	}
+	requests := stats.Requests - lastRequests[server][shard_]
+	if requests < 0 {
+		// server was respawned and its counters restarted
+		requests = stats.Requests
+	}
+	lastRequests[server][shard_] = stats.Requests
+	return float64(requests) + rowWeight*float64(stats.Rows)
+}
+
+// rebalance moves at most one secondary replica per round from the most loaded server to
+// the least loaded one that can take it
+func rebalance() {
+	planLock.Lock()
+	defer planLock.Unlock()
+	heartRmLock.Lock()
+	defer heartRmLock.Unlock()
+	p, primaries, err := getPlacement()
+	if err != nil {
+		log.Printf("Error getting placement: %v", err)
+		return
+	}
+	if len(p) < 2 {
+		return
+	}
+	stats := collectStats(p)
+	serverLoad := make(map[string]float64)
+	shardLoad := make(map[string]map[string]float64)
+	total := 0.0
+	for server, shards := range p {
+		shardLoad[server] = make(map[string]float64)
+		for shard_ := range shards {
+			load := replicaLoad(server, shard_, stats[server][shard_])
+			shardLoad[server][shard_] = load
+			serverLoad[server] += load
+		}
+		total += serverLoad[server]
+	}
+	avg := total / float64(len(p))
+
+	source := ""
+	for server := range p {
+		if source == "" || serverLoad[server] > serverLoad[source] {
+			source = server
+		}
+	}
+	overCapacity := serverCapacity > 0 && len(p[source]) > serverCapacity
+	if !overCapacity && serverLoad[source] <= avg*(1+rebalanceThreshold) {
+		return
+	}
+	// heaviest replicas first
+	var shards []string
+	for shard_ := range p[source] {
+		if primaries[shard_] != source {
+			shards = append(shards, shard_)
+		}
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return shardLoad[source][shards[i]] > shardLoad[source][shards[j]]
+	})
+	for _, shard_ := range shards {
+		load := shardLoad[source][shard_]
+		target := ""
+		for _, server := range p.candidates(shard_, map[string]bool{source: true}) {
+			if target == "" || serverLoad[server] < serverLoad[target] {
+				target = server
+			}
+		}
+		if target == "" {
+			continue
+		}
+		if !overCapacity && serverLoad[target]+load >= serverLoad[source]-load {
+			continue
+		}
+		log.Printf("Moving shard %s from %s to %s", shard_, source, target)
+		err := addReplica(target, shard_)
+		if err != nil {
+			log.Printf("Error adding shard %s to %s: %v", shard_, target, err)
+			continue
+		}
+		err = unregisterReplica(source, shard_)
+		if err != nil {
+			log.Printf("Error unregistering shard %s on %s: %v", shard_, source, err)
+			return
+		}
+		// balancers keep reading from the source until they take the new view, so its copy
+		// stays until they confirm. The balancer may be waiting on us inside /rm, so this
+		// does not run under the locks.
+		go retireReplica(source, target, shard_)
+		return
+	}
+}
+
+// checkReplication adds replicas to every shard that has fewer than its target, copying
+// from the current primary through the server /add path
+func checkReplication() {
+	planLock.Lock()
+	defer planLock.Unlock()
+	heartRmLock.Lock()
+	defer heartRmLock.Unlock()
+	p, primaries, err := getPlacement()
+	if err != nil {
+		log.Printf("Error getting placement: %v", err)
+		return
+	}
+	targets, err := getTargets()
+	if err != nil {
+		log.Printf("Error getting replica targets: %v", err)
+		return
+	}
+	added := make(map[string][]string)
+	for shard_, target := range targets {
+		current := p.replicas(shard_)
+		if current >= target {
+			continue
+		}
+		if primaries[shard_] == "" {
+			log.Printf("Shard %s is under-replicated (%d/%d) but has no primary to copy from", shard_, current, target)
+			continue
+		}
+		log.Printf("Shard %s is under-replicated (%d/%d)", shard_, current, target)
+		for _, server := range p.placeShard(shard_, target, nil) {
+			err := addReplica(server, shard_)
+			if err != nil {
+				log.Printf("Error adding shard %s to %s: %v", shard_, server, err)
+				delete(p[server], shard_)
+				continue
+			}
+			added[server] = append(added[server], shard_)
+		}
+		if p.replicas(shard_) < target {
+			log.Printf("Shard %s still has %d of %d replicas, no server can take more", shard_, p.replicas(shard_), target)
+		}
+	}
+	if len(added) != 0 {
+		go notifyBalancer(syncPayload{Added: added})
+	}
+}
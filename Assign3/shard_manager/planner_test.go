@@ -0,0 +1,198 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func placementOf(servers map[string][]string) placement {
+	p := make(placement)
+	for server, shards := range servers {
+		p[server] = make(map[string]bool)
+		for _, shard_ := range shards {
+			p.add(server, shard_)
+		}
+	}
+	return p
+}
+
+func TestPlaceShard(t *testing.T) {
+	defer func(capacity int) { serverCapacity = capacity }(serverCapacity)
+	tests := []struct {
+		name     string
+		servers  map[string][]string
+		capacity int
+		want     int
+		exclude  map[string]bool
+		chosen   []string
+	}{
+		{
+			name:    "least loaded first",
+			servers: map[string][]string{"Server0": {"sh1", "sh2"}, "Server1": {}, "Server2": {"sh2"}},
+			want:    2,
+			chosen:  []string{"Server1", "Server2"},
+		},
+		{
+			name:    "ties broken by name",
+			servers: map[string][]string{"Server2": {}, "Server0": {}, "Server1": {}},
+			want:    2,
+			chosen:  []string{"Server0", "Server1"},
+		},
+		{
+			name:    "existing replicas count",
+			servers: map[string][]string{"Server0": {"sh9"}, "Server1": {}, "Server2": {}},
+			want:    2,
+			chosen:  []string{"Server1"},
+		},
+		{
+			name:    "already placed",
+			servers: map[string][]string{"Server0": {"sh9"}, "Server1": {"sh9"}, "Server2": {}},
+			want:    2,
+			chosen:  nil,
+		},
+		{
+			name:    "excluded servers are skipped",
+			servers: map[string][]string{"Server0": {}, "Server1": {}, "Server2": {"sh1"}},
+			want:    2,
+			exclude: map[string]bool{"Server0": true},
+			chosen:  []string{"Server1", "Server2"},
+		},
+		{
+			name:     "full servers are skipped",
+			servers:  map[string][]string{"Server0": {"sh1", "sh2"}, "Server1": {"sh1"}, "Server2": {}},
+			capacity: 2,
+			want:     3,
+			chosen:   []string{"Server2", "Server1"},
+		},
+		{
+			name:    "fewer servers than wanted",
+			servers: map[string][]string{"Server0": {}},
+			want:    3,
+			chosen:  []string{"Server0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverCapacity = tt.capacity
+			p := placementOf(tt.servers)
+			chosen := p.placeShard("sh9", tt.want, tt.exclude)
+			if !reflect.DeepEqual(chosen, tt.chosen) {
+				t.Errorf("got %v, want %v", chosen, tt.chosen)
+			}
+			for _, server := range chosen {
+				if !p[server]["sh9"] {
+					t.Errorf("%s was chosen but does not hold the shard", server)
+				}
+			}
+		})
+	}
+}
+
+func TestFreeName(t *testing.T) {
+	defer func(running map[string]bool) { active_containers = running }(active_containers)
+	tests := []struct {
+		name    string
+		placed  []string
+		running []string
+		want    string
+	}{
+		{"empty", nil, nil, "Server0"},
+		{"placed names are taken", []string{"Server0", "Server1"}, nil, "Server2"},
+		{"running names are taken", []string{"Server0"}, []string{"Server1"}, "Server2"},
+		{"gaps are reused", []string{"Server0", "Server2"}, nil, "Server1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make(placement)
+			for _, server := range tt.placed {
+				p[server] = make(map[string]bool)
+			}
+			active_containers = make(map[string]bool)
+			for _, server := range tt.running {
+				active_containers[server] = true
+			}
+			if got := p.freeName(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicaLoad(t *testing.T) {
+	defer func(last map[string]map[string]int, weight float64) {
+		lastRequests, rowWeight = last, weight
+	}(lastRequests, rowWeight)
+	lastRequests = make(map[string]map[string]int)
+	rowWeight = 0.01
+	// rounds of one replica, each weighed against the round before
+	tests := []struct {
+		name  string
+		stats shardStats
+		want  float64
+	}{
+		{"first round counts every request", shardStats{Requests: 50, Rows: 1000}, 60},
+		{"requests since the last round", shardStats{Requests: 80, Rows: 1000}, 40},
+		{"idle", shardStats{Requests: 80, Rows: 500}, 5},
+		{"counters restarted", shardStats{Requests: 20, Rows: 0}, 20},
+	}
+	for _, tt := range tests {
+		if got := replicaLoad("Server0", "sh1", tt.stats); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTargetOf(t *testing.T) {
+	defer func(factor int) { replicationFactor = factor }(replicationFactor)
+	replicationFactor = 3
+	tests := []struct {
+		name  string
+		shard shard
+		want  int
+	}{
+		{"default factor", shard{Shard_id: "sh1"}, 3},
+		{"own target", shard{Shard_id: "sh1", Target_replicas: 5}, 5},
+		{"single replica", shard{Shard_id: "sh1", Target_replicas: 1}, 1},
+		{"negative falls back", shard{Shard_id: "sh1", Target_replicas: -2}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := targetOf(tt.shard); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReReplicate(t *testing.T) {
+	defer func(capacity int) { serverCapacity = capacity }(serverCapacity)
+	serverCapacity = 0
+	// Server1 died holding sh1, the survivors top it up again
+	tests := []struct {
+		name    string
+		servers map[string][]string
+		dead    map[string]bool
+		target  int
+		added   int
+		want    int
+	}{
+		{"one replica lost", map[string][]string{"Server0": {"sh1"}, "Server1": {"sh1"}, "Server2": {}}, map[string]bool{"Server1": true}, 2, 1, 2},
+		{"not enough servers left", map[string][]string{"Server0": {"sh1"}, "Server1": {"sh1"}}, map[string]bool{"Server1": true}, 2, 0, 1},
+		{"target raised", map[string][]string{"Server0": {"sh1"}, "Server1": {}, "Server2": {}}, nil, 3, 2, 3},
+		{"already at target", map[string][]string{"Server0": {"sh1"}, "Server1": {"sh1"}}, nil, 2, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := placementOf(tt.servers).without(tt.dead)
+			added := p.placeShard("sh1", tt.target, nil)
+			if len(added) != tt.added || p.replicas("sh1") != tt.want {
+				t.Errorf("added %v, %d replicas, want %d added and %d replicas", added, p.replicas("sh1"), tt.added, tt.want)
+			}
+			for server := range tt.dead {
+				if _, ok := p[server]; ok {
+					t.Errorf("dead server %s is still placed", server)
+				}
+			}
+		})
+	}
+}
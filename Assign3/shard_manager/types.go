@@ -8,9 +8,26 @@ import (
 )
 
 type shard struct {
-	Stud_id_low int
-	Shard_id    string
-	Shard_size  int
+	Stud_id_low     int
+	Shard_id        string
+	Shard_size      int
+	Target_replicas int
+	// "raft" has the replicas elect their own leader, empty leaves it to the shard manager
+	Mode string
+}
+
+// IndexT declares a secondary index on a column of the student table
+type IndexT struct {
+	Column string `gorm:"primaryKey"`
+}
+
+type ShardT struct {
+	Shard_id        string `gorm:"primaryKey"`
+	Target_replicas int
+	Stud_id_low     int
+	Shard_size      int
+	Term            int
+	Mode            string
 }
 
 type shardMetaData struct {
@@ -37,7 +54,8 @@ type student struct {
 }
 
 type configPayload struct {
-	Shards []string `json:"shards" binding:"required"`
+	Shards []string          `json:"shards" binding:"required"`
+	Modes  map[string]string `json:"modes,omitempty"`
 }
 
 type initPayload struct {
@@ -50,6 +68,29 @@ type readPayload struct {
 	Stud_id map[string]int `json:"Stud_id" binding:"required"`
 }
 
+type shardStats struct {
+	Requests int
+	Rows     int
+}
+
+// syncPayload tells the load balancer about replica moves and carries the placement of
+// every shard as of Version
+type syncPayload struct {
+	Added   map[string][]string
+	Removed map[string][]string
+	Version int64
+	View    map[string]shardView
+}
+
+type shardView struct {
+	Primary         string
+	Replicas        []string
+	Target_replicas int
+	Stud_id_low     int
+	Shard_size      int
+	Term            int
+}
+
 type readResponse struct {
 	Data   []student
 	Status string
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	viewVersion int64
+	viewLock    = &sync.Mutex{}
+	// balancers that registered for pushes and when they last did
+	balancers     = make(map[string]time.Time)
+	balancersLock = &sync.Mutex{}
+	balancerTTL   = time.Duration(envInt("BALANCER_TTL_S", 60)) * time.Second
+)
+
+// buildView reads the range, replicas and primary of every shard from map_db. Versions only grow,
+// across restarts too, and a later snapshot never holds an older placement than an earlier
+// one since both are taken under viewLock.
+func buildView() (int64, map[string]shardView, error) {
+	viewLock.Lock()
+	defer viewLock.Unlock()
+	viewVersion++
+	if now := time.Now().UnixNano(); now > viewVersion {
+		viewVersion = now
+	}
+	var mapTs []MapT
+	err := mapdb.Find(&mapTs).Error
+	if err != nil {
+		return 0, nil, err
+	}
+	var shardTs []ShardT
+	err = mapdb.Find(&shardTs).Error
+	if err != nil {
+		return 0, nil, err
+	}
+	view := make(map[string]shardView)
+	for _, shardT := range shardTs {
+		view[shardT.Shard_id] = shardView{Target_replicas: shardT.Target_replicas, Stud_id_low: shardT.Stud_id_low, Shard_size: shardT.Shard_size, Term: shardT.Term}
+	}
+	for _, mapT := range mapTs {
+		shardView_ := view[mapT.Shard_id]
+		shardView_.Replicas = append(shardView_.Replicas, mapT.Server_id)
+		if mapT.Primary {
+			shardView_.Primary = mapT.Server_id
+		}
+		view[mapT.Shard_id] = shardView_
+	}
+	return viewVersion, view, nil
+}
+
+// viewHandler serves the current view so a load balancer can reconcile missed pushes
+func viewHandler(c *gin.Context) {
+	version, view, err := buildView()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error reading map_db", "status": "failure"})
+		return
+	}
+	c.JSON(http.StatusOK, syncPayload{Version: version, View: view})
+}
+
+// registerHandler adds a load balancer to the ones the view is pushed to. Balancers register
+// again on every reconciliation, so one that stopped doing so is dropped after balancerTTL.
+func registerHandler(c *gin.Context) {
+	var payload struct {
+		Address string
+	}
+	err := json.Unmarshal([]byte(getJSONstring(c)), &payload)
+	if err != nil || payload.Address == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error decoding JSON", "status": "failure"})
+		return
+	}
+	balancersLock.Lock()
+	if _, ok := balancers[payload.Address]; !ok {
+		log.Printf("Load balancer %s registered", payload.Address)
+	}
+	balancers[payload.Address] = time.Now()
+	balancersLock.Unlock()
+	c.JSON(http.StatusOK, gin.H{"message": "Registered", "status": "success"})
+}
+
+// registeredBalancers lists the balancers that registered within balancerTTL
+func registeredBalancers() []string {
+	balancersLock.Lock()
+	defer balancersLock.Unlock()
+	var addresses []string
+	for address, seen := range balancers {
+		if time.Since(seen) > balancerTTL {
+			log.Printf("Load balancer %s expired", address)
+			delete(balancers, address)
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterBalancers(t *testing.T) {
+	defer func(ttl time.Duration) { balancerTTL = ttl }(balancerTTL)
+	balancerTTL = time.Minute
+	balancersLock.Lock()
+	balancers = map[string]time.Time{
+		"lb1": time.Now().Add(-2 * time.Minute),
+		"lb2": time.Now().Add(-2 * time.Minute),
+	}
+	balancersLock.Unlock()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/register", registerHandler)
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"address":"lb2"}`, http.StatusOK},
+		{`{"address":"lb3"}`, http.StatusOK},
+		{`{"address":""}`, http.StatusBadRequest},
+		{`{"address":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(tt.body)))
+		if recorder.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.body, recorder.Code, tt.status)
+		}
+	}
+	// lb1 stopped registering, lb2 came back in time
+	addresses := registeredBalancers()
+	sort.Strings(addresses)
+	if !reflect.DeepEqual(addresses, []string{"lb2", "lb3"}) {
+		t.Errorf("got %v, want lb2 and lb3", addresses)
+	}
+	if _, ok := balancers["lb1"]; ok {
+		t.Error("expired balancer was kept")
+	}
+}